@@ -0,0 +1,378 @@
+// Package access authenticates requests that arrive through Cloudflare Access
+// by validating the Cf-Access-Jwt-Assertion header against the team's JWKS.
+package access
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderName = "Cf-Access-Jwt-Assertion"
+	CookieName = "CF_Authorization"
+
+	ModePassword = "password"
+	ModeAccess   = "access"
+	ModeBoth     = "both"
+
+	defaultJWKSTTL   = time.Hour
+	minRefetchPeriod = time.Minute
+	clockLeeway      = time.Minute
+	maxJWKSSize      = 1 << 20
+)
+
+var (
+	ErrNoToken      = errors.New("no Cloudflare Access token")
+	ErrUnknownEmail = errors.New("email is not mapped to a user")
+)
+
+// Config describes the Access application the dashboard sits behind.
+type Config struct {
+	Mode       string
+	TeamDomain string
+	Audience   string
+	JWKSURL    string
+	JWKSTTL    time.Duration
+	Users      map[string]string
+}
+
+// Identity is the user behind a validated token.
+type Identity struct {
+	Email    string
+	Username string
+}
+
+type claims struct {
+	Email     string          `json:"email"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+	IssuedAt  int64           `json:"iat"`
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+var (
+	mu        sync.Mutex
+	cfg       = Config{Mode: ModePassword}
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	// attempts counts key set fetches so requests that waited on refreshMu
+	// can tell one was just made for them.
+	attempts int
+
+	// refreshMu lets one request fetch the key set while the others wait for
+	// it, without holding mu over the network call.
+	refreshMu sync.Mutex
+	client    = &http.Client{Timeout: 10 * time.Second}
+)
+
+// ConfigFromEnv reads AUTH_MODE, CF_ACCESS_TEAM_DOMAIN, CF_ACCESS_AUD,
+// CF_ACCESS_JWKS_URL, CF_ACCESS_JWKS_TTL and CF_ACCESS_USERS. The users list
+// maps emails to local usernames ("alice@example.com=admin,bob@example.com");
+// an email without "=name" keeps the email as its username.
+func ConfigFromEnv() (Config, error) {
+	c := Config{
+		Mode:       strings.ToLower(os.Getenv("AUTH_MODE")),
+		TeamDomain: strings.TrimSuffix(strings.TrimPrefix(os.Getenv("CF_ACCESS_TEAM_DOMAIN"), "https://"), "/"),
+		Audience:   os.Getenv("CF_ACCESS_AUD"),
+		JWKSURL:    os.Getenv("CF_ACCESS_JWKS_URL"),
+		JWKSTTL:    defaultJWKSTTL,
+		Users:      make(map[string]string),
+	}
+	if c.Mode == "" {
+		c.Mode = ModePassword
+	}
+	if c.Mode != ModePassword && c.Mode != ModeAccess && c.Mode != ModeBoth {
+		return c, fmt.Errorf("invalid AUTH_MODE %q (want password, access or both)", c.Mode)
+	}
+
+	if v := os.Getenv("CF_ACCESS_JWKS_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return c, fmt.Errorf("invalid CF_ACCESS_JWKS_TTL: %v", err)
+		}
+		c.JWKSTTL = d
+	}
+
+	for _, entry := range strings.Split(os.Getenv("CF_ACCESS_USERS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		email, user, found := strings.Cut(entry, "=")
+		email = strings.ToLower(strings.TrimSpace(email))
+		if !found || strings.TrimSpace(user) == "" {
+			user = email
+		}
+		c.Users[email] = strings.TrimSpace(user)
+	}
+
+	if c.Mode == ModePassword {
+		return c, nil
+	}
+	if c.Audience == "" {
+		return c, fmt.Errorf("CF_ACCESS_AUD is required when AUTH_MODE=%s", c.Mode)
+	}
+	if c.JWKSURL == "" {
+		if c.TeamDomain == "" {
+			return c, fmt.Errorf("CF_ACCESS_TEAM_DOMAIN or CF_ACCESS_JWKS_URL is required when AUTH_MODE=%s", c.Mode)
+		}
+		c.JWKSURL = "https://" + c.TeamDomain + "/cdn-cgi/access/certs"
+	}
+	return c, nil
+}
+
+// Configure installs c and drops any cached keys.
+func Configure(c Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	cfg = c
+	keys = nil
+	fetchedAt = time.Time{}
+}
+
+// Enabled reports whether Access tokens are accepted at all.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return cfg.Mode == ModeAccess || cfg.Mode == ModeBoth
+}
+
+// PasswordAllowed reports whether the local password login is still offered.
+func PasswordAllowed() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return cfg.Mode != ModeAccess
+}
+
+// Authenticate validates the Access token on r, taken from the header or, as a
+// fallback, the CF_Authorization cookie, and maps its email to a user.
+func Authenticate(r *http.Request) (*Identity, error) {
+	token := r.Header.Get(HeaderName)
+	if token == "" {
+		if c, err := r.Cookie(CookieName); err == nil {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		return nil, ErrNoToken
+	}
+
+	email, err := verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	users := cfg.Users
+	mu.Unlock()
+
+	username := email
+	if len(users) > 0 {
+		mapped, ok := users[strings.ToLower(email)]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownEmail, email)
+		}
+		username = mapped
+	}
+	return &Identity{Email: email, Username: username}, nil
+}
+
+func verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", fmt.Errorf("bad token header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return "", fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	key, err := keyFor(header.Kid)
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("bad token signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return "", errors.New("invalid token signature")
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return "", fmt.Errorf("bad token claims: %v", err)
+	}
+
+	mu.Lock()
+	audience, team := cfg.Audience, cfg.TeamDomain
+	mu.Unlock()
+
+	now := time.Now()
+	if c.ExpiresAt == 0 || now.After(time.Unix(c.ExpiresAt, 0).Add(clockLeeway)) {
+		return "", errors.New("token expired")
+	}
+	if c.NotBefore != 0 && now.Add(clockLeeway).Before(time.Unix(c.NotBefore, 0)) {
+		return "", errors.New("token not valid yet")
+	}
+	if !hasAudience(c.Audience, audience) {
+		return "", errors.New("token audience mismatch")
+	}
+	if team != "" && c.Issuer != "https://"+team {
+		return "", fmt.Errorf("unexpected token issuer %q", c.Issuer)
+	}
+	if c.Email == "" {
+		return "", errors.New("token has no email claim")
+	}
+	return c.Email, nil
+}
+
+// keyFor returns the signing key for kid. The key set is refreshed when the
+// cache expires or, at most once a minute, when an unknown kid shows up after
+// Cloudflare rotates its keys.
+func keyFor(kid string) (*rsa.PublicKey, error) {
+	key, stale, seen := cachedKey(kid)
+	if stale {
+		refreshMu.Lock()
+		mu.Lock()
+		url, again := cfg.JWKSURL, attempts == seen
+		mu.Unlock()
+		// Only fetch if nobody else did while this request waited
+		if again {
+			fresh, err := fetchKeys(url)
+			mu.Lock()
+			attempts++
+			if err != nil {
+				if keys == nil {
+					mu.Unlock()
+					refreshMu.Unlock()
+					return nil, err
+				}
+				// Keep serving from the old set if the refresh fails
+				log.Printf("Failed to refresh Access JWKS, keeping cached keys: %v", err)
+			} else {
+				keys = fresh
+				fetchedAt = time.Now()
+			}
+			mu.Unlock()
+		}
+		refreshMu.Unlock()
+		key, _, _ = cachedKey(kid)
+	}
+
+	if key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// cachedKey looks kid up in the cached key set and reports whether the set
+// should be fetched again, along with the number of fetches so far.
+func cachedKey(kid string) (key *rsa.PublicKey, stale bool, seen int) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	stale = keys == nil || time.Since(fetchedAt) > cfg.JWKSTTL
+	key = keys[kid]
+	if !stale && key == nil {
+		stale = time.Since(fetchedAt) > minRefetchPeriod
+	}
+	return key, stale, attempts
+}
+
+func fetchKeys(url string) (map[string]*rsa.PublicKey, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS: %v", err)
+	}
+
+	parsed := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || k.Kid == "" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+		parsed[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(parsed) == 0 {
+		return nil, errors.New("JWKS contains no usable RSA keys")
+	}
+	return parsed, nil
+}
+
+func hasAudience(raw json.RawMessage, want string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == want
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		for _, aud := range list {
+			if aud == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
@@ -0,0 +1,383 @@
+// Package ai talks to chat models behind one interface, so the assistant can
+// use Google Gemini, any OpenAI-compatible endpoint or a local Ollama or
+// llama.cpp server without the callers knowing which.
+package ai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Provider kinds accepted by New.
+const (
+	Gemini   = "gemini"
+	OpenAI   = "openai"
+	Ollama   = "ollama"
+	LlamaCpp = "llamacpp"
+)
+
+// Message roles. Providers translate them to their own names, e.g. "model"
+// for Gemini.
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	RoleTool      = "tool"
+)
+
+var ErrEmptyConversation = errors.New("ai: cannot send an empty conversation")
+
+type Message struct {
+	Role string `json:"role"`
+	Text string `json:"text"`
+	// ToolCalls are the functions an assistant message asks to have run.
+	ToolCalls []ToolCall `json:"toolCalls,omitempty"`
+	// ToolCallID and Name tie a tool message, whose Text is the result, to
+	// the call it answers.
+	ToolCallID string `json:"toolCallId,omitempty"`
+	Name       string `json:"name,omitempty"`
+	// Attachments are images or documents sent along with a user message.
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// Attachment is a file for the model to look at. Path is where it came from,
+// which is all the browser sends; the server reads the file into Data, and
+// providers only look at MIMEType and Data.
+type Attachment struct {
+	Path     string `json:"path"`
+	Name     string `json:"name,omitempty"`
+	MIMEType string `json:"mimeType,omitempty"`
+	Data     []byte `json:"-"`
+	// Text is what a text file held when it was attached; it is pasted into
+	// the message instead of being sent as a file. Digest is the SHA-256 of
+	// the Data of an image or PDF, which is not kept and has to be read again
+	// when a stored conversation is sent.
+	Text   string `json:"text,omitempty"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// inlineTypes are the file types sent to the model as they are rather than
+// as text. Not every provider takes all of them.
+var inlineTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/webp":      true,
+	"image/gif":       true,
+	"application/pdf": true,
+}
+
+// InlineType reports whether files of mimeType can be attached as they are.
+func InlineType(mimeType string) bool {
+	return inlineTypes[mimeType]
+}
+
+func isImage(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "image/")
+}
+
+// checkAttachments returns an error naming the first attachment in req that
+// accept refuses.
+func checkAttachments(provider string, req *Request, accept func(mimeType string) bool) error {
+	for _, m := range req.Messages {
+		for _, a := range m.Attachments {
+			if !accept(a.MIMEType) {
+				return fmt.Errorf("%s cannot take %s attachments (%s)", provider, a.MIMEType, a.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Tool is a function the model may call. Parameters is a JSON schema object.
+type Tool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Parameters  map[string]interface{} `json:"parameters"`
+}
+
+type ToolCall struct {
+	ID   string          `json:"id"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args"`
+}
+
+// Request is one chat completion. Zero settings leave the provider's default
+// in place; Temperature is a pointer because 0 is a meaningful value.
+type Request struct {
+	Model       string
+	System      string
+	Messages    []Message
+	Tools       []Tool
+	Temperature *float64
+	TopK        int
+	TopP        float64
+	MaxTokens   int
+}
+
+type Usage struct {
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+}
+
+// Response is a reply from the model. When ToolCalls is set the model wants
+// them run and their results sent back before it answers; Text may be empty.
+type Response struct {
+	Text      string     `json:"text"`
+	ToolCalls []ToolCall `json:"toolCalls,omitempty"`
+	Model     string     `json:"model"`
+	Usage     Usage      `json:"usage"`
+}
+
+type Provider interface {
+	// Name returns the provider kind, e.g. "gemini".
+	Name() string
+	// Model returns the model used when a request does not name one.
+	Model() string
+	Chat(ctx context.Context, req *Request) (*Response, error)
+	// Stream is Chat with the reply passed to onDelta piece by piece as the
+	// model produces it. The returned Response holds the whole text. An
+	// error from onDelta stops the stream and is returned.
+	Stream(ctx context.Context, req *Request, onDelta func(text string) error) (*Response, error)
+	// Check lists the server's models, which confirms it can be reached and
+	// accepts the API key without spending any tokens.
+	Check(ctx context.Context) error
+}
+
+// Config selects and configures a provider. Empty fields take the defaults of
+// the kind.
+type Config struct {
+	Provider string
+	BaseURL  string
+	APIKey   string
+	Model    string
+}
+
+type defaults struct {
+	baseURL string
+	model   string
+}
+
+var providerDefaults = map[string]defaults{
+	Gemini:   {"https://generativelanguage.googleapis.com/v1beta", "gemini-2.0-flash"},
+	OpenAI:   {"https://api.openai.com/v1", "gpt-4o-mini"},
+	Ollama:   {"http://localhost:11434", "llama3.2"},
+	LlamaCpp: {"http://localhost:8080/v1", "default"},
+}
+
+// Kinds lists the provider kinds New accepts.
+func Kinds() []string {
+	return []string{Gemini, OpenAI, Ollama, LlamaCpp}
+}
+
+// DefaultBaseURL returns the endpoint a kind uses when none is configured.
+func DefaultBaseURL(kind string) string {
+	return providerDefaults[kind].baseURL
+}
+
+// DefaultModel returns the model a kind uses when none is configured.
+func DefaultModel(kind string) string {
+	return providerDefaults[kind].model
+}
+
+// New returns the provider described by cfg. llama.cpp's server speaks the
+// OpenAI protocol, so it is an OpenAI provider with local defaults.
+func New(cfg Config) (Provider, error) {
+	kind := strings.ToLower(cfg.Provider)
+	d, ok := providerDefaults[kind]
+	if !ok {
+		return nil, fmt.Errorf("ai: unknown provider %q", cfg.Provider)
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = d.baseURL
+	}
+	if cfg.Model == "" {
+		cfg.Model = d.model
+	}
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+
+	switch kind {
+	case Gemini:
+		if cfg.APIKey == "" {
+			return nil, errors.New("ai: gemini needs an API key")
+		}
+		return &geminiProvider{cfg: cfg}, nil
+	case Ollama:
+		return &ollamaProvider{cfg: cfg}, nil
+	default:
+		return &openAIProvider{kind: kind, cfg: cfg}, nil
+	}
+}
+
+// APIError is a non-2xx reply from a provider.
+type APIError struct {
+	Provider   string
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s API error (status %d): %s", e.Provider, e.StatusCode, e.Message)
+}
+
+// A local model on a phone can take minutes to answer and a stream lasts as
+// long as the reply, so requests are bounded by their context rather than a
+// client timeout; only a server that never answers at all is cut off.
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Minute,
+	},
+}
+
+// post sends payload to url and returns the body of a successful reply, which
+// the caller must close. Error replies become an *APIError carrying the
+// provider's own message when it can be found.
+func post(ctx context.Context, provider, url string, header http.Header, payload interface{}) (io.ReadCloser, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("ai: failed to encode request: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return do(req, provider)
+}
+
+// get requests url and only looks at whether it succeeded.
+func get(ctx context.Context, provider, url string, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	body, err := do(req, provider)
+	if err != nil {
+		return err
+	}
+	body.Close()
+	return nil
+}
+
+// do sends req and returns the body of a successful reply, or the error the
+// provider gave as an *APIError.
+func do(req *http.Request, provider string) (io.ReadCloser, error) {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", provider, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		return nil, &APIError{Provider: provider, StatusCode: resp.StatusCode, Message: errorMessage(data)}
+	}
+	return resp.Body, nil
+}
+
+// postJSON is post for a reply that is one JSON document, decoded into out.
+func postJSON(ctx context.Context, provider, url string, header http.Header, payload, out interface{}) error {
+	body, err := post(ctx, provider, url, header, payload)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, 32<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read %s response: %v", provider, err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to parse %s response: %v", provider, err)
+	}
+	return nil
+}
+
+// streamLines calls fn with every non-empty line of body. Server-Sent Events
+// replies are handled by the callers picking out the "data:" lines.
+func streamLines(ctx context.Context, provider string, body io.Reader, fn func(line []byte) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 4<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("failed to read %s stream: %v", provider, err)
+	}
+	return ctx.Err()
+}
+
+// sseData returns the payload of a Server-Sent Events "data:" line.
+func sseData(line []byte) ([]byte, bool) {
+	data, ok := bytes.CutPrefix(line, []byte("data:"))
+	return bytes.TrimSpace(data), ok
+}
+
+// errorMessage pulls the message out of the error bodies the supported APIs
+// send: {"error": {"message": ...}} or {"error": "..."}.
+func errorMessage(body []byte) string {
+	var parsed struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(body, &parsed) == nil && len(parsed.Error) > 0 {
+		var obj struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(parsed.Error, &obj) == nil && obj.Message != "" {
+			return obj.Message
+		}
+		var s string
+		if json.Unmarshal(parsed.Error, &s) == nil && s != "" {
+			return s
+		}
+	}
+	msg := strings.TrimSpace(string(body))
+	if len(msg) > 500 {
+		msg = msg[:500] + "..."
+	}
+	return msg
+}
+
+// callArgs returns the arguments of a call as a JSON object, which is what
+// every provider expects even for a function without parameters.
+func callArgs(args json.RawMessage) json.RawMessage {
+	if len(bytes.TrimSpace(args)) == 0 || !json.Valid(args) {
+		return json.RawMessage("{}")
+	}
+	return args
+}
+
+// callID names a call for providers that do not, so the results can still be
+// matched to it.
+func callID(n int) string {
+	return fmt.Sprintf("call_%d_%d", time.Now().UnixNano(), n)
+}
+
+func modelFor(req *Request, p Provider) string {
+	if req.Model != "" {
+		return req.Model
+	}
+	return p.Model()
+}
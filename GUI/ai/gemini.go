@@ -0,0 +1,276 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type geminiProvider struct {
+	cfg Config
+}
+
+type geminiFunctionCall struct {
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args"`
+}
+
+type geminiFunctionResponse struct {
+	ID       string                 `json:"id,omitempty"`
+	Name     string                 `json:"name"`
+	Response map[string]interface{} `json:"response"`
+}
+
+// geminiBlob is file data sent inline; Data is base64 encoded on the wire.
+type geminiBlob struct {
+	MIMEType string `json:"mime_type"`
+	Data     []byte `json:"data"`
+}
+
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	InlineData       *geminiBlob             `json:"inline_data,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	PromptFeedback struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+	ModelVersion string `json:"modelVersion"`
+}
+
+func (p *geminiProvider) Name() string  { return Gemini }
+func (p *geminiProvider) Model() string { return p.cfg.Model }
+
+// geminiContents converts the conversation. Tool results are sent by the user
+// side as functionResponse parts, and the results of one round of calls have
+// to arrive together in a single turn. Attachments follow the text of their
+// message as inline_data parts.
+func geminiContents(messages []Message) []geminiContent {
+	contents := make([]geminiContent, 0, len(messages))
+	for _, m := range messages {
+		switch m.Role {
+		case RoleTool:
+			part := geminiPart{FunctionResponse: &geminiFunctionResponse{
+				Name:     m.Name,
+				Response: map[string]interface{}{"result": m.Text},
+			}}
+			if n := len(contents); n > 0 && contents[n-1].Parts[0].FunctionResponse != nil {
+				contents[n-1].Parts = append(contents[n-1].Parts, part)
+			} else {
+				contents = append(contents, geminiContent{Role: "user", Parts: []geminiPart{part}})
+			}
+		case RoleAssistant:
+			content := geminiContent{Role: "model"}
+			if m.Text != "" {
+				content.Parts = append(content.Parts, geminiPart{Text: m.Text})
+			}
+			for _, call := range m.ToolCalls {
+				content.Parts = append(content.Parts, geminiPart{FunctionCall: &geminiFunctionCall{
+					Name: call.Name,
+					Args: callArgs(call.Args),
+				}})
+			}
+			if len(content.Parts) == 0 {
+				content.Parts = []geminiPart{{Text: " "}}
+			}
+			contents = append(contents, content)
+		default:
+			content := geminiContent{Role: "user"}
+			if m.Text != "" || len(m.Attachments) == 0 {
+				content.Parts = append(content.Parts, geminiPart{Text: m.Text})
+			}
+			for _, a := range m.Attachments {
+				content.Parts = append(content.Parts, geminiPart{InlineData: &geminiBlob{MIMEType: a.MIMEType, Data: a.Data}})
+			}
+			contents = append(contents, content)
+		}
+	}
+	return contents
+}
+
+func (p *geminiProvider) payload(req *Request) map[string]interface{} {
+	payload := map[string]interface{}{"contents": geminiContents(req.Messages)}
+	if req.System != "" {
+		payload["system_instruction"] = geminiContent{Parts: []geminiPart{{Text: req.System}}}
+	}
+	if len(req.Tools) > 0 {
+		payload["tools"] = []map[string]interface{}{{"functionDeclarations": req.Tools}}
+	}
+	genConfig := map[string]interface{}{}
+	if req.Temperature != nil {
+		genConfig["temperature"] = *req.Temperature
+	}
+	if req.TopK > 0 {
+		genConfig["topK"] = req.TopK
+	}
+	if req.TopP > 0 {
+		genConfig["topP"] = req.TopP
+	}
+	if req.MaxTokens > 0 {
+		genConfig["maxOutputTokens"] = req.MaxTokens
+	}
+	if len(genConfig) > 0 {
+		payload["generationConfig"] = genConfig
+	}
+	return payload
+}
+
+// header carries the key. It goes in a header rather than the query string
+// so it does not end up in proxy or error logs.
+func (p *geminiProvider) header() http.Header {
+	header := http.Header{}
+	header.Set("x-goog-api-key", p.cfg.APIKey)
+	return header
+}
+
+// endpoint returns the URL of method for model.
+func (p *geminiProvider) endpoint(model, method string) (string, http.Header) {
+	return p.cfg.BaseURL + "/models/" + url.PathEscape(model) + ":" + method, p.header()
+}
+
+// reply returns the text and function calls in resp, or why there are none.
+// A streamed chunk may carry nothing at all, which only counts as an error
+// for whole replies.
+func (resp *geminiResponse) reply(whole bool) (string, []ToolCall, error) {
+	if resp.PromptFeedback.BlockReason != "" {
+		return "", nil, errors.New("Gemini blocked the prompt: " + resp.PromptFeedback.BlockReason)
+	}
+	if len(resp.Candidates) == 0 {
+		if !whole {
+			return "", nil, nil
+		}
+		return "", nil, errors.New("invalid response format from Gemini API: no candidates found")
+	}
+
+	var text strings.Builder
+	var calls []ToolCall
+	for _, part := range resp.Candidates[0].Content.Parts {
+		text.WriteString(part.Text)
+		if fc := part.FunctionCall; fc != nil {
+			id := fc.ID
+			if id == "" {
+				id = callID(len(calls))
+			}
+			calls = append(calls, ToolCall{ID: id, Name: fc.Name, Args: callArgs(fc.Args)})
+		}
+	}
+	empty := text.Len() == 0 && len(calls) == 0
+	reason := resp.Candidates[0].FinishReason
+	if reason != "" && reason != "STOP" && reason != "MAX_TOKENS" && empty {
+		return "", nil, errors.New("Gemini returned no text (finish reason " + reason + ")")
+	}
+	if whole && empty {
+		return "", nil, errors.New("invalid response format from Gemini API: no parts found")
+	}
+	return text.String(), calls, nil
+}
+
+func (p *geminiProvider) Check(ctx context.Context) error {
+	return get(ctx, "Gemini", p.cfg.BaseURL+"/models", p.header())
+}
+
+func (p *geminiProvider) Chat(ctx context.Context, req *Request) (*Response, error) {
+	if len(req.Messages) == 0 {
+		return nil, ErrEmptyConversation
+	}
+	model := modelFor(req, p)
+
+	url, header := p.endpoint(model, "generateContent")
+	var resp geminiResponse
+	if err := postJSON(ctx, "Gemini", url, header, p.payload(req), &resp); err != nil {
+		return nil, err
+	}
+	text, calls, err := resp.reply(true)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ModelVersion != "" {
+		model = resp.ModelVersion
+	}
+	return &Response{
+		Text:      text,
+		ToolCalls: calls,
+		Model:     model,
+		Usage: Usage{
+			PromptTokens:     resp.UsageMetadata.PromptTokenCount,
+			CompletionTokens: resp.UsageMetadata.CandidatesTokenCount,
+		},
+	}, nil
+}
+
+// Stream uses streamGenerateContent with alt=sse, where every event is a
+// partial generateContent reply and the last one carries the token counts.
+// Function calls arrive whole within a chunk.
+func (p *geminiProvider) Stream(ctx context.Context, req *Request, onDelta func(string) error) (*Response, error) {
+	if len(req.Messages) == 0 {
+		return nil, ErrEmptyConversation
+	}
+	result := &Response{Model: modelFor(req, p)}
+
+	url, header := p.endpoint(result.Model, "streamGenerateContent?alt=sse")
+	body, err := post(ctx, "Gemini", url, header, p.payload(req))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var text strings.Builder
+	err = streamLines(ctx, "Gemini", body, func(line []byte) error {
+		data, ok := sseData(line)
+		if !ok {
+			return nil
+		}
+		var chunk geminiResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return fmt.Errorf("failed to parse Gemini stream: %v", err)
+		}
+		if chunk.ModelVersion != "" {
+			result.Model = chunk.ModelVersion
+		}
+		if chunk.UsageMetadata.PromptTokenCount > 0 || chunk.UsageMetadata.CandidatesTokenCount > 0 {
+			result.Usage = Usage{
+				PromptTokens:     chunk.UsageMetadata.PromptTokenCount,
+				CompletionTokens: chunk.UsageMetadata.CandidatesTokenCount,
+			}
+		}
+		delta, calls, err := chunk.reply(false)
+		if err != nil {
+			return err
+		}
+		result.ToolCalls = append(result.ToolCalls, calls...)
+		if delta == "" {
+			return nil
+		}
+		text.WriteString(delta)
+		return onDelta(delta)
+	})
+	result.Text = text.String()
+	if err != nil {
+		return result, err
+	}
+	if result.Text == "" && len(result.ToolCalls) == 0 {
+		return nil, errors.New("invalid response format from Gemini API: no parts found")
+	}
+	return result, nil
+}
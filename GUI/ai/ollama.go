@@ -0,0 +1,149 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ollamaProvider uses Ollama's native /api/chat, which, unlike its OpenAI
+// compatible endpoint, reports token counts and takes top_k. Ollama has no
+// keys of its own; one is sent for servers behind an authenticating proxy.
+type ollamaProvider struct {
+	cfg Config
+}
+
+type ollamaResponse struct {
+	Model           string        `json:"model"`
+	Message         openAIMessage `json:"message"`
+	Done            bool          `json:"done"`
+	Error           string        `json:"error"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+}
+
+func (p *ollamaProvider) Name() string  { return Ollama }
+func (p *ollamaProvider) Model() string { return p.cfg.Model }
+
+func (p *ollamaProvider) payload(req *Request, model string, stream bool) map[string]interface{} {
+	options := map[string]interface{}{}
+	if req.Temperature != nil {
+		options["temperature"] = *req.Temperature
+	}
+	if req.TopK > 0 {
+		options["top_k"] = req.TopK
+	}
+	if req.TopP > 0 {
+		options["top_p"] = req.TopP
+	}
+	if req.MaxTokens > 0 {
+		options["num_predict"] = req.MaxTokens
+	}
+	payload := map[string]interface{}{
+		"model":    model,
+		"messages": openAIMessages(req, true),
+		"stream":   stream,
+	}
+	if len(req.Tools) > 0 {
+		payload["tools"] = openAITools(req.Tools)
+	}
+	if len(options) > 0 {
+		payload["options"] = options
+	}
+	return payload
+}
+
+func (p *ollamaProvider) header() http.Header {
+	header := http.Header{}
+	if p.cfg.APIKey != "" {
+		header.Set("Authorization", "Bearer "+p.cfg.APIKey)
+	}
+	return header
+}
+
+func (p *ollamaProvider) Check(ctx context.Context) error {
+	return get(ctx, "Ollama", p.cfg.BaseURL+"/api/tags", p.header())
+}
+
+func (p *ollamaProvider) Chat(ctx context.Context, req *Request) (*Response, error) {
+	if len(req.Messages) == 0 {
+		return nil, ErrEmptyConversation
+	}
+	if err := checkAttachments("Ollama", req, isImage); err != nil {
+		return nil, err
+	}
+	model := modelFor(req, p)
+
+	var resp ollamaResponse
+	if err := postJSON(ctx, "Ollama", p.cfg.BaseURL+"/api/chat", p.header(), p.payload(req, model, false), &resp); err != nil {
+		return nil, err
+	}
+	calls := openAIToolCalls(resp.Message.ToolCalls)
+	if resp.Message.Content == "" && len(calls) == 0 {
+		return nil, errors.New("invalid response format from Ollama: empty message")
+	}
+	if resp.Model != "" {
+		model = resp.Model
+	}
+	return &Response{
+		Text:      resp.Message.Content,
+		ToolCalls: calls,
+		Model:     model,
+		Usage: Usage{
+			PromptTokens:     resp.PromptEvalCount,
+			CompletionTokens: resp.EvalCount,
+		},
+	}, nil
+}
+
+// Stream reads Ollama's newline separated JSON objects; the one marked done
+// carries the token counts. Tool calls come whole in one of them.
+func (p *ollamaProvider) Stream(ctx context.Context, req *Request, onDelta func(string) error) (*Response, error) {
+	if len(req.Messages) == 0 {
+		return nil, ErrEmptyConversation
+	}
+	if err := checkAttachments("Ollama", req, isImage); err != nil {
+		return nil, err
+	}
+	result := &Response{Model: modelFor(req, p)}
+
+	body, err := post(ctx, "Ollama", p.cfg.BaseURL+"/api/chat", p.header(), p.payload(req, result.Model, true))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var text strings.Builder
+	err = streamLines(ctx, "Ollama", body, func(line []byte) error {
+		var chunk ollamaResponse
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return fmt.Errorf("failed to parse Ollama stream: %v", err)
+		}
+		if chunk.Error != "" {
+			return errors.New("Ollama error: " + chunk.Error)
+		}
+		if chunk.Model != "" {
+			result.Model = chunk.Model
+		}
+		if chunk.Done {
+			result.Usage = Usage{PromptTokens: chunk.PromptEvalCount, CompletionTokens: chunk.EvalCount}
+		}
+		result.ToolCalls = append(result.ToolCalls, openAIToolCalls(chunk.Message.ToolCalls)...)
+		if chunk.Message.Content == "" {
+			return nil
+		}
+		text.WriteString(chunk.Message.Content)
+		return onDelta(chunk.Message.Content)
+	})
+	result.Text = text.String()
+	if err != nil {
+		return result, err
+	}
+	if result.Text == "" && len(result.ToolCalls) == 0 {
+		return nil, errors.New("invalid response format from Ollama: empty message")
+	}
+	return result, nil
+}
@@ -0,0 +1,346 @@
+package ai
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// openAIProvider speaks the /chat/completions protocol, which OpenAI and most
+// self-hosted servers (llama.cpp, vLLM, LM Studio) implement. top_k is not
+// part of the protocol but local servers accept it.
+type openAIProvider struct {
+	kind string
+	cfg  Config
+}
+
+type openAIToolCall struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name string `json:"name,omitempty"`
+		// Arguments is a JSON string for OpenAI and a JSON object for
+		// Ollama, so it is kept raw.
+		Arguments json.RawMessage `json:"arguments,omitempty"`
+	} `json:"function"`
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    string           `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+	// Images is how Ollama's native API takes attached images.
+	Images [][]byte `json:"images,omitempty"`
+	// Parts replaces Content in requests when a message has attachments.
+	Parts []openAIContentPart `json:"-"`
+}
+
+type openAIContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+	File *struct {
+		Filename string `json:"filename"`
+		FileData string `json:"file_data"`
+	} `json:"file,omitempty"`
+}
+
+// MarshalJSON sends Parts, when there are any, as the content array.
+func (m openAIMessage) MarshalJSON() ([]byte, error) {
+	type plain openAIMessage
+	if len(m.Parts) == 0 {
+		return json.Marshal(plain(m))
+	}
+	return json.Marshal(struct {
+		plain
+		Content []openAIContentPart `json:"content"`
+	}{plain(m), m.Parts})
+}
+
+// openAIParts returns the text of m followed by its attachments as data URLs.
+func openAIParts(m Message) []openAIContentPart {
+	parts := []openAIContentPart{}
+	if m.Text != "" {
+		parts = append(parts, openAIContentPart{Type: "text", Text: m.Text})
+	}
+	for _, a := range m.Attachments {
+		dataURL := "data:" + a.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(a.Data)
+		var part openAIContentPart
+		if isImage(a.MIMEType) {
+			part.Type = "image_url"
+			part.ImageURL = &struct {
+				URL string `json:"url"`
+			}{dataURL}
+		} else {
+			part.Type = "file"
+			part.File = &struct {
+				Filename string `json:"filename"`
+				FileData string `json:"file_data"`
+			}{a.Name, dataURL}
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+type openAIResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message      openAIMessage `json:"message"`
+		Delta        openAIMessage `json:"delta"`
+		FinishReason string        `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage"`
+}
+
+func (p *openAIProvider) Name() string  { return p.kind }
+func (p *openAIProvider) Model() string { return p.cfg.Model }
+
+// openAIMessages converts a request to the message list shared by the OpenAI
+// and Ollama protocols, with the system prompt as the first message. OpenAI
+// wants call arguments as a JSON encoded string and attachments as content
+// parts; Ollama's native API takes the arguments as the object itself and
+// images in a list of their own.
+func openAIMessages(req *Request, ollama bool) []openAIMessage {
+	messages := make([]openAIMessage, 0, len(req.Messages)+1)
+	if req.System != "" {
+		messages = append(messages, openAIMessage{Role: "system", Content: req.System})
+	}
+	for _, m := range req.Messages {
+		msg := openAIMessage{Role: RoleUser, Content: m.Text}
+		switch m.Role {
+		case RoleAssistant:
+			msg.Role = RoleAssistant
+			for _, call := range m.ToolCalls {
+				tc := openAIToolCall{ID: call.ID, Type: "function"}
+				tc.Function.Name = call.Name
+				tc.Function.Arguments = callArgs(call.Args)
+				if !ollama {
+					tc.Function.Arguments, _ = json.Marshal(string(tc.Function.Arguments))
+				}
+				msg.ToolCalls = append(msg.ToolCalls, tc)
+			}
+		case RoleTool:
+			msg.Role = RoleTool
+			msg.ToolCallID = m.ToolCallID
+		default:
+			if len(m.Attachments) == 0 {
+				break
+			}
+			if !ollama {
+				msg.Parts = openAIParts(m)
+				break
+			}
+			for _, a := range m.Attachments {
+				msg.Images = append(msg.Images, a.Data)
+			}
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+// openAITools declares tools in the format OpenAI and Ollama share.
+func openAITools(tools []Tool) []map[string]interface{} {
+	declared := make([]map[string]interface{}, 0, len(tools))
+	for _, t := range tools {
+		declared = append(declared, map[string]interface{}{"type": "function", "function": t})
+	}
+	return declared
+}
+
+// toolCallArgs reads call arguments sent either as a JSON string or as the
+// object itself.
+func toolCallArgs(raw json.RawMessage) json.RawMessage {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		raw = json.RawMessage(s)
+	}
+	return callArgs(raw)
+}
+
+func openAIToolCalls(calls []openAIToolCall) []ToolCall {
+	var out []ToolCall
+	for i, tc := range calls {
+		id := tc.ID
+		if id == "" {
+			id = callID(i)
+		}
+		out = append(out, ToolCall{ID: id, Name: tc.Function.Name, Args: toolCallArgs(tc.Function.Arguments)})
+	}
+	return out
+}
+
+func (p *openAIProvider) payload(req *Request, model string) map[string]interface{} {
+	payload := map[string]interface{}{
+		"model":    model,
+		"messages": openAIMessages(req, false),
+	}
+	if len(req.Tools) > 0 {
+		payload["tools"] = openAITools(req.Tools)
+	}
+	if req.Temperature != nil {
+		payload["temperature"] = *req.Temperature
+	}
+	if req.TopP > 0 {
+		payload["top_p"] = req.TopP
+	}
+	if req.TopK > 0 && p.kind != OpenAI {
+		payload["top_k"] = req.TopK
+	}
+	if req.MaxTokens > 0 {
+		payload["max_tokens"] = req.MaxTokens
+	}
+	return payload
+}
+
+func (p *openAIProvider) header() http.Header {
+	header := http.Header{}
+	if p.cfg.APIKey != "" {
+		header.Set("Authorization", "Bearer "+p.cfg.APIKey)
+	}
+	return header
+}
+
+func (p *openAIProvider) Check(ctx context.Context) error {
+	return get(ctx, p.kind, p.cfg.BaseURL+"/models", p.header())
+}
+
+func (p *openAIProvider) Chat(ctx context.Context, req *Request) (*Response, error) {
+	if len(req.Messages) == 0 {
+		return nil, ErrEmptyConversation
+	}
+	model := modelFor(req, p)
+
+	var resp openAIResponse
+	if err := postJSON(ctx, p.kind, p.cfg.BaseURL+"/chat/completions", p.header(), p.payload(req, model), &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, errors.New("invalid response format from " + p.kind + " API: no choices found")
+	}
+	msg := resp.Choices[0].Message
+	result := &Response{Text: msg.Content, ToolCalls: openAIToolCalls(msg.ToolCalls), Model: model}
+	if result.Text == "" && len(result.ToolCalls) == 0 {
+		return nil, errors.New("invalid response format from " + p.kind + " API: empty message")
+	}
+	if resp.Model != "" {
+		result.Model = resp.Model
+	}
+	if resp.Usage != nil {
+		result.Usage = Usage{PromptTokens: resp.Usage.PromptTokens, CompletionTokens: resp.Usage.CompletionTokens}
+	}
+	return result, nil
+}
+
+// Stream asks for server-sent chunks ending with "data: [DONE]". Token counts
+// come in a last chunk without choices when the server honours
+// stream_options; servers that do not simply leave them at zero. Tool calls
+// arrive in pieces keyed by index, the arguments a few characters at a time.
+func (p *openAIProvider) Stream(ctx context.Context, req *Request, onDelta func(string) error) (*Response, error) {
+	if len(req.Messages) == 0 {
+		return nil, ErrEmptyConversation
+	}
+	result := &Response{Model: modelFor(req, p)}
+
+	payload := p.payload(req, result.Model)
+	payload["stream"] = true
+	payload["stream_options"] = map[string]bool{"include_usage": true}
+	body, err := post(ctx, p.kind, p.cfg.BaseURL+"/chat/completions", p.header(), payload)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	type partialCall struct {
+		id, name string
+		args     strings.Builder
+	}
+	calls := map[int]*partialCall{}
+
+	var text strings.Builder
+	err = streamLines(ctx, p.kind, body, func(line []byte) error {
+		data, ok := sseData(line)
+		if !ok || bytes.Equal(data, []byte("[DONE]")) {
+			return nil
+		}
+		var chunk openAIResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return fmt.Errorf("failed to parse %s stream: %v", p.kind, err)
+		}
+		if chunk.Model != "" {
+			result.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			result.Usage = Usage{PromptTokens: chunk.Usage.PromptTokens, CompletionTokens: chunk.Usage.CompletionTokens}
+		}
+		if len(chunk.Choices) == 0 {
+			return nil
+		}
+		delta := chunk.Choices[0].Delta
+		for i, tc := range delta.ToolCalls {
+			index := i
+			if tc.Index != nil {
+				index = *tc.Index
+			}
+			call, ok := calls[index]
+			if !ok {
+				call = &partialCall{}
+				calls[index] = call
+			}
+			if tc.ID != "" {
+				call.id = tc.ID
+			}
+			call.name += tc.Function.Name
+			var piece string
+			if json.Unmarshal(tc.Function.Arguments, &piece) == nil {
+				call.args.WriteString(piece)
+			} else {
+				call.args.Write(tc.Function.Arguments)
+			}
+		}
+		if delta.Content == "" {
+			return nil
+		}
+		text.WriteString(delta.Content)
+		return onDelta(delta.Content)
+	})
+	result.Text = text.String()
+
+	indexes := make([]int, 0, len(calls))
+	for i := range calls {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		call := calls[i]
+		id := call.id
+		if id == "" {
+			id = callID(i)
+		}
+		result.ToolCalls = append(result.ToolCalls, ToolCall{ID: id, Name: call.name, Args: callArgs(json.RawMessage(call.args.String()))})
+	}
+
+	if err != nil {
+		return result, err
+	}
+	if result.Text == "" && len(result.ToolCalls) == 0 {
+		return nil, errors.New("invalid response format from " + p.kind + " API: no choices found")
+	}
+	return result, nil
+}
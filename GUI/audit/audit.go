@@ -0,0 +1,244 @@
+// Package audit keeps an append-only, JSON-lines record of every action that
+// changes state: tunnels, DNS records, configs, passwords and login attempts.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-manager/auth"
+	"cf-manager/throttle"
+)
+
+const (
+	LogFilePath  = "audit.log"
+	DefaultLimit = 200
+)
+
+// Entry is one line of the audit log.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	SourceIP string    `json:"source_ip"`
+	Action   string    `json:"action"`
+	Target   string    `json:"target"`
+	Before   string    `json:"before,omitempty"`
+	After    string    `json:"after,omitempty"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Filter selects entries for Query and Export. Zero values match everything.
+type Filter struct {
+	Action   string
+	Actor    string
+	Target   string
+	SourceIP string
+	Since    time.Time
+	Until    time.Time
+	Success  *bool
+	Limit    int
+}
+
+var (
+	logFile  *os.File
+	logMutex sync.Mutex
+)
+
+// Record appends an entry for the request's authenticated actor. A non-nil err
+// marks the action as failed.
+func Record(r *http.Request, action, target, before, after string, err error) {
+	RecordAs(r, auth.Actor(r), action, target, before, after, err)
+}
+
+// RecordAs is Record with an explicit actor, for requests that are not yet
+// authenticated such as login attempts.
+func RecordAs(r *http.Request, actor, action, target, before, after string, err error) {
+	RecordFrom(actor, throttle.ClientIP(r), action, target, before, after, err)
+}
+
+// RecordFrom is RecordAs for work that outlives its request, such as a
+// background task: the actor and source IP are taken while the request is
+// still being handled.
+func RecordFrom(actor, sourceIP, action, target, before, after string, err error) {
+	e := Entry{
+		Time:     time.Now().UTC(),
+		Actor:    actor,
+		SourceIP: sourceIP,
+		Action:   action,
+		Target:   target,
+		Before:   before,
+		After:    after,
+		Success:  err == nil,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	if werr := write(e); werr != nil {
+		log.Printf("Failed to write audit entry %s %s: %v", action, target, werr)
+	}
+}
+
+// Summarize describes a blob of content without storing it, so config edits can
+// be compared in the log without copying secrets into it.
+func Summarize(content string) string {
+	if content == "" {
+		return "empty"
+	}
+	sum := sha256.Sum256([]byte(content))
+	lines := strings.Count(content, "\n")
+	if !strings.HasSuffix(content, "\n") {
+		lines++
+	}
+	return fmt.Sprintf("%d lines, %d bytes, sha256 %s", lines, len(content), hex.EncodeToString(sum[:6]))
+}
+
+// Query returns matching entries, newest first, capped at f.Limit (or
+// DefaultLimit when unset).
+func Query(f Filter) ([]Entry, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+
+	var matched []Entry
+	err := scan(func(e Entry, _ []byte) {
+		if f.matches(e) {
+			matched = append(matched, e)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Reverse so the newest entries come first, then trim
+	for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+		matched[i], matched[j] = matched[j], matched[i]
+	}
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	if matched == nil {
+		matched = []Entry{}
+	}
+	return matched, nil
+}
+
+// Export writes matching entries to w as JSON lines, oldest first, exactly as
+// they are stored. f.Limit is ignored so log shippers get everything.
+func Export(w io.Writer, f Filter) error {
+	var werr error
+	err := scan(func(e Entry, line []byte) {
+		if werr != nil || !f.matches(e) {
+			return
+		}
+		if _, werr = w.Write(line); werr == nil {
+			_, werr = w.Write([]byte("\n"))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+func (f Filter) matches(e Entry) bool {
+	if f.Action != "" && !strings.HasPrefix(e.Action, f.Action) {
+		return false
+	}
+	if f.Actor != "" && !strings.Contains(e.Actor, f.Actor) {
+		return false
+	}
+	if f.Target != "" && !strings.Contains(e.Target, f.Target) {
+		return false
+	}
+	if f.SourceIP != "" && e.SourceIP != f.SourceIP {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	if f.Success != nil && e.Success != *f.Success {
+		return false
+	}
+	return true
+}
+
+func write(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	if logFile == nil {
+		// O_APPEND keeps every write at the end of the file even if something
+		// else has it open; entries are never rewritten.
+		logFile, err = os.OpenFile(LogFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = logFile.Write(append(line, '\n'))
+	return err
+}
+
+// scan calls fn for each entry in the log, oldest first. The lock is held
+// only while the file is opened: entries are appended whole under it, so
+// reading up to the size seen then never meets half a line, and a slow fn,
+// such as an export to a slow client, does not hold up Record.
+func scan(fn func(e Entry, line []byte)) error {
+	file, size, err := openForScan()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(file, size))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			continue
+		}
+		fn(e, line)
+	}
+	return scanner.Err()
+}
+
+func openForScan() (*os.File, int64, error) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	file, err := os.Open(LogFilePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
@@ -1,77 +1,141 @@
 package auth
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"time"
+
+	"cf-manager/secrets"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 const (
-	CookieName       = "cf-session"
-	CookieValue      = "cf-admin"
+	DefaultUsername  = "admin"
 	CookieMaxAge     = 3600
 	EnvFilePath      = ".env"
 	PasswordFilePath = "password.dat"
+
+	// EnvPasswordName is the plaintext copy of the password that older builds
+	// kept in .env next to password.dat
+	EnvPasswordName = "PASSWORD"
+
+	// PasswordSecretName is the secret store entry holding the bcrypt hash
+	PasswordSecretName = "ADMIN_PASSWORD_HASH"
 )
 
+// CookieName is the session cookie. Cookies are shared across ports, so
+// servers on the same device must each use their own name.
+var CookieName = "cf-session"
+
 var (
 	hashedPassword []byte
 	passwordMutex  sync.RWMutex
 	devMode        bool
+	sessions       = make(map[string]*Session)
+	sessionsMutex  sync.Mutex
+	csrfKey        = mustRandomBytes(32)
 )
 
+// Session is a logged-in browser. The ID is the cookie value and is never
+// logged; use ShortID when a session has to be identified in logs.
+type Session struct {
+	ID        string
+	Username  string
+	CSRFToken string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// ShortID is a stable, non-reversible identifier for the session that is safe
+// to write to logs.
+func (s *Session) ShortID() string {
+	sum := sha256.Sum256([]byte(s.ID))
+	return hex.EncodeToString(sum[:4])
+}
+
 // SetDevMode sets the development mode
 func SetDevMode(isDev bool) {
 	devMode = isDev
 }
 
-func init() {
-	// Load the hashed password from the .dat file on startup
-	loadPasswordFromFile()
-}
-
-func loadPasswordFromFile() {
+// LoadPassword reads the admin password hash from the secret store. A
+// password.dat left by older builds is imported and removed, or failing that
+// the PASSWORD line they kept in .env is hashed and imported; with none of
+// them, the default password "admin" is set. The PASSWORD line is removed
+// from .env in any case. secrets.Open must have been called first.
+func LoadPassword() error {
 	passwordMutex.Lock()
 	defer passwordMutex.Unlock()
 
-	// Debugging: Print the file path
-	fmt.Println("Password File Path:", PasswordFilePath)
+	if err := loadPassword(); err != nil {
+		return err
+	}
+	if err := secrets.RemoveFromEnvFile(EnvFilePath, EnvPasswordName); err != nil {
+		return fmt.Errorf("failed to remove %s from %s: %v", EnvPasswordName, EnvFilePath, err)
+	}
+	return nil
+}
+
+func loadPassword() error {
+	if secrets.Has(PasswordSecretName) {
+		hashedPassword = []byte(secrets.Get(PasswordSecretName))
+		return nil
+	}
 
-	// Read the hashed password from the .dat file
-	if _, err := os.Stat(PasswordFilePath); err == nil {
-		hashedPassword, err = os.ReadFile(PasswordFilePath)
-		if err != nil {
-			panic("Failed to read password file: " + err.Error())
+	if legacy, err := os.ReadFile(PasswordFilePath); err == nil {
+		if err := secrets.Set(PasswordSecretName, strings.TrimSpace(string(legacy))); err != nil {
+			return fmt.Errorf("failed to import %s: %v", PasswordFilePath, err)
 		}
-		// Debugging: Print the file contents
-		fmt.Println("File Contents:", string(hashedPassword))
-	} else {
-		// If the file doesn't exist, hash the default password and save it
-		var err error
-		hashedPassword, err = bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.DefaultCost)
-		if err != nil {
-			panic("Failed to hash password: " + err.Error())
-		}
-		if err := savePasswordToFile(hashedPassword); err != nil {
-			panic("Failed to save password file: " + err.Error())
+		hashedPassword = []byte(secrets.Get(PasswordSecretName))
+		if err := os.Remove(PasswordFilePath); err != nil {
+			log.Printf("Imported %s into the secret store but could not remove it: %v", PasswordFilePath, err)
+		} else {
+			log.Printf("Imported %s into the secret store", PasswordFilePath)
 		}
+		return nil
 	}
-}
 
-func savePasswordToFile(password []byte) error {
-	return os.WriteFile(PasswordFilePath, password, 0644)
+	values, err := secrets.EnvFileValues(EnvFilePath, EnvPasswordName)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", EnvFilePath, err)
+	}
+	password := values[EnvPasswordName]
+	if password != "" {
+		log.Printf("Importing %s from %s into the secret store as a hash", EnvPasswordName, EnvFilePath)
+	} else {
+		// Nothing stored yet, hash the default password and save it
+		password = "admin"
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
+	}
+	if err := secrets.Set(PasswordSecretName, string(hash)); err != nil {
+		return fmt.Errorf("failed to save password: %v", err)
+	}
+	hashedPassword = hash
+	return nil
 }
 
 type LoginRequest struct {
+	Username string `json:"username,omitempty"`
 	Password string `json:"password"`
 }
 
 type LoginResponse struct {
-	Success bool `json:"success"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
 }
 
 type ChangePasswordRequest struct {
@@ -84,7 +148,32 @@ type ChangePasswordResponse struct {
 	Error   string `json:"error,omitempty"`
 }
 
-func SetSession(w http.ResponseWriter, r *http.Request) {
+func SetSession(w http.ResponseWriter, r *http.Request, username string) error {
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	csrfToken, err := GenerateCSRFToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	sessionsMutex.Lock()
+	for sid, s := range sessions {
+		if now.After(s.ExpiresAt) {
+			delete(sessions, sid)
+		}
+	}
+	sessions[id] = &Session{
+		ID:        id,
+		Username:  username,
+		CSRFToken: csrfToken,
+		CreatedAt: now,
+		ExpiresAt: now.Add(CookieMaxAge * time.Second),
+	}
+	sessionsMutex.Unlock()
+
 	// Get the host from the request to determine if we're on localhost or IP
 	host := r.Host
 	isLocalhost := strings.Contains(host, "localhost") || strings.Contains(host, "127.0.0.1")
@@ -92,20 +181,16 @@ func SetSession(w http.ResponseWriter, r *http.Request) {
 	// For local network access, we need to be more permissive with cookie settings
 	cookie := &http.Cookie{
 		Name:     CookieName,
-		Value:    CookieValue,
+		Value:    id,
 		Path:     "/",
 		MaxAge:   CookieMaxAge,
 		HttpOnly: true,
-		// Only use Secure flag for HTTPS or localhost
-		Secure:   false, // Set to false for local network access over HTTP
+		// Secure whenever the browser reached us over HTTPS, so plain HTTP on
+		// the local network keeps working when TLS is off
+		Secure:   IsSecureRequest(r),
 		SameSite: http.SameSiteLaxMode,
 	}
 
-	// If we're in production and using HTTPS, enable secure flag
-	if !devMode && r.Header.Get("X-Forwarded-Proto") == "https" {
-		cookie.Secure = true
-	}
-
 	// For localhost, we can be more restrictive
 	if isLocalhost {
 		cookie.Domain = ""
@@ -115,29 +200,145 @@ func SetSession(w http.ResponseWriter, r *http.Request) {
 	}
 
 	http.SetCookie(w, cookie)
+	return nil
 }
 
-func ClearSession(w http.ResponseWriter) {
+func ClearSession(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(CookieName); err == nil {
+		sessionsMutex.Lock()
+		delete(sessions, c.Value)
+		sessionsMutex.Unlock()
+	}
+
 	http.SetCookie(w, &http.Cookie{
 		Name:     CookieName,
 		Value:    "",
 		Path:     "/",
 		MaxAge:   -1,
 		HttpOnly: true,
-		Secure:   false, // Match the secure setting used in SetSession
+		Secure:   IsSecureRequest(r), // Match the secure setting used in SetSession
 		SameSite: http.SameSiteLaxMode,
 	})
 }
 
-func IsAuthenticated(r *http.Request) bool {
+// IsSecureRequest reports whether the browser is talking HTTPS, either to our
+// own TLS listener or to a proxy in front of us (outside dev mode).
+func IsSecureRequest(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return !devMode && r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// CurrentSession returns the live session for the request's cookie, or nil.
+func CurrentSession(r *http.Request) *Session {
 	c, err := r.Cookie(CookieName)
-	return err == nil && c.Value == CookieValue
+	if err != nil || c.Value == "" {
+		return nil
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	s, ok := sessions[c.Value]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(s.ExpiresAt) {
+		delete(sessions, c.Value)
+		return nil
+	}
+	return s
+}
+
+func IsAuthenticated(r *http.Request) bool {
+	return CurrentSession(r) != nil
+}
+
+type userContextKey struct{}
+
+type contextUser struct {
+	username string
+	via      string
+}
+
+// WithUser returns r carrying a user authenticated without a session cookie,
+// such as through Cloudflare Access. via says how, for the audit trail.
+func WithUser(r *http.Request, username, via string) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey{}, contextUser{username: username, via: via})
+	return r.WithContext(ctx)
+}
+
+// Username returns the authenticated user for the request, or "" if none.
+func Username(r *http.Request) string {
+	if u, ok := r.Context().Value(userContextKey{}).(contextUser); ok {
+		return u.username
+	}
+	if s := CurrentSession(r); s != nil {
+		return s.Username
+	}
+	return ""
+}
+
+// Actor describes who is making the request, for logs and the audit trail.
+func Actor(r *http.Request) string {
+	if u, ok := r.Context().Value(userContextKey{}).(contextUser); ok {
+		return fmt.Sprintf("%s (%s)", u.username, u.via)
+	}
+	if s := CurrentSession(r); s != nil {
+		return fmt.Sprintf("%s (session %s)", s.Username, s.ShortID())
+	}
+	return "anonymous"
+}
+
+// CSRFToken returns the token that state-changing requests from this user must
+// echo back. Sessions carry their own random token; users authenticated by a
+// header (Cloudflare Access) get one derived from their identity.
+func CSRFToken(r *http.Request) string {
+	if u, ok := r.Context().Value(userContextKey{}).(contextUser); ok {
+		mac := hmac.New(sha256.New, csrfKey)
+		mac.Write([]byte(u.via + "\x00" + u.username))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	if s := CurrentSession(r); s != nil {
+		return s.CSRFToken
+	}
+	return ""
+}
+
+// ValidCSRF checks the X-CSRF-Token header, or the csrf_token form field, against
+// CSRFToken(r).
+func ValidCSRF(r *http.Request) bool {
+	want := CSRFToken(r)
+	if want == "" {
+		return false
+	}
+	got := r.Header.Get("X-CSRF-Token")
+	if got == "" {
+		got = r.PostFormValue("csrf_token")
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+func mustRandomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("Failed to read random bytes: " + err.Error())
+	}
+	return b
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 func ValidatePassword(password string) bool {
 	passwordMutex.RLock()
 	defer passwordMutex.RUnlock()
-	fmt.Println("Hashed Password:", string(hashedPassword)) // Debugging line
 	err := bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
 	return err == nil
 }
@@ -158,47 +359,11 @@ func ChangePassword(oldPassword, newPassword string) bool {
 		return false
 	}
 
-	// Update the hashed password
-	hashedPassword = newHashedPassword
-
-	// Save the new hashed password to the .dat file
-	if err := savePasswordToFile(newHashedPassword); err != nil {
-		return false
-	}
-
-	// Update the .env file
-	if err := updateEnvFile(newPassword); err != nil {
+	// Save the new hashed password to the secret store before using it
+	if err := secrets.Set(PasswordSecretName, string(newHashedPassword)); err != nil {
 		return false
 	}
 
+	hashedPassword = newHashedPassword
 	return true
 }
-
-func updateEnvFile(newPassword string) error {
-	// Read the existing .env file
-	file, err := os.ReadFile(EnvFilePath)
-	if err != nil {
-		return err
-	}
-
-	// Split the file into lines
-	lines := strings.Split(string(file), "\n")
-
-	// Find and update the password line
-	updated := false
-	for i, line := range lines {
-		if strings.HasPrefix(line, "PASSWORD=") {
-			lines[i] = "PASSWORD=" + newPassword
-			updated = true
-			break
-		}
-	}
-
-	// If the password line was not found, add it
-	if !updated {
-		lines = append(lines, "PASSWORD="+newPassword)
-	}
-
-	// Write the updated lines back to the .env file
-	return os.WriteFile(EnvFilePath, []byte(strings.Join(lines, "\n")), 0644)
-}
@@ -54,6 +54,7 @@ body {
 <div class="prompt">admin@cloudflare:~$</div>
 <input type="password" class="input" id="password" placeholder="enter password" autofocus>
 <input type="hidden" id="csrf_token" value="{{.CSRFToken}}">
+<input type="hidden" id="next" value="{{.Next}}">
 <div class="message" id="message"></div>
 
 <script>
@@ -76,9 +77,9 @@ document.getElementById('password').addEventListener('keydown', function(e) {
     .then(data => {
       if (data.success) {
         document.getElementById('message').textContent = 'Access granted.';
-        window.location.href = '/dashboard';
+        window.location.href = document.getElementById('next').value || '/dashboard';
       } else {
-        document.getElementById('message').textContent = 'Access denied.';
+        document.getElementById('message').textContent = data.error || 'Access denied.';
         this.value = '';
         this.focus();
       }
@@ -112,7 +113,9 @@ func GenerateCSRFToken() (string, error) {
 	return base64.StdEncoding.EncodeToString(b), nil
 }
 
-func RenderLogin(w http.ResponseWriter, data interface{}) error {
+// RenderLogin shows the login page; after a successful login the browser goes
+// to next.
+func RenderLogin(w http.ResponseWriter, next string) error {
 	csrfToken, err := GenerateCSRFToken()
 	if err != nil {
 		return err
@@ -121,5 +124,6 @@ func RenderLogin(w http.ResponseWriter, data interface{}) error {
 	w.Header().Set("Content-Type", "text/html")
 	return loginTemplate.Execute(w, map[string]interface{}{
 		"CSRFToken": csrfToken,
+		"Next":      next,
 	})
 }
@@ -0,0 +1,254 @@
+// Package certs serves the web UIs over HTTPS, either with a supplied
+// certificate or with a self-signed one generated for the device's LAN
+// addresses and kept on disk between restarts.
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultDir      = "tls"
+	certFileName    = "cert.pem"
+	keyFileName     = "key.pem"
+	certValidity    = 365 * 24 * time.Hour
+	renewBefore     = 30 * 24 * time.Hour
+	certCommonName  = "cf-manager self-signed"
+	certOrgName     = "Cloudflare Tunnel Manager"
+	privateFileMode = 0600
+)
+
+// Config selects how, and whether, the server listens for HTTPS.
+type Config struct {
+	Enabled      bool
+	CertFile     string
+	KeyFile      string
+	Dir          string
+	Port         string
+	RedirectHTTP bool
+}
+
+// ConfigFromEnv reads TLS_ENABLED, TLS_CERT_FILE, TLS_KEY_FILE, TLS_DIR,
+// TLS_PORT and TLS_REDIRECT_HTTP. defaultPort is used when TLS_PORT is unset.
+func ConfigFromEnv(defaultPort string) Config {
+	c := Config{
+		Enabled:      os.Getenv("TLS_ENABLED") == "true",
+		CertFile:     os.Getenv("TLS_CERT_FILE"),
+		KeyFile:      os.Getenv("TLS_KEY_FILE"),
+		Dir:          os.Getenv("TLS_DIR"),
+		Port:         os.Getenv("TLS_PORT"),
+		RedirectHTTP: os.Getenv("TLS_REDIRECT_HTTP") != "false",
+	}
+	if c.Dir == "" {
+		c.Dir = DefaultDir
+	}
+	if c.Port == "" {
+		c.Port = defaultPort
+	}
+	return c
+}
+
+// ListenAndServe serves handler on host:httpPort over plain HTTP when TLS is
+// disabled. With TLS enabled it serves HTTPS on host:cfg.Port and, if
+// RedirectHTTP is set, redirects plain HTTP on httpPort to it.
+func ListenAndServe(handler http.Handler, host, httpPort string, cfg Config) error {
+	if !cfg.Enabled {
+		return http.ListenAndServe(host+":"+httpPort, handler)
+	}
+
+	tlsConfig, err := LoadOrCreate(cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.RedirectHTTP && httpPort != cfg.Port {
+		go func() {
+			log.Printf("Redirecting http://%s:%s to https on port %s", host, httpPort, cfg.Port)
+			if err := http.ListenAndServe(host+":"+httpPort, RedirectHandler(cfg.Port)); err != nil {
+				log.Printf("HTTP redirect listener stopped: %v", err)
+			}
+		}()
+	}
+
+	server := &http.Server{
+		Addr:      host + ":" + cfg.Port,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	return server.ListenAndServeTLS("", "")
+}
+
+// RedirectHandler sends every request to the same host and path on httpsPort.
+func RedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		target := "https://" + host
+		if httpsPort != "443" {
+			target += ":" + httpsPort
+		}
+		target += r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
+
+// LoadOrCreate returns a TLS config using the supplied certificate, or the
+// persisted self-signed one. The self-signed certificate is regenerated when it
+// is missing, close to expiry, or no longer covers every LAN address.
+func LoadOrCreate(cfg Config) (*tls.Config, error) {
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		return newTLSConfig(cert), nil
+	}
+
+	certPath := filepath.Join(cfg.Dir, certFileName)
+	keyPath := filepath.Join(cfg.Dir, keyFileName)
+	ips := LANAddresses()
+
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && stillValid(leaf, ips) {
+			return newTLSConfig(cert), nil
+		}
+		log.Printf("Self-signed certificate in %s is expiring or missing LAN addresses, regenerating", cfg.Dir)
+	}
+
+	if err := generateSelfSigned(certPath, keyPath, ips); err != nil {
+		return nil, fmt.Errorf("failed to generate self-signed certificate: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return newTLSConfig(cert), nil
+}
+
+// LANAddresses lists the unicast addresses of every interface that is up,
+// including loopback, so the certificate is valid however the phone is reached.
+func LANAddresses() []net.IP {
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ips
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsLoopback() {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+func stillValid(leaf *x509.Certificate, ips []net.IP) bool {
+	if time.Until(leaf.NotAfter) < renewBefore {
+		return false
+	}
+	for _, ip := range ips {
+		if leaf.VerifyHostname(ip.String()) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func generateSelfSigned(certPath, keyPath string, ips []net.IP) error {
+	if err := os.MkdirAll(filepath.Dir(certPath), 0700); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	dnsNames := []string{"localhost"}
+	if hostname != "" && hostname != "localhost" {
+		dnsNames = append(dnsNames, hostname)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   certCommonName,
+			Organization: []string{certOrgName},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), privateFileMode); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+
+	log.Printf("Generated self-signed certificate %s for %v", certPath, ips)
+	return nil
+}
+
+func newTLSConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+}
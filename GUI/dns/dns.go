@@ -7,6 +7,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+
+	"cf-manager/secrets"
 )
 
 type DNSRecord struct {
@@ -38,7 +40,7 @@ type CloudflareListResponse struct {
 }
 
 func getCloudflareAPI() (string, string, string) {
-	apiToken := os.Getenv("CF_API_TOKEN")
+	apiToken := secrets.Get(secrets.CloudflareAPIToken)
 	zoneID := os.Getenv("CF_ZONE_ID")
 	domain := os.Getenv("CF_DOMAIN")
 	return apiToken, zoneID, domain
@@ -81,10 +83,58 @@ func ListDNSRecords() ([]DNSRecord, error) {
 	return cfResp.Result, nil
 }
 
+func GetDNSRecord(recordID string) (*DNSRecord, error) {
+	apiToken, zoneID, _ := getCloudflareAPI()
+
+	url := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records/%s", zoneID, recordID)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+apiToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfResp CloudflareResponse
+	if err := json.Unmarshal(body, &cfResp); err != nil {
+		return nil, err
+	}
+
+	if !cfResp.Success {
+		return nil, fmt.Errorf("cloudflare API error: %v", cfResp.Errors)
+	}
+
+	// Parse the result back to DNSRecord
+	resultBytes, _ := json.Marshal(cfResp.Result)
+	var record DNSRecord
+	json.Unmarshal(resultBytes, &record)
+
+	return &record, nil
+}
+
+// FullName is the name CreateDNSRecord gives a record for subdomain.
+func FullName(subdomain string) string {
+	_, _, domain := getCloudflareAPI()
+	return fmt.Sprintf("%s.%s", subdomain, domain)
+}
+
 func CreateDNSRecord(req CreateDNSRequest) (*DNSRecord, error) {
-	apiToken, zoneID, domain := getCloudflareAPI()
+	apiToken, zoneID, _ := getCloudflareAPI()
 
-	fullName := fmt.Sprintf("%s.%s", req.Subdomain, domain)
+	fullName := FullName(req.Subdomain)
 
 	// Check if record already exists
 	records, err := ListDNSRecords()
@@ -2,28 +2,69 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
+	"cf-manager/access"
+	"cf-manager/audit"
 	"cf-manager/auth"
 	"cf-manager/dns"
+	"cf-manager/secrets"
 	"cf-manager/templates"
+	"cf-manager/throttle"
 	"cf-manager/tunnels"
 
 	"github.com/gorilla/mux"
 )
 
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !access.PasswordAllowed() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(auth.LoginResponse{Error: "Password login is disabled; sign in through Cloudflare Access"})
+		return
+	}
+
 	var req auth.LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
 
+	// There is only the one account. Any other name fails like a wrong
+	// password, counting against the IP alone so that made-up names neither
+	// lock out the real account nor end up as a session or audit identity.
+	account := auth.DefaultUsername
+	ip := throttle.ClientIP(r)
+	if name := throttle.Normalize(req.Username); name != "" && name != account {
+		throttle.RecordFailure(ip, "")
+		audit.RecordAs(r, "", "login", req.Username, "", "", errors.New("unknown user"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(auth.LoginResponse{Success: false})
+		return
+	}
+
+	if wait, ok := throttle.AllowAccount(account); !ok {
+		audit.RecordAs(r, account, "login", account, "", "", errors.New("throttled"))
+		throttle.WriteTooManyRequests(w, wait)
+		return
+	}
+
 	success := auth.ValidatePassword(req.Password)
 	if success {
+		throttle.RecordSuccess(ip, account)
 		// Pass the request to SetSession so it can determine the appropriate cookie settings
-		auth.SetSession(w, r)
+		if err := auth.SetSession(w, r, account); err != nil {
+			http.Error(w, "Failed to create session", http.StatusInternalServerError)
+			return
+		}
+		audit.RecordAs(r, account, "login", account, "", "", nil)
+	} else {
+		throttle.RecordFailure(ip, account)
+		audit.RecordAs(r, account, "login", account, "", "", errors.New("invalid credentials"))
 	}
 
 	resp := auth.LoginResponse{Success: success}
@@ -32,12 +73,23 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	auth.ClearSession(w)
+	audit.Record(r, "logout", auth.Actor(r), "", "", nil)
+	auth.ClearSession(w, r)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
-	auth.RenderLogin(w, nil)
+	if access.Enabled() {
+		if _, err := access.Authenticate(r); err == nil {
+			http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+			return
+		}
+		if !access.PasswordAllowed() {
+			http.Error(w, "This dashboard is only available through Cloudflare Access", http.StatusForbidden)
+			return
+		}
+	}
+	auth.RenderLogin(w, "/dashboard")
 }
 
 func DashboardHandler(w http.ResponseWriter, r *http.Request) {
@@ -68,6 +120,7 @@ func CreateDNSRecordHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	record, err := dns.CreateDNSRecord(req)
+	audit.Record(r, "dns.create", req.Subdomain, "", describeDNSRequest(req.Type, req.Target, req.Proxied), err)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
@@ -83,7 +136,10 @@ func DeleteDNSRecordHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	recordID := vars["id"]
 
-	if err := dns.DeleteDNSRecord(recordID); err != nil {
+	before := describeDNSRecordByID(recordID)
+	err := dns.DeleteDNSRecord(recordID)
+	audit.Record(r, "dns.delete", recordID, before, "deleted", err)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -102,7 +158,9 @@ func UpdateDNSRecordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	before := describeDNSRecordByID(recordID)
 	record, err := dns.UpdateDNSRecord(recordID, req)
+	audit.Record(r, "dns.update", recordID, before, describeDNSRequest(req.Type, req.Content, req.Proxied), err)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
@@ -135,6 +193,11 @@ func CreateTunnelHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tunnel, err := tunnels.CreateTunnel(req)
+	after := ""
+	if tunnel != nil {
+		after = fmt.Sprintf("%s on port %d", tunnel.Domain, tunnel.Port)
+	}
+	audit.Record(r, "tunnel.create", req.Subdomain, "", after, err)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
@@ -156,7 +219,10 @@ func DeleteTunnelHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
 
-	if err := tunnels.DeleteTunnel(name); err != nil {
+	before := tunnelState(name)
+	err := tunnels.DeleteTunnel(name)
+	audit.Record(r, "tunnel.delete", name, before, "deleted", err)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -169,7 +235,10 @@ func StartTunnelHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
 
-	if err := tunnels.StartTunnel(name); err != nil {
+	before := tunnelState(name)
+	err := tunnels.StartTunnel(name)
+	audit.Record(r, "tunnel.start", name, before, tunnelState(name), err)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -182,7 +251,10 @@ func StopTunnelHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
 
-	if err := tunnels.StopTunnel(name); err != nil {
+	before := tunnelState(name)
+	err := tunnels.StopTunnel(name)
+	audit.Record(r, "tunnel.stop", name, before, tunnelState(name), err)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -234,7 +306,10 @@ func EditTunnelConfigHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := tunnels.UpdateTunnelConfig(name, req.Config); err != nil {
+	before, _ := tunnels.GetTunnelConfig(name)
+	err := tunnels.UpdateTunnelConfig(name, req.Config)
+	audit.Record(r, "tunnel.config", name, audit.Summarize(before), audit.Summarize(req.Config), err)
+	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
@@ -254,6 +329,110 @@ func SystemStatusHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// Secret Handlers
+
+func ListSecretsHandler(w http.ResponseWriter, r *http.Request) {
+	list := secrets.List()
+
+	// The password hash is managed through /change-password only
+	visible := make([]secrets.Info, 0, len(list))
+	for _, info := range list {
+		if info.Name != auth.PasswordSecretName {
+			visible = append(visible, info)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(visible)
+}
+
+func RotateSecretHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var req struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if name == auth.PasswordSecretName {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "use Change Password to update the admin password"})
+		return
+	}
+
+	before := "unset"
+	if secrets.Has(name) {
+		before = "set"
+	}
+	err := secrets.Set(name, req.Value)
+	audit.Record(r, "secret.rotate", name, before, "set", err)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+func DeleteSecretHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	if name == auth.PasswordSecretName {
+		http.Error(w, "the admin password cannot be deleted", http.StatusBadRequest)
+		return
+	}
+
+	err := secrets.Delete(name)
+	audit.Record(r, "secret.delete", name, "set", "unset", err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// Lockout Handlers
+
+func ListLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(throttle.Lockouts())
+}
+
+func ClearLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	cleared := throttle.Clear(key)
+	var auditErr error
+	if !cleared {
+		auditErr = errors.New("not found")
+	}
+	audit.Record(r, "lockout.clear", key, "", "", auditErr)
+	if !cleared {
+		http.Error(w, "lockout not found: "+key, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+func ClearAllLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	throttle.ClearAll()
+	audit.Record(r, "lockout.clear", "*", "", "", nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
 func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
 	var req auth.ChangePasswordRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -264,6 +443,12 @@ func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
 	success := auth.ChangePassword(req.OldPassword, req.NewPassword)
 	response := auth.ChangePasswordResponse{Success: success}
 
+	var auditErr error
+	if !success {
+		auditErr = errors.New("password change rejected")
+	}
+	audit.Record(r, "password.change", auth.DefaultUsername, "", "", auditErr)
+
 	w.Header().Set("Content-Type", "application/json")
 	if success {
 		w.WriteHeader(http.StatusOK)
@@ -272,3 +457,97 @@ func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	json.NewEncoder(w).Encode(response)
 }
+
+// Audit Handlers
+
+func ListAuditHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := audit.Query(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func ExportAuditHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	if err := audit.Export(w, filter); err != nil {
+		// Headers are already sent, so all we can do is stop the stream
+		fmt.Printf("Warning: audit export interrupted: %v\n", err)
+	}
+}
+
+// parseAuditFilter reads action, actor, target, ip, success, since, until and
+// limit from the query string. Times are RFC 3339.
+func parseAuditFilter(r *http.Request) (audit.Filter, error) {
+	q := r.URL.Query()
+	f := audit.Filter{
+		Action:   q.Get("action"),
+		Actor:    q.Get("actor"),
+		Target:   q.Get("target"),
+		SourceIP: q.Get("ip"),
+	}
+
+	var err error
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, fmt.Errorf("invalid until: %v", err)
+		}
+	}
+	if v := q.Get("success"); v != "" {
+		ok, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid success: %v", err)
+		}
+		f.Success = &ok
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			return f, fmt.Errorf("invalid limit: %v", err)
+		}
+	}
+	return f, nil
+}
+
+func tunnelState(name string) string {
+	tunnel, err := tunnels.GetTunnelStatus(name)
+	if err != nil {
+		return "absent"
+	}
+	return tunnel.Status
+}
+
+func describeDNSRequest(recordType, content string, proxied bool) string {
+	if proxied {
+		return fmt.Sprintf("%s %s (proxied)", recordType, content)
+	}
+	return fmt.Sprintf("%s %s", recordType, content)
+}
+
+func describeDNSRecordByID(recordID string) string {
+	record, err := dns.GetDNSRecord(recordID)
+	if err != nil {
+		return "unknown"
+	}
+	return record.Name + " " + describeDNSRequest(record.Type, record.Content, record.Proxied)
+}
@@ -5,25 +5,26 @@ import (
 	"net/http"
 	"os"
 	"strings"
-	"time"
 
+	"cf-manager/access"
 	"cf-manager/auth"
+	"cf-manager/certs"
 	"cf-manager/handlers"
 	"cf-manager/middleware"
+	"cf-manager/secrets"
+	"cf-manager/throttle"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
-	"golang.org/x/time/rate"
 )
 
-var limiter = rate.NewLimiter(rate.Every(1*time.Minute), 20) // 20 requests per minute
-
 func rateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Apply rate limiting only to the login endpoint
+		// Apply rate limiting only to the login endpoint, per client IP.
+		// The per-account limit is checked in LoginHandler once the body is decoded.
 		if r.URL.Path == "/login" && r.Method == "POST" {
-			if !limiter.Allow() {
-				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			if wait, ok := throttle.AllowIP(throttle.ClientIP(r)); !ok {
+				throttle.WriteTooManyRequests(w, wait)
 				return
 			}
 		}
@@ -87,8 +88,36 @@ func main() {
 		log.Println("No .env file found, using system environment variables")
 	}
 
-	// Validate required environment variables
-	requiredVars := []string{"CF_API_TOKEN", "CF_ZONE_ID", "CF_DOMAIN"}
+	// Login throttling reads LOGIN_* and TRUSTED_PROXIES from the environment
+	throttle.Configure(throttle.ConfigFromEnv())
+
+	// Open the encrypted secret store and move any plaintext secrets out of .env
+	if err := secrets.Open(); err != nil {
+		log.Fatalf("Failed to open secret store: %v", err)
+	}
+	moved, err := secrets.ImportFromEnvFile(auth.EnvFilePath, secrets.CloudflareAPIToken, secrets.GeminiAPIKey)
+	if err != nil {
+		log.Fatalf("Failed to import secrets from %s: %v", auth.EnvFilePath, err)
+	}
+	for _, name := range moved {
+		log.Printf("Moved %s from %s into the encrypted secret store", name, auth.EnvFilePath)
+	}
+	if err := auth.LoadPassword(); err != nil {
+		log.Fatalf("Failed to load admin password: %v", err)
+	}
+
+	// AUTH_MODE=access or both accepts Cloudflare Access assertions
+	accessConfig, err := access.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid Cloudflare Access configuration: %v", err)
+	}
+	access.Configure(accessConfig)
+
+	// Validate required configuration
+	if secrets.Get(secrets.CloudflareAPIToken) == "" {
+		log.Fatalf("Required secret %s is not set", secrets.CloudflareAPIToken)
+	}
+	requiredVars := []string{"CF_ZONE_ID", "CF_DOMAIN"}
 	for _, v := range requiredVars {
 		if os.Getenv(v) == "" {
 			log.Fatalf("Required environment variable %s is not set", v)
@@ -104,12 +133,12 @@ func main() {
 	r.HandleFunc("/", handlers.IndexHandler).Methods("GET")
 	r.HandleFunc("/login", handlers.LoginHandler).Methods("POST")
 	r.HandleFunc("/logout", handlers.LogoutHandler).Methods("GET")
-	r.HandleFunc("/change-password", handlers.ChangePasswordHandler).Methods("POST")
 
 	// Protected routes
 	protected := r.PathPrefix("/").Subrouter()
 	protected.Use(middleware.AuthMiddleware)
 	protected.HandleFunc("/dashboard", handlers.DashboardHandler).Methods("GET")
+	protected.HandleFunc("/change-password", handlers.ChangePasswordHandler).Methods("POST")
 
 	// DNS Management routes
 	protected.HandleFunc("/dns/records", handlers.ListDNSRecordsHandler).Methods("GET")
@@ -128,6 +157,14 @@ func main() {
 
 	// System routes
 	protected.HandleFunc("/system/status", handlers.SystemStatusHandler).Methods("GET")
+	protected.HandleFunc("/system/audit", handlers.ListAuditHandler).Methods("GET")
+	protected.HandleFunc("/system/audit/export", handlers.ExportAuditHandler).Methods("GET")
+	protected.HandleFunc("/system/secrets", handlers.ListSecretsHandler).Methods("GET")
+	protected.HandleFunc("/system/secrets/{name}", handlers.RotateSecretHandler).Methods("PUT")
+	protected.HandleFunc("/system/secrets/{name}", handlers.DeleteSecretHandler).Methods("DELETE")
+	protected.HandleFunc("/system/lockouts", handlers.ListLockoutsHandler).Methods("GET")
+	protected.HandleFunc("/system/lockouts", handlers.ClearAllLockoutsHandler).Methods("DELETE")
+	protected.HandleFunc("/system/lockouts/{key}", handlers.ClearLockoutHandler).Methods("DELETE")
 
 	// Apply rate limiting middleware
 	r.Use(rateLimitMiddleware)
@@ -138,7 +175,12 @@ func main() {
 		port = "3000"
 	}
 
-	log.Printf("Cloudflare Manager running on :%s", port)
+	tlsConfig := certs.ConfigFromEnv("3443")
+	if tlsConfig.Enabled {
+		log.Printf("Cloudflare Manager running on https :%s", tlsConfig.Port)
+	} else {
+		log.Printf("Cloudflare Manager running on :%s", port)
+	}
 	log.Printf("Dev mode: %v", devMode)
-	log.Fatal(http.ListenAndServe("0.0.0.0:"+port, r))
+	log.Fatal(certs.ListenAndServe(r, "0.0.0.0", port, tlsConfig))
 }
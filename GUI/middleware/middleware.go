@@ -5,19 +5,43 @@ import (
 	"log"
 	"net/http"
 
+	"cf-manager/access"
 	"cf-manager/auth"
 )
 
-func AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie(auth.CookieName)
-		if err != nil {
-			log.Printf("Authentication failed for %s: session cookie not found", r.RemoteAddr)
-		} else {
-			log.Printf("Session cookie found for %s: %s", r.RemoteAddr, cookie.Value)
+// Authenticate checks the request against the configured login methods. On
+// success it returns the request to continue with, carrying the user when it
+// came from a Cloudflare Access assertion.
+func Authenticate(r *http.Request) (*http.Request, bool) {
+	// Behind Cloudflare Access the signed assertion replaces the local login
+	if access.Enabled() {
+		id, err := access.Authenticate(r)
+		if err == nil {
+			return auth.WithUser(r, id.Username, "access "+id.Email), true
 		}
+		if err != access.ErrNoToken {
+			log.Printf("Cloudflare Access token rejected for %s: %v", r.RemoteAddr, err)
+		}
+	}
+
+	if access.PasswordAllowed() && auth.IsAuthenticated(r) {
+		return r, true
+	}
 
-		if !auth.IsAuthenticated(r) {
+	if !access.PasswordAllowed() {
+		log.Printf("Authentication failed for %s: no valid Cloudflare Access token", r.RemoteAddr)
+	} else if _, err := r.Cookie(auth.CookieName); err != nil {
+		log.Printf("Authentication failed for %s: session cookie not found", r.RemoteAddr)
+	} else {
+		log.Printf("Authentication failed for %s: session expired or unknown", r.RemoteAddr)
+	}
+	return r, false
+}
+
+func AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, ok := Authenticate(r)
+		if !ok {
 			if r.Header.Get("Content-Type") == "application/json" {
 				w.Header().Set("Content-Type", "application/json")
 				w.WriteHeader(http.StatusUnauthorized)
@@ -0,0 +1,408 @@
+// Package secrets keeps API tokens, keys and the admin password hash encrypted
+// at rest. Values are sealed with AES-256-GCM using a key derived from a master
+// passphrase (CF_MANAGER_MASTER_PASSPHRASE) or read from a key file
+// (CF_MANAGER_KEY_FILE, generated on first use).
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	StoreFilePath  = "secrets.enc"
+	KeyFilePath    = "secrets.key"
+	PassphraseEnv  = "CF_MANAGER_MASTER_PASSPHRASE"
+	KeyFileEnv     = "CF_MANAGER_KEY_FILE"
+	storeVersion   = 1
+	keySize        = 32
+	kdfPassphrase  = "scrypt"
+	kdfKeyFile     = "keyfile"
+	scryptN        = 1 << 15
+	scryptR        = 8
+	scryptP        = 1
+	saltSize       = 16
+	fileMode       = 0600
+	maskVisibleLen = 4
+)
+
+// Names of the secrets the manager knows about. Other names can be stored too.
+const (
+	CloudflareAPIToken = "CF_API_TOKEN"
+	GeminiAPIKey       = "GEMINI_API_KEY"
+)
+
+// Info describes a stored secret without revealing it.
+type Info struct {
+	Name      string    `json:"name"`
+	Masked    string    `json:"masked"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type secret struct {
+	Value     string    `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// envelope is the on-disk format. Only Data is secret; the rest is needed to
+// rebuild the key and open it.
+type envelope struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    string `json:"salt,omitempty"`
+	Nonce   string `json:"nonce"`
+	Data    string `json:"data"`
+}
+
+var (
+	store      = make(map[string]secret)
+	storeMutex sync.RWMutex
+	aead       cipher.AEAD
+	kdf        string
+	salt       []byte
+
+	validName = regexp.MustCompile(`^[A-Z][A-Z0-9_]{0,63}$`)
+)
+
+// Open derives the key and loads the store, creating both on first run. It must
+// be called before any other function in this package.
+func Open() error {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	var env envelope
+	raw, err := os.ReadFile(StoreFilePath)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(raw, &env); err != nil {
+			return fmt.Errorf("corrupt secret store %s: %v", StoreFilePath, err)
+		}
+		if env.Version != storeVersion {
+			return fmt.Errorf("unsupported secret store version %d", env.Version)
+		}
+	case os.IsNotExist(err):
+		env.KDF = kdfKeyFile
+		if os.Getenv(PassphraseEnv) != "" {
+			env.KDF = kdfPassphrase
+		}
+	default:
+		return fmt.Errorf("failed to read secret store: %v", err)
+	}
+
+	// Tighten permissions on stores written by older builds
+	if err == nil {
+		os.Chmod(StoreFilePath, fileMode)
+	}
+
+	kdf = env.KDF
+	salt = nil
+	if env.Salt != "" {
+		if salt, err = base64.StdEncoding.DecodeString(env.Salt); err != nil {
+			return fmt.Errorf("corrupt secret store salt: %v", err)
+		}
+	}
+
+	key, err := deriveKey(env.Data == "")
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+
+	store = make(map[string]secret)
+	if env.Data == "" {
+		return nil
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(env.Nonce)
+	if err != nil {
+		return fmt.Errorf("corrupt secret store nonce: %v", err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(env.Data)
+	if err != nil {
+		return fmt.Errorf("corrupt secret store data: %v", err)
+	}
+	plain, err := aead.Open(nil, nonce, sealed, []byte(env.KDF))
+	if err != nil {
+		return fmt.Errorf("cannot decrypt %s: wrong passphrase or key file", StoreFilePath)
+	}
+	return json.Unmarshal(plain, &store)
+}
+
+// Get returns the stored value for name, falling back to the process
+// environment so deployments that inject variables still work.
+func Get(name string) string {
+	storeMutex.RLock()
+	s, ok := store[name]
+	storeMutex.RUnlock()
+	if ok {
+		return s.Value
+	}
+	return os.Getenv(name)
+}
+
+// Has reports whether name is in the encrypted store (ignoring the environment).
+func Has(name string) bool {
+	storeMutex.RLock()
+	defer storeMutex.RUnlock()
+	_, ok := store[name]
+	return ok
+}
+
+// Set stores or rotates a secret and rewrites the store.
+func Set(name, value string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid secret name %q", name)
+	}
+	if value == "" {
+		return fmt.Errorf("secret value cannot be empty")
+	}
+
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	previous, existed := store[name]
+	store[name] = secret{Value: value, UpdatedAt: time.Now().UTC()}
+	if err := save(); err != nil {
+		if existed {
+			store[name] = previous
+		} else {
+			delete(store, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes a secret from the store.
+func Delete(name string) error {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	previous, ok := store[name]
+	if !ok {
+		return fmt.Errorf("secret not found: %s", name)
+	}
+	delete(store, name)
+	if err := save(); err != nil {
+		store[name] = previous
+		return err
+	}
+	return nil
+}
+
+// List describes every stored secret, sorted by name.
+func List() []Info {
+	storeMutex.RLock()
+	defer storeMutex.RUnlock()
+
+	list := make([]Info, 0, len(store))
+	for name, s := range store {
+		list = append(list, Info{Name: name, Masked: Mask(s.Value), UpdatedAt: s.UpdatedAt})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Mask hides all but the last few characters of a value.
+func Mask(value string) string {
+	if len(value) <= maskVisibleLen*2 {
+		return strings.Repeat("•", 8)
+	}
+	return strings.Repeat("•", 8) + value[len(value)-maskVisibleLen:]
+}
+
+// ImportFromEnvFile moves the named variables out of a plaintext .env file into
+// the store. Values already in the store win. The .env file is rewritten
+// without those lines. It returns the names that were removed from the file.
+func ImportFromEnvFile(path string, names ...string) ([]string, error) {
+	values, err := EnvFileValues(path, names...)
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+
+	var moved []string
+	for _, name := range names {
+		value, found := values[name]
+		if !found {
+			continue
+		}
+		if value != "" && !Has(name) {
+			if err := Set(name, value); err != nil {
+				return moved, err
+			}
+		}
+		moved = append(moved, name)
+	}
+	return moved, RemoveFromEnvFile(path, moved...)
+}
+
+// EnvFileValues returns the named variables that a .env file sets, unquoted.
+// A missing file sets none.
+func EnvFileValues(path string, names ...string) (map[string]string, error) {
+	_, values, err := splitEnvFile(path, names)
+	return values, err
+}
+
+// RemoveFromEnvFile rewrites a .env file without the lines setting the named
+// variables, once whatever they held has been stored another way.
+func RemoveFromEnvFile(path string, names ...string) error {
+	kept, values, err := splitEnvFile(path, names)
+	if err != nil || len(values) == 0 {
+		return err
+	}
+	return writeFileAtomic(path, []byte(strings.Join(kept, "\n")))
+}
+
+// splitEnvFile reads a .env file into the lines that do not set one of names
+// and the values of those that do.
+func splitEnvFile(path string, names []string) ([]string, map[string]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	wanted := make(map[string]bool, len(names))
+	for _, n := range names {
+		wanted[n] = true
+	}
+
+	var kept []string
+	values := make(map[string]string)
+	for _, line := range strings.Split(string(raw), "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		key = strings.TrimSpace(strings.TrimPrefix(key, "export "))
+		if !found || !wanted[key] {
+			kept = append(kept, line)
+			continue
+		}
+		values[key] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	return kept, values, nil
+}
+
+// save seals the store and replaces the file. Callers hold storeMutex.
+func save() error {
+	plain, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	env := envelope{
+		Version: storeVersion,
+		KDF:     kdf,
+		Nonce:   base64.StdEncoding.EncodeToString(nonce),
+		Data:    base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, plain, []byte(kdf))),
+	}
+	if salt != nil {
+		env.Salt = base64.StdEncoding.EncodeToString(salt)
+	}
+
+	out, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(StoreFilePath, out)
+}
+
+// deriveKey builds the store key. A missing key file is only generated when
+// the store is new; otherwise it would silently replace the key that sealed it.
+func deriveKey(isNew bool) ([]byte, error) {
+	if kdf == kdfPassphrase {
+		passphrase := os.Getenv(PassphraseEnv)
+		if passphrase == "" {
+			return nil, fmt.Errorf("%s is encrypted with a passphrase but %s is not set", StoreFilePath, PassphraseEnv)
+		}
+		if salt == nil {
+			salt = make([]byte, saltSize)
+			if _, err := rand.Read(salt); err != nil {
+				return nil, err
+			}
+		}
+		return scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, keySize)
+	}
+
+	if kdf != kdfKeyFile {
+		return nil, fmt.Errorf("unknown key derivation %q", kdf)
+	}
+
+	keyPath := os.Getenv(KeyFileEnv)
+	if keyPath == "" {
+		keyPath = KeyFilePath
+	}
+
+	key, err := os.ReadFile(keyPath)
+	if os.IsNotExist(err) && isNew {
+		key = make([]byte, keySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(keyPath, key); err != nil {
+			return nil, fmt.Errorf("failed to create key file: %v", err)
+		}
+		log.Printf("Generated new secrets key file %s; keep it safe, it is required to read %s", keyPath, StoreFilePath)
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %v", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("key file %s must contain exactly %d bytes", keyPath, keySize)
+	}
+	return key, nil
+}
+
+// writeFileAtomic writes data with owner-only permissions via a temp file so a
+// crash never leaves a half-written store behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(fileMode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -415,6 +415,7 @@ body {
             <button class="dropdown-item" onclick="refreshAll()">Refresh All</button>
             <button class="dropdown-item" onclick="logout()">Logout</button>
             <button class="dropdown-item" onclick="showChangePasswordModal()">Change Password</button>
+            <button class="dropdown-item" onclick="showSecretsModal()">Manage Secrets</button>
           </div>
         </div>
       </div>
@@ -589,6 +590,30 @@ body {
     </div>
   </div>
 
+  <!-- Secrets Modal -->
+  <div class="modal-overlay" id="secrets-modal">
+    <div class="modal">
+      <div class="modal-header">Secrets (encrypted at rest)</div>
+      <div id="secrets-container">
+        <div class="empty-state">Loading secrets...</div>
+      </div>
+      <form id="secret-form">
+        <div class="form-group">
+          <label class="form-label">Name</label>
+          <input type="text" class="form-input" id="secret-name" placeholder="CF_API_TOKEN" pattern="[A-Z][A-Z0-9_]*" required>
+        </div>
+        <div class="form-group">
+          <label class="form-label">New Value</label>
+          <input type="password" class="form-input" id="secret-value" autocomplete="off" required>
+        </div>
+        <div class="modal-actions">
+          <button type="submit" class="btn btn-primary">SAVE SECRET</button>
+          <button type="button" class="btn btn-secondary" onclick="closeModal('secrets-modal')">CLOSE</button>
+        </div>
+      </form>
+    </div>
+  </div>
+
   <!-- YAML Editor Modal -->
   <div id="yaml-modal" class="modal">
     <div class="modal-content">
@@ -1082,6 +1107,93 @@ body {
       }
     });
 
+    function showSecretsModal() {
+      document.getElementById('secret-form').reset();
+      fetchSecrets();
+      openModal('secrets-modal');
+    }
+
+    async function fetchSecrets() {
+      const container = document.getElementById('secrets-container');
+      try {
+        const response = await fetch('/system/secrets');
+        const list = await response.json();
+        if (!list || list.length === 0) {
+          container.innerHTML = '<div class="empty-state">No secrets stored</div>';
+          return;
+        }
+        container.innerHTML = '<table class="table">' +
+          '<thead><tr><th>Name</th><th>Value</th><th>Updated</th><th>Actions</th></tr></thead>' +
+          '<tbody>' +
+          list.map(secret =>
+            '<tr>' +
+            '<td>' + secret.name + '</td>' +
+            '<td>' + secret.masked + '</td>' +
+            '<td>' + new Date(secret.updated_at).toLocaleString() + '</td>' +
+            '<td>' +
+            '<button class="btn btn-secondary btn-small" onclick="rotateSecret(\'' + secret.name + '\')">ROTATE</button> ' +
+            '<button class="btn btn-danger btn-small" onclick="deleteSecret(\'' + secret.name + '\')">DELETE</button>' +
+            '</td>' +
+            '</tr>'
+          ).join('') +
+          '</tbody></table>';
+      } catch (error) {
+        showToast('Failed to fetch secrets', 'error');
+      }
+    }
+
+    function rotateSecret(name) {
+      document.getElementById('secret-name').value = name;
+      document.getElementById('secret-value').value = '';
+      document.getElementById('secret-value').focus();
+    }
+
+    async function deleteSecret(name) {
+      if (!confirm('Delete secret "' + name + '"?')) return;
+
+      try {
+        const response = await fetch('/system/secrets/' + name, {
+          method: 'DELETE'
+        });
+
+        if (response.ok) {
+          showToast('Secret deleted', 'success');
+          fetchSecrets();
+        } else {
+          showToast('Failed to delete secret', 'error');
+        }
+      } catch (error) {
+        showToast('Server error', 'error');
+      }
+    }
+
+    document.getElementById('secret-form').addEventListener('submit', async function(e) {
+      e.preventDefault();
+
+      const name = document.getElementById('secret-name').value.trim();
+      const value = document.getElementById('secret-value').value;
+
+      try {
+        const response = await fetch('/system/secrets/' + name, {
+          method: 'PUT',
+          headers: {'Content-Type': 'application/json'},
+          body: JSON.stringify({ value })
+        });
+
+        const result = await response.json();
+
+        if (response.ok && result.success) {
+          showToast('Secret ' + name + ' saved', 'success');
+          document.getElementById('secret-form').reset();
+          fetchSecrets();
+        } else {
+          showToast(result.error || 'Failed to save secret', 'error');
+        }
+      } catch (error) {
+        showToast('Server error', 'error');
+      }
+    });
+
     let currentYamlTunnel = null;
 
     async function editTunnelConfig(name) {
@@ -1128,6 +1240,7 @@ body {
         closeModal('edit-dns-modal');
         closeModal('tunnel-modal');
         closeModal('change-password-modal');
+        closeModal('secrets-modal');
       }
     });
   </script>
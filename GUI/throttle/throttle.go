@@ -0,0 +1,412 @@
+// Package throttle slows down repeated login attempts and temporarily locks out
+// client IPs and accounts that keep failing.
+package throttle
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	KindIP      = "ip"
+	KindAccount = "account"
+)
+
+// Config controls the per-IP and per-account limits. Every field can be
+// overridden from the environment, see ConfigFromEnv.
+type Config struct {
+	IPRate          rate.Limit
+	IPBurst         int
+	AccountRate     rate.Limit
+	AccountBurst    int
+	MaxFailures     int
+	FailureWindow   time.Duration
+	LockoutDuration time.Duration
+	TrustedProxies  []*net.IPNet
+}
+
+// Lockout describes the failure state of one IP or account.
+type Lockout struct {
+	Key         string    `json:"key"`
+	Kind        string    `json:"kind"`
+	Subject     string    `json:"subject"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+	Locked      bool      `json:"locked"`
+}
+
+type entry struct {
+	limiter      *rate.Limiter
+	failures     int
+	firstFailure time.Time
+	lastFailure  time.Time
+	lockedUntil  time.Time
+	lastSeen     time.Time
+}
+
+var (
+	mu      sync.Mutex
+	cfg     = DefaultConfig()
+	entries = make(map[string]*entry)
+)
+
+func init() {
+	go janitor()
+}
+
+// DefaultConfig keeps the old global limit (20 attempts, one new attempt per
+// minute) but applies it per IP, and trusts forwarding headers only from the
+// local cloudflared connector.
+func DefaultConfig() Config {
+	return Config{
+		IPRate:          rate.Every(1 * time.Minute),
+		IPBurst:         20,
+		AccountRate:     rate.Every(1 * time.Minute),
+		AccountBurst:    10,
+		MaxFailures:     5,
+		FailureWindow:   15 * time.Minute,
+		LockoutDuration: 15 * time.Minute,
+		TrustedProxies:  parseCIDRs("127.0.0.1/32,::1/128"),
+	}
+}
+
+// ConfigFromEnv builds a Config from LOGIN_* and TRUSTED_PROXIES variables,
+// falling back to DefaultConfig for anything unset or invalid.
+func ConfigFromEnv() Config {
+	c := DefaultConfig()
+	if n := envInt("LOGIN_IP_BURST"); n > 0 {
+		c.IPBurst = n
+	}
+	if d := envDuration("LOGIN_IP_INTERVAL"); d > 0 {
+		c.IPRate = rate.Every(d)
+	}
+	if n := envInt("LOGIN_ACCOUNT_BURST"); n > 0 {
+		c.AccountBurst = n
+	}
+	if d := envDuration("LOGIN_ACCOUNT_INTERVAL"); d > 0 {
+		c.AccountRate = rate.Every(d)
+	}
+	if n := envInt("LOGIN_MAX_FAILURES"); n > 0 {
+		c.MaxFailures = n
+	}
+	if d := envDuration("LOGIN_FAILURE_WINDOW"); d > 0 {
+		c.FailureWindow = d
+	}
+	if d := envDuration("LOGIN_LOCKOUT_DURATION"); d > 0 {
+		c.LockoutDuration = d
+	}
+	if v, ok := os.LookupEnv("TRUSTED_PROXIES"); ok {
+		c.TrustedProxies = parseCIDRs(v)
+	}
+	return c
+}
+
+// Configure replaces the active configuration. Existing limiters are dropped
+// so the new rates take effect immediately; failure counts are kept.
+func Configure(c Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	cfg = c
+	for _, e := range entries {
+		e.limiter = nil
+	}
+}
+
+// ClientIP returns the address of the client that made the request. Forwarding
+// headers are only honoured when the direct peer is a trusted proxy, so a
+// client talking to us directly cannot pick its own rate limit bucket.
+func ClientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+
+	mu.Lock()
+	trusted := cfg.TrustedProxies
+	mu.Unlock()
+
+	if !isTrusted(peer, trusted) {
+		return peer
+	}
+
+	// cloudflared sets CF-Connecting-IP to the visitor address seen by the edge
+	if ip := strings.TrimSpace(r.Header.Get("CF-Connecting-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+
+	// Walk X-Forwarded-For from the right, skipping our own proxies
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if !isTrusted(hop, trusted) {
+				return hop
+			}
+		}
+	}
+
+	return peer
+}
+
+// AllowIP reports whether another login attempt from ip may proceed. When it
+// may not, the returned duration says how long the client should wait.
+func AllowIP(ip string) (time.Duration, bool) {
+	return allow(KindIP, ip)
+}
+
+// AllowAccount is AllowIP for the account named in the login request.
+func AllowAccount(account string) (time.Duration, bool) {
+	return allow(KindAccount, account)
+}
+
+// RecordFailure counts a failed login against both the IP and the account and
+// starts a lockout once either reaches MaxFailures inside FailureWindow. An
+// empty account, for a name that does not exist, counts against the IP only.
+func RecordFailure(ip, account string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	keys := []string{makeKey(KindIP, ip)}
+	if account != "" {
+		keys = append(keys, makeKey(KindAccount, account))
+	}
+	for _, key := range keys {
+		e := getEntry(key, now)
+		if e.failures == 0 || now.Sub(e.firstFailure) > cfg.FailureWindow {
+			e.failures = 0
+			e.firstFailure = now
+		}
+		e.failures++
+		e.lastFailure = now
+		if e.failures >= cfg.MaxFailures {
+			e.lockedUntil = now.Add(cfg.LockoutDuration)
+			log.Printf("Login lockout: %s locked until %s after %d failures", key, e.lockedUntil.Format(time.RFC3339), e.failures)
+		}
+	}
+}
+
+// RecordSuccess resets the failure counters for the IP and the account.
+func RecordSuccess(ip, account string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, key := range []string{makeKey(KindIP, ip), makeKey(KindAccount, account)} {
+		if e, ok := entries[key]; ok {
+			e.failures = 0
+			e.lockedUntil = time.Time{}
+		}
+	}
+}
+
+// Lockouts lists every IP and account with recent failures, locked ones first.
+func Lockouts() []Lockout {
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	list := make([]Lockout, 0)
+	for key, e := range entries {
+		if e.failures == 0 && !now.Before(e.lockedUntil) {
+			continue
+		}
+		kind, subject, _ := strings.Cut(key, ":")
+		l := Lockout{
+			Key:         key,
+			Kind:        kind,
+			Subject:     subject,
+			Failures:    e.failures,
+			LastFailure: e.lastFailure,
+			Locked:      now.Before(e.lockedUntil),
+		}
+		if l.Locked {
+			l.LockedUntil = e.lockedUntil
+		}
+		list = append(list, l)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Locked != list[j].Locked {
+			return list[i].Locked
+		}
+		return list[i].LastFailure.After(list[j].LastFailure)
+	})
+	return list
+}
+
+// Clear removes the failure state and lockout for key (as returned in
+// Lockout.Key). It reports whether anything was cleared.
+func Clear(key string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := entries[key]; !ok {
+		return false
+	}
+	delete(entries, key)
+	return true
+}
+
+// ClearAll removes every failure counter and lockout.
+func ClearAll() {
+	mu.Lock()
+	defer mu.Unlock()
+	entries = make(map[string]*entry)
+}
+
+// WriteTooManyRequests answers a throttled login attempt with a Retry-After
+// header and a JSON body the login page can show.
+func WriteTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   fmt.Sprintf("Too many login attempts. Try again in %d seconds.", seconds),
+	})
+}
+
+func allow(kind, subject string) (time.Duration, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	e := getEntry(makeKey(kind, subject), now)
+	if now.Before(e.lockedUntil) {
+		return e.lockedUntil.Sub(now), false
+	}
+
+	if e.limiter == nil {
+		if kind == KindIP {
+			e.limiter = rate.NewLimiter(cfg.IPRate, cfg.IPBurst)
+		} else {
+			e.limiter = rate.NewLimiter(cfg.AccountRate, cfg.AccountBurst)
+		}
+	}
+
+	res := e.limiter.ReserveN(now, 1)
+	if !res.OK() {
+		return cfg.LockoutDuration, false
+	}
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return delay, false
+	}
+	return 0, true
+}
+
+func getEntry(key string, now time.Time) *entry {
+	e, ok := entries[key]
+	if !ok {
+		e = &entry{}
+		entries[key] = e
+	}
+	e.lastSeen = now
+	return e
+}
+
+func makeKey(kind, subject string) string {
+	return kind + ":" + Normalize(subject)
+}
+
+// Normalize is how IPs and account names are compared: trimmed and
+// lowercased, so "Admin " is the same account as "admin".
+func Normalize(subject string) string {
+	return strings.ToLower(strings.TrimSpace(subject))
+}
+
+// janitor drops idle entries so the map does not grow with every address that
+// ever hit /login.
+func janitor() {
+	for range time.Tick(10 * time.Minute) {
+		mu.Lock()
+		now := time.Now()
+		for key, e := range entries {
+			idle := now.Sub(e.lastSeen) > time.Hour
+			if idle && !now.Before(e.lockedUntil) {
+				delete(entries, key)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(list string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Printf("Ignoring invalid trusted proxy %q: %v", s, err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func envInt(name string) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", name, v, err)
+		return 0
+	}
+	return n
+}
+
+func envDuration(name string) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", name, v, err)
+		return 0
+	}
+	return d
+}
@@ -15,6 +15,8 @@ import (
 	"syscall"
 	"time"
 
+	"cf-manager/secrets"
+
 	"github.com/shirou/gopsutil/v3/process"
 	"gopkg.in/yaml.v3"
 )
@@ -38,8 +40,26 @@ type CreateTunnelRequest struct {
 
 var configDir = filepath.Join(os.Getenv("HOME"), ".cloudflared")
 
+// A tunnel's log is moved aside to <name>.log.1 when it grows past this at
+// start, so at most two of these are kept.
+const maxLogSize = 1 << 20
+
 func init() {
 	os.MkdirAll(filepath.Join(configDir, "pids"), 0755)
+	os.MkdirAll(filepath.Join(configDir, "logs"), 0755)
+}
+
+func logPath(name string) string {
+	return filepath.Join(configDir, "logs", name+".log")
+}
+
+// openTunnelLog opens the log cloudflared's output is appended to.
+func openTunnelLog(name string) (*os.File, error) {
+	path := logPath(name)
+	if info, err := os.Stat(path); err == nil && info.Size() > maxLogSize {
+		os.Rename(path, path+".1")
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 }
 
 func generatePetName() string {
@@ -127,7 +147,7 @@ ingress:
 
 // createTunnelDNSRecord creates a CNAME record for the tunnel
 func createTunnelDNSRecord(subdomain, target string) error {
-	apiToken := os.Getenv("CF_API_TOKEN")
+	apiToken := secrets.Get(secrets.CloudflareAPIToken)
 	zoneID := os.Getenv("CF_ZONE_ID")
 	domain := os.Getenv("CF_DOMAIN")
 
@@ -330,11 +350,21 @@ func StartTunnel(name string) error {
 		}
 	}
 
+	logFile, err := openTunnelLog(name)
+	if err != nil {
+		return fmt.Errorf("failed to open tunnel log: %v", err)
+	}
+	defer logFile.Close()
+	fmt.Fprintf(logFile, "--- %s starting tunnel %s\n", time.Now().Format(time.RFC3339), name)
+
 	// Start new process
 	cmd := exec.Command("cloudflared", "tunnel", "--config", configPath, "run")
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
 
 	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(logFile, "--- failed to start: %v\n", err)
 		return fmt.Errorf("failed to start tunnel: %v", err)
 	}
 
@@ -391,6 +421,9 @@ func DeleteTunnel(name string) error {
 	pidPath := filepath.Join(configDir, "pids", fmt.Sprintf("%s.pid", name))
 	os.Remove(pidPath)
 
+	os.Remove(logPath(name))
+	os.Remove(logPath(name) + ".1")
+
 	return nil
 }
 
@@ -398,6 +431,49 @@ func GetTunnelStatus(name string) (*Tunnel, error) {
 	return getTunnelFromConfig(name)
 }
 
+// GetTunnelLogs returns the last lines of what cloudflared wrote for the
+// tunnel since the manager started capturing it.
+func GetTunnelLogs(name string, lines int) (string, error) {
+	if _, err := os.Stat(filepath.Join(configDir, name+"-config.yml")); os.IsNotExist(err) {
+		return "", fmt.Errorf("tunnel config not found: %s", name)
+	}
+
+	content, err := ioutil.ReadFile(logPath(name))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read tunnel log: %v", err)
+	}
+
+	all := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	if lines > 0 && len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+	return strings.Join(all, "\n"), nil
+}
+
+// TunnelSecrets returns the TunnelSecret of every credentials file in the
+// cloudflared directory, so they can be kept out of text that leaves the
+// machine.
+func TunnelSecrets() []string {
+	files, _ := filepath.Glob(filepath.Join(configDir, "*.json"))
+	var found []string
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var creds struct {
+			TunnelSecret string `json:"TunnelSecret"`
+		}
+		if json.Unmarshal(content, &creds) == nil && creds.TunnelSecret != "" {
+			found = append(found, creds.TunnelSecret)
+		}
+	}
+	return found
+}
+
 func GetTunnelConfig(name string) (string, error) {
 	configPath := filepath.Join(configDir, name+"-config.yml")
 
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-manager/ai"
+	"cf-manager/auth"
+)
+
+const (
+	defaultAITemperature = 0.7
+	defaultAIMaxTokens   = 2048
+	maxAITopK            = 100
+
+	// How many times one user message may go back and forth through tools
+	// before the model has to answer.
+	maxAIToolRounds = 5
+)
+
+// AIProviderSettings is how one provider kind is reached.
+type AIProviderSettings struct {
+	BaseURL string
+	Model   string
+	// KeyEnv names the secret holding the API key, kept in the secret store
+	// or set in the environment. Local servers usually need none, so it may
+	// well be unset.
+	KeyEnv string
+}
+
+// AISettings tune generation. Zero fields take the server defaults;
+// Temperature is a pointer because 0 is a valid choice.
+type AISettings struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopK        int      `json:"topK,omitempty"`
+	TopP        float64  `json:"topP,omitempty"`
+	MaxTokens   int      `json:"maxTokens,omitempty"`
+}
+
+var (
+	aiDefaultProvider = ai.Gemini
+	aiProviders       = map[string]*AIProviderSettings{}
+
+	aiSystemPrompt string
+	aiTemperature  = defaultAITemperature
+	aiMaxTokens    = defaultAIMaxTokens
+	aiToolsEnabled = true
+)
+
+// aiKeyEnv are the secret names API keys are kept under, in the secret store
+// or else the environment. They are looked up on every request so a rotated
+// key is picked up without a restart.
+var aiKeyEnv = map[string]string{
+	ai.Gemini:   "GEMINI_API_KEY",
+	ai.OpenAI:   "OPENAI_API_KEY",
+	ai.Ollama:   "OLLAMA_API_KEY",
+	ai.LlamaCpp: "LLAMACPP_API_KEY",
+}
+
+// loadAIConfig reads FM_AI_PROVIDER, the provider the assistant uses unless a
+// request picks another, and FM_AI_MODEL / FM_AI_BASE_URL for it. Each kind
+// can also be set up on its own with FM_AI_<KIND>_MODEL and
+// FM_AI_<KIND>_URL, e.g. FM_AI_OLLAMA_URL=http://192.168.1.5:11434.
+func loadAIConfig() error {
+	if v := os.Getenv("FM_AI_PROVIDER"); v != "" {
+		aiDefaultProvider = strings.ToLower(v)
+	}
+	known := false
+	for _, kind := range ai.Kinds() {
+		prefix := "FM_AI_" + strings.ToUpper(kind) + "_"
+		aiProviders[kind] = &AIProviderSettings{
+			BaseURL: strings.TrimRight(os.Getenv(prefix+"URL"), "/"),
+			Model:   os.Getenv(prefix + "MODEL"),
+			KeyEnv:  aiKeyEnv[kind],
+		}
+		if kind == aiDefaultProvider {
+			known = true
+		}
+	}
+	if !known {
+		return fmt.Errorf("unknown FM_AI_PROVIDER %q (expected one of %s)", aiDefaultProvider, strings.Join(ai.Kinds(), ", "))
+	}
+
+	settings := aiProviders[aiDefaultProvider]
+	if v := os.Getenv("FM_AI_MODEL"); v != "" {
+		settings.Model = v
+	}
+	if v := os.Getenv("FM_AI_BASE_URL"); v != "" {
+		settings.BaseURL = strings.TrimRight(v, "/")
+	}
+	if err := loadAIGeneration(); err != nil {
+		return err
+	}
+	if err := loadAIAttachLimit(); err != nil {
+		return err
+	}
+	if err := loadAIRedaction(); err != nil {
+		return err
+	}
+	if err := loadAIConversationSettings(); err != nil {
+		return err
+	}
+	return loadAIUsage()
+}
+
+// loadAIGeneration reads FM_AI_TEMPERATURE, the default temperature,
+// FM_AI_MAX_TOKENS, the most tokens a reply may have (and the default),
+// FM_AI_SYSTEM_PROMPT_FILE, a file replacing the built-in system prompt, and
+// FM_AI_TOOLS, which set to false stops offering the model any tools.
+func loadAIGeneration() error {
+	if v := os.Getenv("FM_AI_TOOLS"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid FM_AI_TOOLS %q", v)
+		}
+		aiToolsEnabled = enabled
+	}
+	if v := os.Getenv("FM_AI_TEMPERATURE"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil || t < 0 || t > 2 {
+			return fmt.Errorf("invalid FM_AI_TEMPERATURE %q", v)
+		}
+		aiTemperature = t
+	}
+	if v := os.Getenv("FM_AI_MAX_TOKENS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid FM_AI_MAX_TOKENS %q", v)
+		}
+		aiMaxTokens = n
+	}
+
+	aiSystemPrompt = defaultSystemPrompt()
+	if v := os.Getenv("FM_AI_SYSTEM_PROMPT_FILE"); v != "" {
+		prompt, err := os.ReadFile(v)
+		if err != nil {
+			return fmt.Errorf("cannot read FM_AI_SYSTEM_PROMPT_FILE: %v", err)
+		}
+		aiSystemPrompt = strings.TrimSpace(string(prompt))
+	}
+	return nil
+}
+
+// defaultSystemPrompt describes the machine the assistant is helping with, so
+// its advice fits Termux and the tunnel layout this manager keeps.
+func defaultSystemPrompt() string {
+	home := os.Getenv("HOME")
+	cloudflared := filepath.Join(home, ".cloudflared")
+	domain := os.Getenv("CF_DOMAIN")
+	if domain == "" {
+		domain = "the configured Cloudflare zone"
+	}
+	roots := make([]string, 0, len(allowedRoots))
+	for _, root := range allowedRoots {
+		roots = append(roots, root.Path)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("You are the assistant built into a self-hosted file manager and Cloudflare Tunnel manager. ")
+	sb.WriteString("It usually runs on an Android phone under Termux: there is no root access and no systemd, packages are installed with pkg, ")
+	sb.WriteString("binaries live under $PREFIX (/data/data/com.termux/files/usr) and the home directory is " + home + ".\n\n")
+	sb.WriteString("Tunnels are run by cloudflared and kept in " + cloudflared + ":\n")
+	sb.WriteString("- <name>-config.yml is the config of tunnel <name>, with its tunnel ID, credentials-file and one ingress rule mapping <name>." + domain + " to a local http://0.0.0.0:<port> service, followed by a http_status:404 catch-all.\n")
+	sb.WriteString("- <tunnel-id>.json holds the tunnel credentials and cert.pem the account certificate. Never ask the user to paste their contents.\n")
+	sb.WriteString("- pids/<name>.pid holds the PID of a running tunnel, started with: cloudflared tunnel --config <config> run.\n")
+	sb.WriteString("Each tunnel has a CNAME record <name>." + domain + " pointing to <tunnel-id>.cfargotunnel.com.\n\n")
+	if len(roots) > 0 {
+		sb.WriteString("The file manager can reach these directories: " + strings.Join(roots, ", ") + ".\n\n")
+	}
+	sb.WriteString("You can inspect tunnels and their logs with your tools. Starting or stopping a tunnel and creating DNS records are proposed to the user, who has to approve them; say what you propose and why.\n\n")
+	sb.WriteString("Keep answers short and practical for a small screen. Prefer commands that work in Termux, and say when something needs a step outside it.")
+	return sb.String()
+}
+
+// resolveAISettings fills in the server defaults and rejects values outside
+// the limits the server allows.
+func resolveAISettings(s AISettings) (AISettings, error) {
+	if s.Temperature == nil {
+		t := aiTemperature
+		s.Temperature = &t
+	} else if *s.Temperature < 0 || *s.Temperature > 2 {
+		return s, errors.New("temperature must be between 0 and 2")
+	}
+	if s.TopK < 0 || s.TopK > maxAITopK {
+		return s, fmt.Errorf("topK must be between 1 and %d", maxAITopK)
+	}
+	if s.TopP < 0 || s.TopP > 1 {
+		return s, errors.New("topP must be between 0 and 1")
+	}
+	if s.MaxTokens < 0 || s.MaxTokens > aiMaxTokens {
+		return s, fmt.Errorf("maxTokens must be between 1 and %d", aiMaxTokens)
+	}
+	if s.MaxTokens == 0 {
+		s.MaxTokens = aiMaxTokens
+	}
+	return s, nil
+}
+
+// aiCall is an assistant request ready to be sent. added are the messages
+// the browser sent to go on with conversation.
+type aiCall struct {
+	provider     ai.Provider
+	request      *ai.Request
+	conversation *AIConversation
+	added        []ai.Message
+	// overhead is what summarizing older turns took, counted with the turn.
+	overhead ai.Usage
+	// redactor masks secrets in everything sent, and keeps count of those
+	// in new messages for the reply.
+	redactor *aiRedactor
+}
+
+// newAICall builds every request the server makes to a model, adding the
+// system prompt, the tools when wanted and the generation settings, which
+// must already have been through resolveAISettings.
+func newAICall(provider ai.Provider, messages []ai.Message, settings AISettings, tools bool) *aiCall {
+	call := &aiCall{
+		provider: provider,
+		request: &ai.Request{
+			System:      aiSystemPrompt,
+			Messages:    messages,
+			Temperature: settings.Temperature,
+			TopK:        settings.TopK,
+			TopP:        settings.TopP,
+			MaxTokens:   settings.MaxTokens,
+		},
+	}
+	if tools {
+		call.request.Tools = aiToolDeclarations()
+	}
+	return call
+}
+
+// aiTurn is what answering one request added to the conversation.
+type aiTurn struct {
+	Messages []ai.Message `json:"messages"`
+	Pending  []*AIAction  `json:"pending"`
+	Model    string       `json:"model"`
+	Usage    ai.Usage     `json:"usage"`
+}
+
+// reply joins the text the model wrote over the turn.
+func (t *aiTurn) reply() string {
+	var parts []string
+	for _, m := range t.Messages {
+		if m.Role == ai.RoleAssistant && m.Text != "" {
+			parts = append(parts, m.Text)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// run sends the conversation, summarized first if it has grown too long,
+// and keeps answering the model's read-only tool calls until it replies,
+// proposes actions that need approval, or runs out of rounds. With emit set
+// the reply is streamed and reported through it as "delta", "tool" and
+// "action" events; otherwise it is fetched whole.
+func (c *aiCall) run(r *http.Request, emit func(event string, v interface{}) error) (*aiTurn, error) {
+	if c.conversation != nil {
+		c.fitContext(r.Context())
+	}
+	turn := &aiTurn{Pending: []*AIAction{}, Usage: c.overhead}
+	for round := 1; ; round++ {
+		var resp *ai.Response
+		var err error
+		if emit != nil {
+			resp, err = c.provider.Stream(r.Context(), c.request, func(text string) error {
+				return emit("delta", map[string]string{"text": text})
+			})
+		} else {
+			resp, err = c.provider.Chat(r.Context(), c.request)
+		}
+		if resp != nil {
+			turn.Model = resp.Model
+			turn.Usage.PromptTokens += resp.Usage.PromptTokens
+			turn.Usage.CompletionTokens += resp.Usage.CompletionTokens
+		}
+		if err != nil {
+			return turn, err
+		}
+
+		reply := ai.Message{Role: ai.RoleAssistant, Text: resp.Text, ToolCalls: resp.ToolCalls}
+		c.addMessage(turn, reply)
+		if len(resp.ToolCalls) == 0 {
+			return turn, nil
+		}
+
+		limited := round >= maxAIToolRounds
+		for _, call := range resp.ToolCalls {
+			if limited {
+				// Every call needs an answer or the next request is refused
+				c.addMessage(turn, ai.Message{
+					Role:       ai.RoleTool,
+					ToolCallID: call.ID,
+					Name:       call.Name,
+					Text:       "Not run: too many tool calls for one message. Answer with what you know so far.",
+				})
+				continue
+			}
+
+			tool := aiToolByName(call.Name)
+			if tool != nil && !tool.readOnly {
+				action, err := proposeAIAction(auth.Username(r), call, tool)
+				if err != nil {
+					return turn, err
+				}
+				turn.Pending = append(turn.Pending, action)
+				if emit != nil {
+					emit("action", action)
+				}
+				continue
+			}
+
+			result := runAITool(r, call)
+			c.addMessage(turn, result)
+			if emit != nil {
+				emit("tool", map[string]interface{}{"name": call.Name, "args": call.Args, "result": result.Text})
+			}
+		}
+		if len(turn.Pending) > 0 {
+			return turn, nil
+		}
+		if limited {
+			if round > maxAIToolRounds {
+				// Tools were not offered and the model called them anyway
+				return turn, nil
+			}
+			// One more request for the answer, with no tools to call
+			c.request.Tools = nil
+		}
+	}
+}
+
+func (c *aiCall) addMessage(turn *aiTurn, m ai.Message) {
+	turn.Messages = append(turn.Messages, m)
+	if c.redactor != nil && m.Role == ai.RoleTool {
+		c.redactor.message(&m, true)
+	}
+	c.request.Messages = append(c.request.Messages, m)
+}
+
+// newAIProvider returns the provider a request asked for, falling back to the
+// configured default for anything it leaves empty. A request may point a
+// provider at another server, but the configured API key is only sent to the
+// configured server so it cannot be collected by an arbitrary URL.
+func newAIProvider(kind, model, baseURL string) (ai.Provider, error) {
+	if kind == "" {
+		kind = aiDefaultProvider
+	}
+	kind = strings.ToLower(kind)
+	settings, ok := aiProviders[kind]
+	if !ok {
+		return nil, fmt.Errorf("Unknown AI provider %q", kind)
+	}
+
+	configuredURL := aiConfiguredURL(kind)
+	baseURL = strings.TrimRight(baseURL, "/")
+	if baseURL == "" {
+		baseURL = configuredURL
+	}
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		return nil, fmt.Errorf("Invalid AI base URL %q", baseURL)
+	}
+
+	cfg := ai.Config{Provider: kind, BaseURL: baseURL, Model: settings.Model}
+	if model != "" {
+		cfg.Model = model
+	}
+	if settings.KeyEnv != "" && baseURL == configuredURL {
+		cfg.APIKey = aiKey(kind)
+	}
+	if kind == ai.Gemini && cfg.APIKey == "" {
+		return nil, errors.New("No Gemini API key is set. Add your Google AI Studio key under API keys in the assistant, or set GEMINI_API_KEY.")
+	}
+	return ai.New(cfg)
+}
+
+// AIChatRequest goes on with the stored conversation Conversation, adding
+// Messages to it. Without a conversation a new one is started with them.
+type AIChatRequest struct {
+	Conversation string       `json:"conversation"`
+	Provider     string       `json:"provider"`
+	Model        string       `json:"model"`
+	BaseURL      string       `json:"baseUrl"`
+	Messages     []ai.Message `json:"messages"`
+	Settings     AISettings   `json:"settings"`
+	// Tools turns the manager's tools on or off for this request; by
+	// default they follow FM_AI_TOOLS.
+	Tools *bool `json:"tools"`
+	// Contents is the Gemini shaped history older clients send.
+	Contents []Content `json:"contents"`
+}
+
+// chatMessages returns the conversation of req, converting Gemini "contents"
+// when that is what was sent.
+func (req *AIChatRequest) chatMessages() []ai.Message {
+	if len(req.Messages) > 0 {
+		return req.Messages
+	}
+	messages := make([]ai.Message, 0, len(req.Contents))
+	for _, c := range req.Contents {
+		var text strings.Builder
+		for _, part := range c.Parts {
+			text.WriteString(part.Text)
+		}
+		role := ai.RoleUser
+		if c.Role == "model" || c.Role == ai.RoleAssistant {
+			role = ai.RoleAssistant
+		}
+		messages = append(messages, ai.Message{Role: role, Text: text.String()})
+	}
+	return messages
+}
+
+// prepareAIChat decodes an assistant request into the call to make.
+func prepareAIChat(r *http.Request) (*aiCall, error) {
+	var req AIChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("Invalid request format: %v", err)
+	}
+	messages := req.chatMessages()
+	if len(messages) == 0 {
+		return nil, errors.New("Invalid request format: the conversation is empty")
+	}
+	conv, err := openAIConversation(auth.Username(r), req.Conversation)
+	if err != nil {
+		return nil, err
+	}
+	// New attachments are read now and kept with the conversation as they
+	// are, so it reads the same when resumed after the files have changed
+	if err := readAIAttachments(messages); err != nil {
+		return nil, err
+	}
+	history := append([]ai.Message(nil), conv.Messages[min(conv.Summarized, len(conv.Messages)):]...)
+	stored := len(history)
+	history = append(history, messages...)
+	if err := attachAIFiles(history); err != nil {
+		return nil, err
+	}
+	// What was masked in earlier turns has been reported already
+	redactor := newAIRedactor()
+	for i := range history {
+		redactor.message(&history[i], i >= stored)
+	}
+	history = answerOpenCalls(history)
+
+	settings, err := resolveAISettings(req.Settings)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid settings: %v", err)
+	}
+
+	provider, err := newAIProvider(req.Provider, req.Model, req.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	tools := aiToolsEnabled
+	if req.Tools != nil {
+		tools = *req.Tools && aiToolsEnabled
+	}
+	call := newAICall(provider, history, settings, tools)
+	call.request.System = aiSystemWithSummary(conv.Summary)
+	call.conversation = conv
+	call.added = messages
+	call.redactor = redactor
+	return call, nil
+}
+
+// handleGeminiAPI answers the assistant chat in one reply. The name stays
+// from when Gemini was the only backend; the provider is now chosen per
+// request or by FM_AI_PROVIDER. Over a token quota it answers 429 Too Many
+// Requests without asking the model.
+func handleGeminiAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	release, ok := aiQuotaReserve(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	call, err := prepareAIChat(r)
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+
+	turn, err := call.run(r, nil)
+	call.recordUsage(r, turn)
+	if err == nil {
+		err = saveAITurn(call, turn)
+	}
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversation": call.conversation.ID,
+		"title":        call.conversation.Title,
+		"redacted":     call.redactor.report(),
+		"response":     turn.reply(),
+		"provider":     call.provider.Name(),
+		"model":        turn.Model,
+		"usage":        turn.Usage,
+		"messages":     turn.Messages,
+		"pending":      turn.Pending,
+	})
+}
+
+// handleAIStream takes the same request as handleGeminiAPI and relays the
+// reply as Server-Sent Events while the model writes it: "delta" events with
+// the next piece of text, "tool" for a read-only tool that was run and
+// "action" for one waiting for approval, then "done" with the conversation
+// id, the messages to add to it, the pending actions, what secrets were
+// masked and token usage, or "error". It is a POST, so browsers read it with
+// fetch rather than EventSource. When the browser goes away the request
+// context ends, which aborts the call to the provider and leaves the
+// conversation unchanged.
+func handleAIStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// A quota is reported with its status code like on /api/gemini. The
+	// body has to be read before the response starts; other errors are
+	// still reported as an event so the client handles a single kind of reply
+	release, ok := aiQuotaReserve(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	call, err := prepareAIChat(r)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// The keep-alive comments and the events come from different goroutines
+	var mu sync.Mutex
+	send := func(event string, v interface{}) error {
+		data, _ := json.Marshal(v)
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	if err != nil {
+		send("error", map[string]string{"error": err.Error()})
+		return
+	}
+
+	// A local model can think for a long time before the first token; keep
+	// proxies from giving up on the connection meanwhile
+	stopKeepAlive := make(chan struct{})
+	defer close(stopKeepAlive)
+	go func() {
+		ticker := time.NewTicker(sseKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mu.Lock()
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+				mu.Unlock()
+			case <-stopKeepAlive:
+				return
+			}
+		}
+	}()
+
+	turn, err := call.run(r, send)
+	call.recordUsage(r, turn)
+	if r.Context().Err() != nil {
+		return
+	}
+	if err == nil {
+		err = saveAITurn(call, turn)
+	}
+	if err != nil {
+		send("error", map[string]string{"error": err.Error()})
+		return
+	}
+	send("done", map[string]interface{}{
+		"conversation": call.conversation.ID,
+		"title":        call.conversation.Title,
+		"redacted":     call.redactor.report(),
+		"provider":     call.provider.Name(),
+		"model":        turn.Model,
+		"usage":        turn.Usage,
+		"messages":     turn.Messages,
+		"pending":      turn.Pending,
+	})
+}
+
+type AIProviderInfo struct {
+	Name    string `json:"name"`
+	Model   string `json:"model"`
+	BaseURL string `json:"baseUrl"`
+	HasKey  bool   `json:"hasKey"`
+}
+
+// handleAIProviders lists the provider kinds with their configured model and
+// server, and the generation defaults, for the assistant's settings.
+func handleAIProviders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	providers := []AIProviderInfo{}
+	for _, kind := range ai.Kinds() {
+		settings := aiProviders[kind]
+		info := AIProviderInfo{Name: kind, Model: settings.Model, BaseURL: settings.BaseURL}
+		if info.Model == "" {
+			info.Model = ai.DefaultModel(kind)
+		}
+		if info.BaseURL == "" {
+			info.BaseURL = ai.DefaultBaseURL(kind)
+		}
+		if settings.KeyEnv != "" {
+			info.HasKey = aiKey(kind) != ""
+		}
+		providers = append(providers, info)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"default":   aiDefaultProvider,
+		"providers": providers,
+		"settings": map[string]interface{}{
+			"temperature": aiTemperature,
+			"maxTokens":   aiMaxTokens,
+			"maxTopK":     maxAITopK,
+			"tools":       aiToolsEnabled,
+		},
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"cf-manager/ai"
+)
+
+const (
+	defaultMaxAIAttachKB = 4096
+
+	// Text files are pasted into the message, so only their start is sent.
+	aiAttachTextLimit = 32 << 10
+
+	// Every request carries the whole conversation, attachments included.
+	maxAIAttachments  = 10
+	maxAIAttachTotal  = 16 << 20
+	aiAttachSniffSize = 512
+)
+
+var maxAIAttachSize int64 = defaultMaxAIAttachKB << 10
+
+// loadAIAttachLimit reads FM_AI_MAX_ATTACH_KB, the largest image or PDF that
+// can be attached to an assistant message.
+func loadAIAttachLimit() error {
+	if v := os.Getenv("FM_AI_MAX_ATTACH_KB"); v != "" {
+		kb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || kb <= 0 {
+			return fmt.Errorf("invalid FM_AI_MAX_ATTACH_KB %q", v)
+		}
+		maxAIAttachSize = kb << 10
+	}
+	return nil
+}
+
+// readAIAttachments reads the files the browser attached to messages by
+// path, so they are stored with the conversation as they are now: text files
+// with their text, images and PDFs with a digest of their data. Paths go
+// through the sandbox like any other file access.
+func readAIAttachments(messages []ai.Message) error {
+	for i := range messages {
+		m := &messages[i]
+		if len(m.Attachments) == 0 {
+			continue
+		}
+		if m.Role != ai.RoleUser {
+			return errors.New("Only user messages can have attachments")
+		}
+		for j, a := range m.Attachments {
+			file, err := readAIAttachment(a.Path)
+			if err != nil {
+				return err
+			}
+			m.Attachments[j] = file
+		}
+	}
+	return nil
+}
+
+// attachAIFiles readies the attachments of messages for the provider. Text
+// files are appended to the message text; images and PDFs are kept as
+// attachments to send inline, read again for stored messages. One that can no
+// longer be read, or whose data has changed since it was attached, is left
+// out and a note says so, rather than the model seeing other content than
+// the conversation had.
+func attachAIFiles(messages []ai.Message) error {
+	count := 0
+	var total int64
+	for i := range messages {
+		m := &messages[i]
+		if len(m.Attachments) == 0 {
+			continue
+		}
+		if m.Role != ai.RoleUser {
+			return errors.New("Only user messages can have attachments")
+		}
+		var inline []ai.Attachment
+		for _, a := range m.Attachments {
+			count++
+			if count > maxAIAttachments {
+				return fmt.Errorf("Too many attachments: a conversation can have at most %d", maxAIAttachments)
+			}
+			if a.Text != "" {
+				total += int64(len(a.Text))
+				m.Text += "\n\n" + a.Text
+			} else if a.Data == nil {
+				file, err := readAIAttachment(a.Path)
+				switch {
+				case err != nil:
+					m.Text += fmt.Sprintf("\n\n(%s was attached here but can no longer be read.)", a.Path)
+					continue
+				case a.Digest == "" || file.Digest != a.Digest:
+					m.Text += fmt.Sprintf("\n\n(%s was attached here but has changed since, so it is left out.)", a.Path)
+					continue
+				}
+				a = file
+			}
+			if a.Data != nil {
+				total += int64(len(a.Data))
+				inline = append(inline, a)
+			}
+			if total > maxAIAttachTotal {
+				return fmt.Errorf("Attachments are too large: a conversation can carry at most %d MB", maxAIAttachTotal>>20)
+			}
+		}
+		m.Attachments = inline
+	}
+	return nil
+}
+
+// readAIAttachment reads the file at p. An image or PDF comes back with its
+// data and its digest; anything else has to be text and comes back with the
+// text formatted for the message, cut short past aiAttachTextLimit.
+func readAIAttachment(p string) (ai.Attachment, error) {
+	var file ai.Attachment
+	path, err := resolvePath(p)
+	if err != nil {
+		return file, fmt.Errorf("Cannot attach %s: access denied: %v", p, err)
+	}
+	name := displayPath(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return file, fmt.Errorf("Cannot attach %s: %v", name, err)
+	}
+	if !info.Mode().IsRegular() {
+		return file, fmt.Errorf("Cannot attach %s: not a regular file", name)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return file, fmt.Errorf("Cannot attach %s: %v", name, err)
+	}
+	defer f.Close()
+
+	head := make([]byte, aiAttachSniffSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return file, fmt.Errorf("Cannot attach %s: %v", name, err)
+	}
+	head = head[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return file, fmt.Errorf("Cannot attach %s: %v", name, err)
+	}
+
+	if mimeType := attachmentType(path, head); ai.InlineType(mimeType) {
+		if info.Size() > maxAIAttachSize {
+			return file, fmt.Errorf("Cannot attach %s: it is %d KB, the limit is %d KB", name, info.Size()>>10, maxAIAttachSize>>10)
+		}
+		data, err := io.ReadAll(io.LimitReader(f, maxAIAttachSize))
+		if err != nil {
+			return file, fmt.Errorf("Cannot attach %s: %v", name, err)
+		}
+		sum := sha256.Sum256(data)
+		return ai.Attachment{Path: p, Name: filepath.Base(path), MIMEType: mimeType, Data: data, Digest: hex.EncodeToString(sum[:])}, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(f, aiAttachTextLimit))
+	if err != nil {
+		return file, fmt.Errorf("Cannot attach %s: %v", name, err)
+	}
+	truncated := int64(len(data)) < info.Size()
+	if !looksLikeText(data, truncated) {
+		return file, fmt.Errorf("Cannot attach %s: only text files, images and PDFs can be attached", name)
+	}
+	// Drop a character cut in half by the limit
+	for len(data) > 0 && !utf8.Valid(data) {
+		data = data[:len(data)-1]
+	}
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "Attached file %s:\n```\n%s", name, data)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		text.WriteByte('\n')
+	}
+	text.WriteString("```")
+	if truncated {
+		fmt.Fprintf(&text, "\n(Only the first %d KB of %d KB are included.)", len(data)>>10, info.Size()>>10)
+	}
+	return ai.Attachment{Path: p, Name: filepath.Base(path), Text: text.String()}, nil
+}
+
+// attachmentType names the MIME type of a file by its extension, or by its
+// first bytes when the extension says nothing useful.
+func attachmentType(path string, head []byte) string {
+	if t, _, err := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(path))); err == nil && ai.InlineType(t) {
+		return t
+	}
+	t, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	return t
+}
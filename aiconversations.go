@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"cf-manager/ai"
+	"cf-manager/auth"
+)
+
+const (
+	defaultAIConversationsDir = "conversations"
+	defaultAIContextTokens    = 16000
+
+	aiTitleLength      = 60
+	maxAITitleLength   = 200
+	aiSummaryMaxTokens = 1024
+
+	// How much of each old message goes into the request for a summary.
+	aiSummaryMessageChars = 2000
+
+	// A rough size for an image or PDF; text counts as four bytes a token.
+	aiAttachmentTokens = 1000
+)
+
+var (
+	aiConversationsDir = defaultAIConversationsDir
+	aiContextTokens    = defaultAIContextTokens
+
+	// aiConversationsMu makes reading and rewriting a conversation file one
+	// step, so two tabs adding to the same conversation both get saved.
+	aiConversationsMu sync.Mutex
+
+	errAIConversationNotFound = errors.New("Conversation not found")
+)
+
+// loadAIConversationSettings reads FM_AI_CONVERSATIONS_DIR, where assistant
+// conversations are kept, and FM_AI_CONTEXT_TOKENS, roughly how much of a
+// conversation is sent to the model before its older turns are summarized.
+func loadAIConversationSettings() error {
+	if v := os.Getenv("FM_AI_CONVERSATIONS_DIR"); v != "" {
+		aiConversationsDir = v
+	}
+	if v := os.Getenv("FM_AI_CONTEXT_TOKENS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= aiMaxTokens {
+			return fmt.Errorf("invalid FM_AI_CONTEXT_TOKENS %q (must be more than the %d max tokens of a reply)", v, aiMaxTokens)
+		}
+		aiContextTokens = n
+	}
+	return os.MkdirAll(aiConversationsDir, 0700)
+}
+
+// AIConversation is a stored assistant conversation. Messages holds all of
+// it; when it is sent to the model, Summary stands in for the first
+// Summarized messages.
+type AIConversation struct {
+	ID         string       `json:"id"`
+	Title      string       `json:"title"`
+	Owner      string       `json:"owner"`
+	Created    time.Time    `json:"created"`
+	Updated    time.Time    `json:"updated"`
+	Provider   string       `json:"provider,omitempty"`
+	Model      string       `json:"model,omitempty"`
+	Summary    string       `json:"summary,omitempty"`
+	Summarized int          `json:"summarized,omitempty"`
+	Messages   []ai.Message `json:"messages"`
+}
+
+// AIConversationInfo is a conversation as listed, without its messages.
+type AIConversationInfo struct {
+	ID       string    `json:"id"`
+	Title    string    `json:"title"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	Messages int       `json:"messages"`
+}
+
+// aiConversationPath returns the file of conversation id. Ids are hex, which
+// keeps them from naming anything outside the directory.
+func aiConversationPath(id string) (string, error) {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return "", errAIConversationNotFound
+	}
+	return filepath.Join(aiConversationsDir, id+".json"), nil
+}
+
+// readAIConversation loads conversation id of owner. Those of other users are
+// reported as not found.
+func readAIConversation(owner, id string) (*AIConversation, error) {
+	path, err := aiConversationPath(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, errAIConversationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c AIConversation
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("Conversation %s is damaged: %v", id, err)
+	}
+	if c.Owner != owner {
+		return nil, errAIConversationNotFound
+	}
+	return &c, nil
+}
+
+// writeAIConversation replaces the file of c through a temporary file, so a
+// crash never leaves half a conversation behind.
+func writeAIConversation(c *AIConversation) error {
+	path, err := aiConversationPath(c.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(aiConversationsDir, "."+c.ID+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// listAIConversations returns the conversations of owner, the most recently
+// updated first.
+func listAIConversations(owner string) ([]AIConversationInfo, error) {
+	entries, err := os.ReadDir(aiConversationsDir)
+	if err != nil {
+		return nil, err
+	}
+	list := []AIConversationInfo{}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || strings.HasPrefix(id, ".") {
+			continue
+		}
+		c, err := readAIConversation(owner, id)
+		if err != nil {
+			continue
+		}
+		list = append(list, AIConversationInfo{
+			ID:       c.ID,
+			Title:    c.Title,
+			Created:  c.Created,
+			Updated:  c.Updated,
+			Messages: len(c.Messages),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Updated.After(list[j].Updated)
+	})
+	return list, nil
+}
+
+// openAIConversation returns conversation id of owner, or a new one when id
+// is empty. A new conversation is only written once its first turn is
+// answered.
+func openAIConversation(owner, id string) (*AIConversation, error) {
+	if id != "" {
+		aiConversationsMu.Lock()
+		defer aiConversationsMu.Unlock()
+		return readAIConversation(owner, id)
+	}
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	return &AIConversation{ID: id, Owner: owner, Created: time.Now()}, nil
+}
+
+// aiConversationTitle names a conversation after its first user message.
+func aiConversationTitle(messages []ai.Message) string {
+	for _, m := range messages {
+		if m.Role != ai.RoleUser {
+			continue
+		}
+		title := strings.Join(strings.Fields(m.Text), " ")
+		if title == "" && len(m.Attachments) > 0 {
+			title = filepath.Base(m.Attachments[0].Path)
+		}
+		if title == "" {
+			continue
+		}
+		if utf8.RuneCountInString(title) > aiTitleLength {
+			title = string([]rune(title)[:aiTitleLength-1]) + "…"
+		}
+		return title
+	}
+	return "New conversation"
+}
+
+// saveAITurn adds the messages the browser sent and the turn answering them
+// to the conversation of c. The file is read again first, as another request
+// may have added to it meanwhile; a conversation deleted meanwhile stays
+// deleted.
+func saveAITurn(c *aiCall, turn *aiTurn) error {
+	conv := c.conversation
+	aiConversationsMu.Lock()
+	defer aiConversationsMu.Unlock()
+
+	stored, err := readAIConversation(conv.Owner, conv.ID)
+	if err == errAIConversationNotFound && conv.Updated.IsZero() {
+		stored = &AIConversation{ID: conv.ID, Owner: conv.Owner, Created: conv.Created}
+	} else if err != nil {
+		return err
+	}
+	stored.Messages = append(stored.Messages, c.added...)
+	stored.Messages = append(stored.Messages, turn.Messages...)
+	if conv.Summarized > stored.Summarized {
+		stored.Summary = conv.Summary
+		stored.Summarized = min(conv.Summarized, len(stored.Messages))
+	}
+	if stored.Title == "" {
+		// A new conversation can come named, or is named after its start
+		stored.Title = conv.Title
+	}
+	if stored.Title == "" {
+		stored.Title = aiConversationTitle(stored.Messages)
+	}
+	stored.Provider = c.provider.Name()
+	stored.Model = turn.Model
+	stored.Updated = time.Now()
+	if err := writeAIConversation(stored); err != nil {
+		return err
+	}
+	*conv = *stored
+	return nil
+}
+
+// answerOpenCalls returns messages with a result added for every tool call
+// that never got one, which happens when the user moves on without deciding
+// on a proposed action. Providers refuse a conversation with open calls.
+func answerOpenCalls(messages []ai.Message) []ai.Message {
+	answered := map[string]bool{}
+	for _, m := range messages {
+		if m.Role == ai.RoleTool {
+			answered[m.ToolCallID] = true
+		}
+	}
+	out := make([]ai.Message, 0, len(messages))
+	for i := 0; i < len(messages); {
+		m := messages[i]
+		out = append(out, m)
+		i++
+		if m.Role != ai.RoleAssistant || len(m.ToolCalls) == 0 {
+			continue
+		}
+		// The missing results go after those that follow the calls
+		for i < len(messages) && messages[i].Role == ai.RoleTool {
+			out = append(out, messages[i])
+			i++
+		}
+		for _, call := range m.ToolCalls {
+			if !answered[call.ID] {
+				out = append(out, ai.Message{
+					Role:       ai.RoleTool,
+					ToolCallID: call.ID,
+					Name:       call.Name,
+					Text:       "Not run: the user did not decide on this action.",
+				})
+			}
+		}
+	}
+	return out
+}
+
+// estimateAITokens guesses the size of messages without the model's
+// tokenizer.
+func estimateAITokens(messages []ai.Message) int {
+	n := 0
+	for _, m := range messages {
+		n += len(m.Text)/4 + 4
+		for _, call := range m.ToolCalls {
+			n += (len(call.Name) + len(call.Args)) / 4
+		}
+		n += len(m.Attachments) * aiAttachmentTokens
+	}
+	return n
+}
+
+// aiSystemWithSummary is the system prompt of a conversation whose older
+// turns have been summarized.
+func aiSystemWithSummary(summary string) string {
+	if summary == "" {
+		return aiSystemPrompt
+	}
+	return aiSystemPrompt + "\n\nThe earlier part of this conversation was summarized to save space:\n" + summary
+}
+
+// fitContext keeps the conversation within aiContextTokens, less room for
+// the reply. Past that the oldest messages are summarized, keeping the newest
+// turns that fit in half of it word for word, starting at a user message. If
+// the model cannot write the summary they are left out all the same.
+func (c *aiCall) fitContext(ctx context.Context) {
+	msgs := c.request.Messages
+	budget := aiContextTokens - c.request.MaxTokens - len(c.request.System)/4
+	if estimateAITokens(msgs) <= budget {
+		return
+	}
+
+	cut, used := 0, 0
+	for i := len(msgs) - 1; i > 0; i-- {
+		used += estimateAITokens(msgs[i : i+1])
+		if cut > 0 && used > budget/2 {
+			break
+		}
+		if msgs[i].Role == ai.RoleUser {
+			cut = i
+		}
+	}
+	if cut == 0 {
+		return
+	}
+
+	conv := c.conversation
+	summary, usage, err := c.summarize(ctx, msgs[:cut])
+	c.overhead = usage
+	if err != nil {
+		log.Printf("Summarizing conversation %s failed, leaving out %d messages: %v", conv.ID, cut, err)
+	} else {
+		conv.Summary = summary
+	}
+	// The results made up for open calls are not stored, so the cut is
+	// counted in user messages, which always are
+	users := 0
+	for _, m := range msgs[:cut] {
+		if m.Role == ai.RoleUser {
+			users++
+		}
+	}
+	all := append(conv.Messages[:len(conv.Messages):len(conv.Messages)], c.added...)
+	conv.Summarized = skipUserMessages(all, conv.Summarized, users)
+	c.request.Messages = msgs[cut:]
+	c.request.System = aiSystemWithSummary(conv.Summary)
+}
+
+// skipUserMessages returns the index of the user message that has n more
+// before it in messages from index from on.
+func skipUserMessages(messages []ai.Message, from, n int) int {
+	for i := from; i < len(messages); i++ {
+		if messages[i].Role != ai.RoleUser {
+			continue
+		}
+		if n == 0 {
+			return i
+		}
+		n--
+	}
+	return len(messages)
+}
+
+// summarize asks the model for a summary of messages that carries on from
+// the summary so far.
+func (c *aiCall) summarize(ctx context.Context, messages []ai.Message) (string, ai.Usage, error) {
+	var transcript strings.Builder
+	if c.conversation.Summary != "" {
+		fmt.Fprintf(&transcript, "Summary of what came before:\n%s\n\n", c.conversation.Summary)
+	}
+	clip := func(s string) string {
+		if len(s) <= aiSummaryMessageChars {
+			return s
+		}
+		return strings.ToValidUTF8(s[:aiSummaryMessageChars], "") + " [...]"
+	}
+	for _, m := range messages {
+		switch m.Role {
+		case ai.RoleUser:
+			fmt.Fprintf(&transcript, "User: %s\n\n", clip(m.Text))
+		case ai.RoleAssistant:
+			if m.Text != "" {
+				fmt.Fprintf(&transcript, "Assistant: %s\n\n", clip(m.Text))
+			}
+			for _, call := range m.ToolCalls {
+				fmt.Fprintf(&transcript, "Assistant called %s %s\n\n", call.Name, compactArgs(call.Args))
+			}
+		case ai.RoleTool:
+			fmt.Fprintf(&transcript, "Result of %s: %s\n\n", m.Name, clip(m.Text))
+		}
+	}
+
+	resp, err := c.provider.Chat(ctx, &ai.Request{
+		System: "You summarize conversations between a user and the assistant of a file manager for Cloudflare tunnels. " +
+			"Write a short summary that keeps the facts, decisions, file, tunnel and host names and open questions needed to carry on the conversation.",
+		Messages:  []ai.Message{{Role: ai.RoleUser, Text: transcript.String()}},
+		MaxTokens: aiSummaryMaxTokens,
+	})
+	if err != nil {
+		return "", ai.Usage{}, err
+	}
+	return strings.TrimSpace(resp.Text), resp.Usage, nil
+}
+
+// compactArgs puts call arguments, which come back from the file indented,
+// on one line.
+func compactArgs(args json.RawMessage) string {
+	var buf bytes.Buffer
+	if json.Compact(&buf, args) != nil {
+		return string(args)
+	}
+	return buf.String()
+}
+
+// aiConversationMarkdown renders c for reading. Everything is included, also
+// the messages the model now only sees as a summary.
+func aiConversationMarkdown(c *AIConversation) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", c.Title)
+	fmt.Fprintf(&b, "_Started %s, last updated %s", c.Created.Format("2006-01-02 15:04"), c.Updated.Format("2006-01-02 15:04"))
+	if c.Model != "" {
+		fmt.Fprintf(&b, ", %s (%s)", c.Model, c.Provider)
+	}
+	b.WriteString("_\n\n")
+	for _, m := range c.Messages {
+		switch m.Role {
+		case ai.RoleUser:
+			fmt.Fprintf(&b, "## User\n\n%s\n\n", m.Text)
+			for _, a := range m.Attachments {
+				fmt.Fprintf(&b, "- Attached `%s`\n", a.Path)
+			}
+			if len(m.Attachments) > 0 {
+				b.WriteString("\n")
+			}
+		case ai.RoleAssistant:
+			b.WriteString("## Assistant\n\n")
+			if m.Text != "" {
+				fmt.Fprintf(&b, "%s\n\n", m.Text)
+			}
+			for _, call := range m.ToolCalls {
+				fmt.Fprintf(&b, "- Called `%s` with `%s`\n", call.Name, compactArgs(call.Args))
+			}
+			if len(m.ToolCalls) > 0 {
+				b.WriteString("\n")
+			}
+		case ai.RoleTool:
+			fmt.Fprintf(&b, "### Result of %s\n\n~~~\n%s\n~~~\n\n", m.Name, m.Text)
+		}
+	}
+	return b.String()
+}
+
+// handleListAIConversations lists the caller's conversations.
+func handleListAIConversations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list, err := listAIConversations(auth.Username(r))
+	if err != nil {
+		writeFileError(w, "Failed to list conversations: "+err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"conversations": list})
+}
+
+// handleGetAIConversation returns a conversation with all its messages, for
+// the browser to resume it.
+func handleGetAIConversation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c, err := readAIConversation(auth.Username(r), r.URL.Query().Get("id"))
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(c)
+}
+
+type AIConversationRequest struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+func handleRenameAIConversation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AIConversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFileError(w, "Invalid request format: "+err.Error())
+		return
+	}
+	title := strings.Join(strings.Fields(req.Title), " ")
+	if title == "" {
+		writeFileError(w, "A title is required")
+		return
+	}
+	if utf8.RuneCountInString(title) > maxAITitleLength {
+		writeFileError(w, fmt.Sprintf("The title is too long (at most %d characters)", maxAITitleLength))
+		return
+	}
+
+	aiConversationsMu.Lock()
+	defer aiConversationsMu.Unlock()
+	c, err := readAIConversation(auth.Username(r), req.ID)
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+	c.Title = title
+	if err := writeAIConversation(c); err != nil {
+		writeFileError(w, "Failed to rename the conversation: "+err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "title": title})
+}
+
+func handleDeleteAIConversation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AIConversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFileError(w, "Invalid request format: "+err.Error())
+		return
+	}
+
+	aiConversationsMu.Lock()
+	defer aiConversationsMu.Unlock()
+	c, err := readAIConversation(auth.Username(r), req.ID)
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+	path, _ := aiConversationPath(c.ID)
+	if err := os.Remove(path); err != nil {
+		writeFileError(w, "Failed to delete the conversation: "+err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// handleExportAIConversation downloads a conversation as Markdown, or with
+// format=json as it is stored.
+func handleExportAIConversation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c, err := readAIConversation(auth.Username(r), r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var data []byte
+	name := "conversation-" + c.ID
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "markdown", "md":
+		data = []byte(aiConversationMarkdown(c))
+		name += ".md"
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	case "json":
+		data, _ = json.MarshalIndent(c, "", "  ")
+		name += ".json"
+		w.Header().Set("Content-Type", "application/json")
+	default:
+		http.Error(w, fmt.Sprintf("Unknown export format %q (expected markdown or json)", format), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Write(data)
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"cf-manager/ai"
+	"cf-manager/auth"
+	"cf-manager/dns"
+	"cf-manager/tunnels"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Lines of cloudflared output sent with a diagnosis.
+	diagnoseLogLines = 100
+
+	originDialTimeout = 3 * time.Second
+)
+
+// The model is asked for JSON so the reply can be shown as fields and its fix
+// offered as a button rather than prose to act on by hand.
+const tunnelDiagnosisPrompt = `You diagnose Cloudflare tunnels run by cloudflared on this server. You get the tunnel's state, its config, its recent cloudflared output, whether its origin services accept connections and the DNS records of its hostnames. Secrets have been replaced by [REDACTED:...] marks.
+
+Reply with one JSON object and nothing else:
+{
+  "healthy": true if nothing is wrong,
+  "summary": "one sentence saying what is wrong",
+  "cause": "the most likely root cause, citing the evidence",
+  "explanation": "what happens and why, in a few short paragraphs of Markdown",
+  "steps": ["manual steps to fix it, if the fix below does not cover it"],
+  "fix": {"tool": "tool name", "args": {...}, "reason": "what this changes"} or null
+}
+
+The fix, if any, is one call to one of these tools, run only if the user clicks to apply it:
+%s
+Only propose a fix that addresses the cause. For this tunnel use the name %q.`
+
+// TunnelOriginCheck says whether an origin service of a tunnel accepts
+// connections.
+type TunnelOriginCheck struct {
+	Hostname  string `json:"hostname"`
+	Service   string `json:"service"`
+	Address   string `json:"address,omitempty"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// TunnelDNSCheck compares the records of a tunnel hostname with the proxied
+// CNAME to the tunnel it should have.
+type TunnelDNSCheck struct {
+	Hostname string          `json:"hostname"`
+	Expected string          `json:"expected"`
+	Records  []dns.DNSRecord `json:"records"`
+	OK       bool            `json:"ok"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// TunnelChecks is what is collected about a tunnel for a diagnosis.
+type TunnelChecks struct {
+	Tunnel  *tunnels.Tunnel     `json:"tunnel"`
+	Origins []TunnelOriginCheck `json:"origins"`
+	DNS     []TunnelDNSCheck    `json:"dns"`
+	config  string
+	logs    string
+}
+
+// tunnelIngress is the part of a cloudflared config the checks look at.
+type tunnelIngress struct {
+	Tunnel  string `yaml:"tunnel"`
+	Ingress []struct {
+		Hostname string `yaml:"hostname"`
+		Service  string `yaml:"service"`
+	} `yaml:"ingress"`
+}
+
+// collectTunnelChecks gathers the config, state, recent output, origin
+// reachability and DNS records of tunnel name.
+func collectTunnelChecks(name string) (*TunnelChecks, error) {
+	config, err := tunnels.GetTunnelConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	checks := &TunnelChecks{config: config, Origins: []TunnelOriginCheck{}, DNS: []TunnelDNSCheck{}}
+	if checks.Tunnel, err = tunnels.GetTunnelStatus(name); err != nil {
+		return nil, err
+	}
+	if checks.logs, err = tunnels.GetTunnelLogs(name, diagnoseLogLines); err != nil {
+		checks.logs = "Could not read the log: " + err.Error()
+	} else if checks.logs == "" {
+		checks.logs = "No output has been logged for this tunnel yet."
+	}
+
+	var parsed tunnelIngress
+	if err := yaml.Unmarshal([]byte(config), &parsed); err != nil {
+		// The model still gets the config and can point out the mistake
+		return checks, nil
+	}
+	tunnelID := strings.Trim(parsed.Tunnel, `"`)
+	if tunnelID == "" {
+		tunnelID = checks.Tunnel.ID
+	}
+
+	var records []dns.DNSRecord
+	var dnsErr error
+	for _, rule := range parsed.Ingress {
+		if rule.Hostname == "" {
+			continue
+		}
+		checks.Origins = append(checks.Origins, checkTunnelOrigin(rule.Hostname, rule.Service))
+
+		if records == nil && dnsErr == nil {
+			if records, dnsErr = dns.ListDNSRecords(); dnsErr == nil && records == nil {
+				records = []dns.DNSRecord{}
+			}
+		}
+		checks.DNS = append(checks.DNS, checkTunnelDNS(rule.Hostname, tunnelID, records, dnsErr))
+	}
+	return checks, nil
+}
+
+func checkTunnelOrigin(hostname, service string) TunnelOriginCheck {
+	check := TunnelOriginCheck{Hostname: hostname, Service: service}
+	address, err := originAddress(service)
+	if err != nil {
+		// http_status:404 and the like answer without an origin
+		check.Error = err.Error()
+		return check
+	}
+	check.Address = address
+	conn, err := net.DialTimeout("tcp", address, originDialTimeout)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	conn.Close()
+	check.Reachable = true
+	return check
+}
+
+func checkTunnelDNS(hostname, tunnelID string, records []dns.DNSRecord, err error) TunnelDNSCheck {
+	check := TunnelDNSCheck{Hostname: hostname, Expected: "CNAME " + tunnelID + ".cfargotunnel.com (proxied)", Records: []dns.DNSRecord{}}
+	if err != nil {
+		check.Error = "Could not list DNS records: " + err.Error()
+		return check
+	}
+	for _, record := range records {
+		if !strings.EqualFold(record.Name, hostname) {
+			continue
+		}
+		check.Records = append(check.Records, record)
+		if record.Type == "CNAME" && strings.EqualFold(record.Content, tunnelID+".cfargotunnel.com") && record.Proxied {
+			check.OK = true
+		}
+	}
+	return check
+}
+
+// report lays the checks out for the model.
+func (c *TunnelChecks) report() string {
+	status, _ := json.MarshalIndent(c.Tunnel, "", "  ")
+	origins, _ := json.MarshalIndent(c.Origins, "", "  ")
+	records, _ := json.MarshalIndent(c.DNS, "", "  ")
+	return fmt.Sprintf("Diagnose tunnel %s.\n\nState:\n```json\n%s\n```\n\nConfig (%s-config.yml):\n```yaml\n%s\n```\n\nLast %d lines of cloudflared output:\n```\n%s\n```\n\nOrigin services:\n```json\n%s\n```\n\nDNS records of its hostnames:\n```json\n%s\n```",
+		c.Tunnel.Name, status, c.Tunnel.Name, strings.TrimRight(c.config, "\n"), diagnoseLogLines, c.logs, origins, records)
+}
+
+// diagnosisFixTools describes the tools a diagnosis can propose as its fix:
+// those that change something, which the user has to approve anyway.
+func diagnosisFixTools() string {
+	var b strings.Builder
+	for _, tool := range aiTools {
+		if tool.readOnly {
+			continue
+		}
+		params, _ := json.Marshal(tool.Parameters)
+		fmt.Fprintf(&b, "- %s: %s Arguments: %s\n", tool.Name, tool.Description, params)
+	}
+	return b.String()
+}
+
+// TunnelDiagnosis is the model's explanation of what is wrong with a tunnel.
+// Fix is a pending action the user can approve like those proposed in the
+// chat.
+type TunnelDiagnosis struct {
+	Healthy     bool      `json:"healthy"`
+	Summary     string    `json:"summary"`
+	Cause       string    `json:"cause"`
+	Explanation string    `json:"explanation"`
+	Steps       []string  `json:"steps"`
+	Fix         *AIAction `json:"fix,omitempty"`
+	FixReason   string    `json:"fixReason,omitempty"`
+}
+
+type diagnosisReply struct {
+	Healthy     bool     `json:"healthy"`
+	Summary     string   `json:"summary"`
+	Cause       string   `json:"cause"`
+	Explanation string   `json:"explanation"`
+	Steps       []string `json:"steps"`
+	Fix         *struct {
+		Tool   string          `json:"tool"`
+		Args   json.RawMessage `json:"args"`
+		Reason string          `json:"reason"`
+	} `json:"fix"`
+}
+
+// parseDiagnosis reads the model's reply. Models wrap JSON in code fences or
+// a sentence now and then, so the outermost braces are taken; a reply
+// without them is shown as the explanation.
+func parseDiagnosis(text string) (*diagnosisReply, error) {
+	start, end := strings.Index(text, "{"), strings.LastIndex(text, "}")
+	if start < 0 || end < start {
+		return &diagnosisReply{Explanation: text}, nil
+	}
+	var reply diagnosisReply
+	if err := json.Unmarshal([]byte(text[start:end+1]), &reply); err != nil {
+		return &diagnosisReply{Explanation: text}, nil
+	}
+	if reply.Summary == "" && reply.Explanation == "" {
+		return nil, errors.New("the model's diagnosis is empty")
+	}
+	return &reply, nil
+}
+
+// diagnosisFix turns the fix the model proposed into a pending action of
+// owner. A fix that is not a known changing tool, is for another tunnel or
+// touches DNS records other than those of the tunnel's hostnames is dropped
+// with the reason.
+func diagnosisFix(owner string, checks *TunnelChecks, reply *diagnosisReply) (*AIAction, error) {
+	tunnel := checks.Tunnel.Name
+	fix := reply.Fix
+	if fix == nil || fix.Tool == "" {
+		return nil, nil
+	}
+	tool := aiToolByName(fix.Tool)
+	if tool == nil || tool.readOnly {
+		return nil, fmt.Errorf("the proposed fix uses %q, which is not a tool that can be applied", fix.Tool)
+	}
+	var args toolArgs
+	if err := json.Unmarshal(fix.Args, &args); err != nil {
+		return nil, fmt.Errorf("the proposed fix has invalid arguments: %v", err)
+	}
+	if name, ok := args["name"]; ok && name != tunnel {
+		return nil, fmt.Errorf("the proposed fix is for tunnel %v, not %s", name, tunnel)
+	}
+	switch fix.Tool {
+	case "create_dns_record":
+		if name := dns.FullName(args.str("subdomain")); !checks.hasHostname(name) {
+			return nil, fmt.Errorf("the proposed fix creates a record for %s, which is not a hostname of %s", name, tunnel)
+		}
+	case "update_dns_record":
+		if !checks.hasRecord(args.str("id")) {
+			return nil, fmt.Errorf("the proposed fix changes a DNS record that does not belong to a hostname of %s", tunnel)
+		}
+	}
+	return proposeAIAction(owner, ai.ToolCall{ID: "diagnose-" + tunnel, Name: fix.Tool, Args: fix.Args}, tool)
+}
+
+// hasHostname reports whether hostname is in the tunnel's ingress rules.
+func (c *TunnelChecks) hasHostname(hostname string) bool {
+	for _, check := range c.DNS {
+		if strings.EqualFold(check.Hostname, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRecord reports whether id is one of the DNS records found for the
+// tunnel's hostnames.
+func (c *TunnelChecks) hasRecord(id string) bool {
+	for _, check := range c.DNS {
+		for _, record := range check.Records {
+			if id != "" && record.ID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type TunnelDiagnoseRequest struct {
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+}
+
+// handleDiagnoseTunnel collects what is known about a tunnel, has the model
+// explain what is wrong, and returns the explanation with a fix to approve.
+// The exchange is kept as a conversation so the user can ask on in the chat.
+// Secrets are masked in what is sent, and the usage counts against the
+// quotas like a chat message.
+func handleDiagnoseTunnel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TunnelDiagnoseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFileError(w, "Invalid request format: "+err.Error())
+		return
+	}
+	if !tunnelNamePattern.MatchString(req.Name) {
+		writeFileError(w, fmt.Sprintf("Invalid tunnel name %q", req.Name))
+		return
+	}
+	release, ok := aiQuotaReserve(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	checks, err := collectTunnelChecks(req.Name)
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+	provider, err := newAIProvider(req.Provider, req.Model, "")
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+	settings, err := resolveAISettings(AISettings{})
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+	owner := auth.Username(r)
+	conv, err := openAIConversation(owner, "")
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+	conv.Title = "Diagnose tunnel " + req.Name
+
+	message := ai.Message{Role: ai.RoleUser, Text: checks.report()}
+	sent := message
+	redactor := newAIRedactor()
+	redactor.message(&sent, true)
+
+	call := newAICall(provider, []ai.Message{sent}, settings, false)
+	call.request.System = fmt.Sprintf(tunnelDiagnosisPrompt, diagnosisFixTools(), req.Name)
+	call.conversation = conv
+	call.added = []ai.Message{message}
+	call.redactor = redactor
+
+	turn, err := call.run(r, nil)
+	call.recordUsage(r, turn)
+	if err == nil {
+		err = saveAITurn(call, turn)
+	}
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+
+	reply, err := parseDiagnosis(turn.reply())
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+	diagnosis := TunnelDiagnosis{
+		Healthy:     reply.Healthy,
+		Summary:     reply.Summary,
+		Cause:       reply.Cause,
+		Explanation: reply.Explanation,
+		Steps:       reply.Steps,
+	}
+	if diagnosis.Steps == nil {
+		diagnosis.Steps = []string{}
+	}
+	if reply.Fix != nil {
+		diagnosis.FixReason = reply.Fix.Reason
+	}
+	if diagnosis.Fix, err = diagnosisFix(owner, checks, reply); err != nil {
+		diagnosis.FixReason = "No fix offered: " + err.Error()
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tunnel":       req.Name,
+		"diagnosis":    diagnosis,
+		"checks":       checks,
+		"conversation": call.conversation.ID,
+		"redacted":     redactor.report(),
+		"provider":     provider.Name(),
+		"model":        turn.Model,
+		"usage":        turn.Usage,
+	})
+}
+
+// handleListTunnels lists the tunnels that can be diagnosed.
+func handleListTunnels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list, err := tunnels.ListTunnels()
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+	if list == nil {
+		list = []*tunnels.Tunnel{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"tunnels": list})
+}
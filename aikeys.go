@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cf-manager/ai"
+	"cf-manager/audit"
+	"cf-manager/secrets"
+)
+
+// How long checking a key with the provider may take.
+const aiKeyCheckTimeout = 15 * time.Second
+
+// aiKey returns the API key of a provider kind from the secret store, or
+// from the environment when it is not stored.
+func aiKey(kind string) string {
+	name := aiKeyEnv[kind]
+	if name == "" {
+		return ""
+	}
+	return secrets.Get(name)
+}
+
+// aiConfiguredURL is the server a kind talks to unless a request names
+// another, and the only one its key is sent to.
+func aiConfiguredURL(kind string) string {
+	if settings := aiProviders[kind]; settings != nil && settings.BaseURL != "" {
+		return settings.BaseURL
+	}
+	return ai.DefaultBaseURL(kind)
+}
+
+// checkAIKey asks the configured server of kind whether it accepts key.
+func checkAIKey(ctx context.Context, kind, key string) error {
+	provider, err := ai.New(ai.Config{Provider: kind, BaseURL: aiConfiguredURL(kind), APIKey: key})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, aiKeyCheckTimeout)
+	defer cancel()
+	return provider.Check(ctx)
+}
+
+// AIKeyInfo describes the key of one provider without giving it away.
+// Source is "store", "environment" or empty when there is none.
+type AIKeyInfo struct {
+	Provider  string     `json:"provider"`
+	Name      string     `json:"name"`
+	Source    string     `json:"source"`
+	Masked    string     `json:"masked,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+}
+
+func aiKeyInfo(kind string) AIKeyInfo {
+	info := AIKeyInfo{Provider: kind, Name: aiKeyEnv[kind]}
+	if secrets.Has(info.Name) {
+		info.Source = "store"
+		for _, s := range secrets.List() {
+			if s.Name == info.Name {
+				info.Masked = s.Masked
+				updated := s.UpdatedAt
+				info.UpdatedAt = &updated
+			}
+		}
+	} else if v := os.Getenv(info.Name); v != "" {
+		info.Source = "environment"
+		info.Masked = secrets.Mask(v)
+	}
+	return info
+}
+
+type AIKeyRequest struct {
+	Provider string `json:"provider"`
+	Key      string `json:"key"`
+	// SkipCheck stores the key without asking the provider first, for a
+	// server that is down at the moment.
+	SkipCheck bool `json:"skipCheck"`
+}
+
+// decodeAIKeyRequest reads a key request and checks it names a provider.
+func decodeAIKeyRequest(r *http.Request) (*AIKeyRequest, error) {
+	var req AIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("Invalid request format: %v", err)
+	}
+	req.Provider = strings.ToLower(req.Provider)
+	if aiKeyEnv[req.Provider] == "" {
+		return nil, fmt.Errorf("Unknown AI provider %q", req.Provider)
+	}
+	return &req, nil
+}
+
+// handleListAIKeys shows, masked, which providers have keys and where they
+// come from.
+func handleListAIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keys := []AIKeyInfo{}
+	for _, kind := range ai.Kinds() {
+		keys = append(keys, aiKeyInfo(kind))
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+// handleSetAIKey stores a provider's key in the encrypted secret store once
+// the provider has accepted it. A stored key takes precedence over the
+// environment.
+func handleSetAIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := decodeAIKeyRequest(r)
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+	key := strings.TrimSpace(req.Key)
+	if key == "" {
+		writeFileError(w, "A key is required")
+		return
+	}
+	if !req.SkipCheck {
+		if err := checkAIKey(r.Context(), req.Provider, key); err != nil {
+			writeFileError(w, "The key was not accepted: "+err.Error())
+			return
+		}
+	}
+
+	name := aiKeyEnv[req.Provider]
+	before := "unset"
+	if secrets.Has(name) {
+		before = "set"
+	}
+	err = secrets.Set(name, key)
+	audit.Record(r, "secret.rotate", name, before, "set", err)
+	if err != nil {
+		writeFileError(w, "Failed to store the key: "+err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "key": aiKeyInfo(req.Provider)})
+}
+
+// handleTestAIKey checks the key a provider has now.
+func handleTestAIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := decodeAIKeyRequest(r)
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+	key := aiKey(req.Provider)
+	if key == "" {
+		writeFileError(w, "No key is set for "+req.Provider)
+		return
+	}
+	if err := checkAIKey(r.Context(), req.Provider, key); err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// handleDeleteAIKey removes a stored key. One from the environment has to be
+// removed where it is set.
+func handleDeleteAIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := decodeAIKeyRequest(r)
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+	name := aiKeyEnv[req.Provider]
+	if !secrets.Has(name) {
+		if os.Getenv(name) != "" {
+			err = fmt.Errorf("%s comes from the environment; remove it from .env or the service settings", name)
+		} else {
+			err = errors.New("No key is stored for " + req.Provider)
+		}
+		writeFileError(w, err.Error())
+		return
+	}
+	err = secrets.Delete(name)
+	audit.Record(r, "secret.delete", name, "set", "unset", err)
+	if err != nil {
+		writeFileError(w, "Failed to delete the key: "+err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "key": aiKeyInfo(req.Provider)})
+}
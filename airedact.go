@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cf-manager/ai"
+	"cf-manager/secrets"
+	"cf-manager/tunnels"
+)
+
+// Stored values shorter than this are not looked for, so a short password
+// does not mask every occurrence of a common word.
+const minKnownSecretLen = 8
+
+// redactRule masks text that looks like a secret wherever it comes from.
+// Only submatch group is replaced, or the whole match when group is 0.
+type redactRule struct {
+	name    string
+	pattern *regexp.Regexp
+	group   int
+}
+
+// redactRules run in order, the specific ones first so they name what they
+// found before the generic ones get to it.
+var redactRules = []redactRule{
+	{"private-key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`), 0},
+	{"bcrypt-hash", regexp.MustCompile(`\$2[abxy]?\$\d{2}\$[./A-Za-z0-9]{53}`), 0},
+	{"tunnel-secret", regexp.MustCompile(`"TunnelSecret"\s*:\s*"([^"]+)"`), 1},
+	{"tunnel-token", regexp.MustCompile(`\beyJhIjoi[A-Za-z0-9+/=_-]{40,}`), 0},
+	{"jwt", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`), 0},
+	{"aws-access-key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), 0},
+	{"github-token", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})`), 0},
+	{"google-api-key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}`), 0},
+	{"openai-api-key", regexp.MustCompile(`\bsk-(?:proj-|ant-)?[A-Za-z0-9_-]{20,}`), 0},
+	{"slack-token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`), 0},
+	{"bearer-token", regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9._~+/=-]{16,})`), 1},
+	{"url-password", regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.-]*://[^\s/:@]+:([^\s/@]+)@`), 1},
+	{"secret-assignment", regexp.MustCompile(`(?i)[a-z0-9_.-]*(?:secret|token|passw(?:or)?d|api[_-]?key|access[_-]?key|private[_-]?key)[a-z0-9_.-]*["']?\s*[:=]\s*["']?([^\s"',;]{8,})`), 1},
+}
+
+// aiRedactAllow holds rule names, secret names and exact values that are
+// never masked.
+var aiRedactAllow = map[string]bool{}
+
+// loadAIRedaction reads FM_AI_REDACT_ALLOW, a comma separated allowlist for
+// the masking of secrets in what is sent to the model. An entry is a rule
+// name such as "jwt" or "secret-assignment" to turn that rule off, the name
+// of a stored secret, or a value that is fine to send as it is.
+func loadAIRedaction() error {
+	for _, entry := range strings.Split(os.Getenv("FM_AI_REDACT_ALLOW"), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			aiRedactAllow[entry] = true
+		}
+	}
+	return nil
+}
+
+// Redaction says how often one kind of secret was masked.
+type Redaction struct {
+	Kind  string `json:"kind"`
+	Count int    `json:"count"`
+}
+
+type knownSecret struct {
+	name, value string
+}
+
+// aiRedactor masks secrets in what one request sends to the model. The
+// known values are gathered when it is made, so a rotated token is caught.
+type aiRedactor struct {
+	known  []knownSecret
+	counts map[string]int
+}
+
+func newAIRedactor() *aiRedactor {
+	r := &aiRedactor{counts: map[string]int{}}
+	seen := map[string]bool{}
+	add := func(name, value string) {
+		if len(value) < minKnownSecretLen || seen[value] || aiRedactAllow[name] || aiRedactAllow[value] {
+			return
+		}
+		seen[value] = true
+		r.known = append(r.known, knownSecret{name, value})
+	}
+
+	for _, info := range secrets.List() {
+		add(info.Name, secrets.Get(info.Name))
+	}
+	// Get falls back to the environment for these
+	add(secrets.CloudflareAPIToken, secrets.Get(secrets.CloudflareAPIToken))
+	add(secrets.GeminiAPIKey, secrets.Get(secrets.GeminiAPIKey))
+	for _, env := range aiKeyEnv {
+		add(env, os.Getenv(env))
+	}
+	for _, s := range tunnels.TunnelSecrets() {
+		add("TunnelSecret", s)
+	}
+
+	// A value inside another must not be replaced first
+	sort.Slice(r.known, func(i, j int) bool {
+		return len(r.known[i].value) > len(r.known[j].value)
+	})
+	return r
+}
+
+func redactionMark(kind string) string {
+	return "[REDACTED:" + kind + "]"
+}
+
+// text returns s with its secrets masked. They are counted when count is
+// set, for telling the user.
+func (r *aiRedactor) text(s string, count bool) string {
+	for _, k := range r.known {
+		if n := strings.Count(s, k.value); n > 0 {
+			s = strings.ReplaceAll(s, k.value, redactionMark(k.name))
+			if count {
+				r.counts[k.name] += n
+			}
+		}
+	}
+
+	for _, rule := range redactRules {
+		if aiRedactAllow[rule.name] {
+			continue
+		}
+		matches := rule.pattern.FindAllStringSubmatchIndex(s, -1)
+		if matches == nil {
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			start, end := m[2*rule.group], m[2*rule.group+1]
+			value := s[start:end]
+			if strings.HasPrefix(value, "[REDACTED:") || aiRedactAllow[value] {
+				continue
+			}
+			b.WriteString(s[last:start])
+			b.WriteString(redactionMark(rule.name))
+			last = end
+			if count {
+				r.counts[rule.name]++
+			}
+		}
+		b.WriteString(s[last:])
+		s = b.String()
+	}
+	return s
+}
+
+// message masks the text of m, and of its tool call arguments, in place.
+func (r *aiRedactor) message(m *ai.Message, count bool) {
+	m.Text = r.text(m.Text, count)
+	if len(m.ToolCalls) == 0 {
+		return
+	}
+	calls := make([]ai.ToolCall, len(m.ToolCalls))
+	for i, call := range m.ToolCalls {
+		call.Args = []byte(r.text(string(call.Args), count))
+		calls[i] = call
+	}
+	m.ToolCalls = calls
+}
+
+// report lists what was counted, the most frequent first.
+func (r *aiRedactor) report() []Redaction {
+	list := []Redaction{}
+	for kind, n := range r.counts {
+		list = append(list, Redaction{kind, n})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Kind < list[j].Kind
+	})
+	return list
+}
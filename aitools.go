@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-manager/ai"
+	"cf-manager/audit"
+	"cf-manager/auth"
+	"cf-manager/dns"
+	"cf-manager/tunnels"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultTunnelLogLines = 50
+	maxTunnelLogLines     = 200
+
+	// How long a proposed action waits for someone to approve it.
+	aiActionTTL = 30 * time.Minute
+)
+
+var tunnelNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// aiTool is one of the manager's operations offered to the model. Read-only
+// tools run as soon as the model calls them; the others only run once a
+// person approves them in the chat.
+type aiTool struct {
+	ai.Tool
+	readOnly bool
+	run      func(r *http.Request, args toolArgs) (string, error)
+	// summary says in a line what a call would do, for the approval prompt.
+	summary func(args toolArgs) string
+}
+
+// toolArgs are the arguments of a call. Models are loose with types, so the
+// accessors accept numbers and booleans sent as strings.
+type toolArgs map[string]interface{}
+
+func (a toolArgs) str(name string) string {
+	switch v := a[name].(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func (a toolArgs) int(name string, def int) int {
+	switch v := a[name].(type) {
+	case float64:
+		return int(v)
+	case string:
+		var n int
+		if _, err := fmt.Sscan(v, &n); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func (a toolArgs) bool(name string) bool {
+	switch v := a[name].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+func (a toolArgs) tunnelName() (string, error) {
+	name := a.str("name")
+	if !tunnelNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid tunnel name %q", name)
+	}
+	return name, nil
+}
+
+func objectSchema(required []string, properties map[string]interface{}) map[string]interface{} {
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+var tunnelNameProperty = map[string]interface{}{
+	"type":        "string",
+	"description": "Tunnel name as shown by list_tunnels, e.g. \"blog\" for blog-config.yml",
+}
+
+var aiTools = []*aiTool{
+	{
+		Tool: ai.Tool{
+			Name:        "list_tunnels",
+			Description: "List the configured Cloudflare tunnels with their hostname, local port and whether they are running.",
+			Parameters:  objectSchema(nil, map[string]interface{}{}),
+		},
+		readOnly: true,
+		run: func(r *http.Request, args toolArgs) (string, error) {
+			list, err := tunnels.ListTunnels()
+			if err != nil {
+				return "", err
+			}
+			return toolJSON(list)
+		},
+	},
+	{
+		Tool: ai.Tool{
+			Name:        "tunnel_status",
+			Description: "Show one tunnel's ID, hostname, local port, state, PID and resource use.",
+			Parameters:  objectSchema([]string{"name"}, map[string]interface{}{"name": tunnelNameProperty}),
+		},
+		readOnly: true,
+		run: func(r *http.Request, args toolArgs) (string, error) {
+			name, err := args.tunnelName()
+			if err != nil {
+				return "", err
+			}
+			tunnel, err := tunnels.GetTunnelStatus(name)
+			if err != nil {
+				return "", fmt.Errorf("tunnel %s not found", name)
+			}
+			return toolJSON(tunnel)
+		},
+	},
+	{
+		Tool: ai.Tool{
+			Name:        "tunnel_logs",
+			Description: "Read the last lines cloudflared logged for a tunnel started by this manager.",
+			Parameters: objectSchema([]string{"name"}, map[string]interface{}{
+				"name": tunnelNameProperty,
+				"lines": map[string]interface{}{
+					"type":        "integer",
+					"description": fmt.Sprintf("How many lines to return, at most %d (default %d)", maxTunnelLogLines, defaultTunnelLogLines),
+				},
+			}),
+		},
+		readOnly: true,
+		run: func(r *http.Request, args toolArgs) (string, error) {
+			name, err := args.tunnelName()
+			if err != nil {
+				return "", err
+			}
+			lines := min(max(args.int("lines", defaultTunnelLogLines), 1), maxTunnelLogLines)
+			logs, err := tunnels.GetTunnelLogs(name, lines)
+			if err != nil {
+				return "", err
+			}
+			if logs == "" {
+				return "No output has been logged for this tunnel yet.", nil
+			}
+			return logs, nil
+		},
+	},
+	{
+		Tool: ai.Tool{
+			Name:        "start_tunnel",
+			Description: "Start a tunnel, restarting it if it already runs. Needs the user's approval.",
+			Parameters:  objectSchema([]string{"name"}, map[string]interface{}{"name": tunnelNameProperty}),
+		},
+		run: func(r *http.Request, args toolArgs) (string, error) {
+			name, err := args.tunnelName()
+			if err != nil {
+				return "", err
+			}
+			before := tunnelState(name)
+			err = tunnels.StartTunnel(name)
+			audit.Record(r, "tunnel.start", name, before, tunnelState(name), err)
+			if err != nil {
+				return "", err
+			}
+			return "Tunnel " + name + " started.", nil
+		},
+		summary: func(args toolArgs) string {
+			return "Start tunnel " + args.str("name")
+		},
+	},
+	{
+		Tool: ai.Tool{
+			Name:        "stop_tunnel",
+			Description: "Stop a running tunnel. Needs the user's approval.",
+			Parameters:  objectSchema([]string{"name"}, map[string]interface{}{"name": tunnelNameProperty}),
+		},
+		run: func(r *http.Request, args toolArgs) (string, error) {
+			name, err := args.tunnelName()
+			if err != nil {
+				return "", err
+			}
+			before := tunnelState(name)
+			err = tunnels.StopTunnel(name)
+			audit.Record(r, "tunnel.stop", name, before, tunnelState(name), err)
+			if err != nil {
+				return "", err
+			}
+			return "Tunnel " + name + " stopped.", nil
+		},
+		summary: func(args toolArgs) string {
+			return "Stop tunnel " + args.str("name")
+		},
+	},
+	{
+		Tool: ai.Tool{
+			Name:        "create_dns_record",
+			Description: "Create a DNS record <subdomain>.<zone domain> in the Cloudflare zone. For a tunnel the record is a proxied CNAME to <tunnel-id>.cfargotunnel.com. Needs the user's approval.",
+			Parameters: objectSchema([]string{"subdomain", "type", "target"}, map[string]interface{}{
+				"subdomain": map[string]interface{}{"type": "string", "description": "Name within the zone, without the domain"},
+				"type":      map[string]interface{}{"type": "string", "enum": []string{"CNAME", "A", "AAAA", "TXT"}},
+				"target":    map[string]interface{}{"type": "string", "description": "Record content: a hostname for CNAME, an address for A/AAAA"},
+				"proxied":   map[string]interface{}{"type": "boolean", "description": "Route through Cloudflare's proxy"},
+			}),
+		},
+		run: func(r *http.Request, args toolArgs) (string, error) {
+			req := dns.CreateDNSRequest{
+				Subdomain: args.str("subdomain"),
+				Type:      strings.ToUpper(args.str("type")),
+				Target:    args.str("target"),
+				Proxied:   args.bool("proxied"),
+			}
+			if req.Subdomain == "" || req.Type == "" || req.Target == "" {
+				return "", errors.New("subdomain, type and target are required")
+			}
+			record, err := dns.CreateDNSRecord(req)
+			audit.Record(r, "dns.create", req.Subdomain, "", describeDNSRequest(req.Type, req.Target, req.Proxied), err)
+			if err != nil {
+				return "", err
+			}
+			return toolJSON(record)
+		},
+		summary: func(args toolArgs) string {
+			return fmt.Sprintf("Create DNS record %s: %s",
+				args.str("subdomain"), describeDNSRequest(strings.ToUpper(args.str("type")), args.str("target"), args.bool("proxied")))
+		},
+	},
+	{
+		Tool: ai.Tool{
+			Name:        "update_dns_record",
+			Description: "Change an existing DNS record, found by its ID, e.g. to point a tunnel's hostname at <tunnel-id>.cfargotunnel.com. Needs the user's approval.",
+			Parameters: objectSchema([]string{"id", "type", "target"}, map[string]interface{}{
+				"id":      map[string]interface{}{"type": "string", "description": "Record ID from Cloudflare"},
+				"type":    map[string]interface{}{"type": "string", "enum": []string{"CNAME", "A", "AAAA", "TXT"}},
+				"target":  map[string]interface{}{"type": "string", "description": "New record content"},
+				"proxied": map[string]interface{}{"type": "boolean", "description": "Route through Cloudflare's proxy"},
+			}),
+		},
+		run: func(r *http.Request, args toolArgs) (string, error) {
+			id := args.str("id")
+			req := dns.UpdateDNSRequest{
+				Type:    strings.ToUpper(args.str("type")),
+				Content: args.str("target"),
+				TTL:     1,
+				Proxied: args.bool("proxied"),
+			}
+			if id == "" || req.Type == "" || req.Content == "" {
+				return "", errors.New("id, type and target are required")
+			}
+			before := "unknown"
+			if record, err := dns.GetDNSRecord(id); err == nil {
+				before = record.Name + " " + describeDNSRequest(record.Type, record.Content, record.Proxied)
+			}
+			record, err := dns.UpdateDNSRecord(id, req)
+			audit.Record(r, "dns.update", id, before, describeDNSRequest(req.Type, req.Content, req.Proxied), err)
+			if err != nil {
+				return "", err
+			}
+			return toolJSON(record)
+		},
+		summary: func(args toolArgs) string {
+			// The ID alone does not tell the user which record they approve
+			name := args.str("id")
+			if record, err := dns.GetDNSRecord(name); err == nil {
+				name = fmt.Sprintf("%s (%s, now %s)", record.Name, name, describeDNSRequest(record.Type, record.Content, record.Proxied))
+			}
+			return fmt.Sprintf("Change DNS record %s to %s",
+				name, describeDNSRequest(strings.ToUpper(args.str("type")), args.str("target"), args.bool("proxied")))
+		},
+	},
+	{
+		Tool: ai.Tool{
+			Name:        "set_tunnel_origin",
+			Description: "Point a tunnel's hostname at another local service, e.g. http://localhost:8080, by rewriting the ingress rules in its config. A running tunnel has to be restarted to use it. Needs the user's approval.",
+			Parameters: objectSchema([]string{"name", "service"}, map[string]interface{}{
+				"name":    tunnelNameProperty,
+				"service": map[string]interface{}{"type": "string", "description": "Origin URL with host and port: http://, https://, tcp://, ssh:// or rdp://"},
+			}),
+		},
+		run: func(r *http.Request, args toolArgs) (string, error) {
+			name, err := args.tunnelName()
+			if err != nil {
+				return "", err
+			}
+			service := args.str("service")
+			if _, err := originAddress(service); err != nil {
+				return "", err
+			}
+			before, err := tunnels.GetTunnelConfig(name)
+			if err != nil {
+				return "", err
+			}
+			after, err := setTunnelService(before, service)
+			if err != nil {
+				return "", err
+			}
+			err = tunnels.UpdateTunnelConfig(name, after)
+			audit.Record(r, "tunnel.config", name, audit.Summarize(before), audit.Summarize(after), err)
+			if err != nil {
+				return "", err
+			}
+			if tunnelState(name) == "running" {
+				return "Tunnel " + name + " now points at " + service + ". Restart it to use the new origin.", nil
+			}
+			return "Tunnel " + name + " now points at " + service + ".", nil
+		},
+		summary: func(args toolArgs) string {
+			return "Point tunnel " + args.str("name") + " at " + args.str("service")
+		},
+	},
+}
+
+func aiToolByName(name string) *aiTool {
+	for _, tool := range aiTools {
+		if tool.Name == name {
+			return tool
+		}
+	}
+	return nil
+}
+
+// aiToolDeclarations returns the tools as offered to the model.
+func aiToolDeclarations() []ai.Tool {
+	declared := make([]ai.Tool, 0, len(aiTools))
+	for _, tool := range aiTools {
+		declared = append(declared, tool.Tool)
+	}
+	return declared
+}
+
+func toolJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func tunnelState(name string) string {
+	tunnel, err := tunnels.GetTunnelStatus(name)
+	if err != nil {
+		return "absent"
+	}
+	return tunnel.Status
+}
+
+func describeDNSRequest(recordType, content string, proxied bool) string {
+	if proxied {
+		return fmt.Sprintf("%s %s (proxied)", recordType, content)
+	}
+	return fmt.Sprintf("%s %s", recordType, content)
+}
+
+// Default ports of the origin schemes cloudflared proxies to.
+var originPorts = map[string]string{"http": "80", "https": "443", "tcp": "", "ssh": "22", "rdp": "3389"}
+
+// originAddress returns the host:port a tunnel service URL connects to. An
+// origin listening on all interfaces is reached on the loopback address.
+func originAddress(service string) (string, error) {
+	u, err := url.Parse(service)
+	if err != nil || u.Hostname() == "" {
+		return "", fmt.Errorf("invalid origin service %q", service)
+	}
+	defaultPort, ok := originPorts[u.Scheme]
+	if !ok {
+		return "", fmt.Errorf("unsupported origin scheme %q", u.Scheme)
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	if port == "" {
+		return "", fmt.Errorf("origin service %q needs a port", service)
+	}
+	if host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// setTunnelService points every ingress rule of config that has a hostname at
+// service. The catch-all rule and everything else are left as they are.
+func setTunnelService(config, service string) (string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(config), &doc); err != nil {
+		return "", fmt.Errorf("invalid YAML syntax: %v", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return "", errors.New("the tunnel config is not a YAML mapping")
+	}
+	ingress := yamlValue(doc.Content[0], "ingress")
+	if ingress == nil || ingress.Kind != yaml.SequenceNode {
+		return "", errors.New("the tunnel config has no ingress rules")
+	}
+	changed := false
+	for _, rule := range ingress.Content {
+		if rule.Kind != yaml.MappingNode || yamlValue(rule, "hostname") == nil {
+			continue
+		}
+		if s := yamlValue(rule, "service"); s != nil {
+			s.Value = service
+			s.Style = yaml.DoubleQuotedStyle
+			changed = true
+		}
+	}
+	if !changed {
+		return "", errors.New("no ingress rule of the tunnel has a hostname and service")
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return "", err
+	}
+	enc.Close()
+	return out.String(), nil
+}
+
+// yamlValue returns the value of key in mapping, or nil.
+func yamlValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// runAITool runs a call and returns the tool message answering it. Failures
+// are reported to the model as the result so it can explain or try again.
+func runAITool(r *http.Request, call ai.ToolCall) ai.Message {
+	result := ai.Message{Role: ai.RoleTool, ToolCallID: call.ID, Name: call.Name}
+	tool := aiToolByName(call.Name)
+	if tool == nil {
+		result.Text = "Error: there is no tool named " + call.Name
+		return result
+	}
+	var args toolArgs
+	if err := json.Unmarshal(call.Args, &args); err != nil {
+		result.Text = "Error: invalid arguments: " + err.Error()
+		return result
+	}
+	out, err := tool.run(r, args)
+	if err != nil {
+		result.Text = "Error: " + err.Error()
+		return result
+	}
+	result.Text = out
+	return result
+}
+
+// AIAction is a call to a tool that changes something, held until a person
+// approves or rejects it.
+type AIAction struct {
+	ID      string          `json:"id"`
+	CallID  string          `json:"callId"`
+	Tool    string          `json:"tool"`
+	Args    json.RawMessage `json:"args"`
+	Summary string          `json:"summary"`
+	Owner   string          `json:"-"`
+	created time.Time
+}
+
+var (
+	aiActionsMu sync.Mutex
+	aiActions   = make(map[string]*AIAction)
+)
+
+// proposeAIAction records call as waiting for owner's approval.
+func proposeAIAction(owner string, call ai.ToolCall, tool *aiTool) (*AIAction, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	var args toolArgs
+	json.Unmarshal(call.Args, &args)
+	action := &AIAction{
+		ID:      id,
+		CallID:  call.ID,
+		Tool:    call.Name,
+		Args:    call.Args,
+		Summary: tool.summary(args),
+		Owner:   owner,
+		created: time.Now(),
+	}
+
+	aiActionsMu.Lock()
+	defer aiActionsMu.Unlock()
+	for id, a := range aiActions {
+		if time.Since(a.created) > aiActionTTL {
+			delete(aiActions, id)
+		}
+	}
+	aiActions[id] = action
+	return action, nil
+}
+
+// takeAIAction removes and returns the pending action id of owner. An action
+// can only be decided once.
+func takeAIAction(id, owner string) (*AIAction, bool) {
+	aiActionsMu.Lock()
+	defer aiActionsMu.Unlock()
+	action, ok := aiActions[id]
+	if !ok || action.Owner != owner || time.Since(action.created) > aiActionTTL {
+		return nil, false
+	}
+	delete(aiActions, id)
+	return action, true
+}
+
+type AIActionRequest struct {
+	ID string `json:"id"`
+}
+
+// handleApproveAIAction runs a proposed action. The reply carries the tool
+// message to add to the conversation before it goes on.
+func handleApproveAIAction(w http.ResponseWriter, r *http.Request) {
+	decideAIAction(w, r, true)
+}
+
+// handleRejectAIAction drops a proposed action and tells the model so.
+func handleRejectAIAction(w http.ResponseWriter, r *http.Request) {
+	decideAIAction(w, r, false)
+}
+
+func decideAIAction(w http.ResponseWriter, r *http.Request, approve bool) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AIActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFileError(w, "Invalid request format: "+err.Error())
+		return
+	}
+	action, ok := takeAIAction(req.ID, auth.Username(r))
+	if !ok {
+		writeFileError(w, "This action is no longer pending")
+		return
+	}
+
+	call := ai.ToolCall{ID: action.CallID, Name: action.Tool, Args: action.Args}
+	var message ai.Message
+	if approve {
+		message = runAITool(r, call)
+	} else {
+		message = ai.Message{
+			Role:       ai.RoleTool,
+			ToolCallID: action.CallID,
+			Name:       action.Tool,
+			Text:       "The user declined to run this action.",
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"approved": approve,
+		"message":  message,
+	})
+}
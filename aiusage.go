@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cf-manager/ai"
+	"cf-manager/auth"
+)
+
+const (
+	defaultAIUsageFile = "ai-usage.json"
+
+	// Days of usage kept, enough to compare a month with the one a year ago.
+	aiUsageKeepDays = 400
+	// Days shown by the usage summary unless it is asked for more.
+	defaultAIUsageDays = 30
+
+	aiUsageDayFormat = "2006-01-02"
+
+	// Tokens held back for a running request of a user who has made none
+	// this month to take the average of.
+	aiReserveTokens = 2000
+	// Retry-After when a quota is only taken up by running requests.
+	aiRetryRunningSeconds = 10
+)
+
+// AIUsageRecord adds up what one user spent with one model on one day. Days
+// are in the server's time zone, like the quotas.
+type AIUsageRecord struct {
+	Day              string `json:"day"`
+	User             string `json:"user"`
+	Provider         string `json:"provider"`
+	Model            string `json:"model"`
+	Requests         int    `json:"requests"`
+	PromptTokens     int    `json:"promptTokens"`
+	CompletionTokens int    `json:"completionTokens"`
+}
+
+// AIQuotas are token limits, prompt and completion together; 0 means none.
+// The User limits apply to each user, the Total ones to everybody at once.
+type AIQuotas struct {
+	UserDaily    int `json:"userDaily"`
+	UserMonthly  int `json:"userMonthly"`
+	TotalDaily   int `json:"totalDaily"`
+	TotalMonthly int `json:"totalMonthly"`
+}
+
+var (
+	aiUsageFile = defaultAIUsageFile
+	aiQuotas    AIQuotas
+
+	aiUsageMu      sync.Mutex
+	aiUsageRecords []*AIUsageRecord
+	// aiUsagePending is what the requests still running are expected to
+	// use, by user, so that requests made together cannot all slip under a
+	// quota
+	aiUsagePending = map[string]int{}
+)
+
+// loadAIUsage reads FM_AI_USAGE_FILE, where token usage is kept, and the
+// quotas: FM_AI_DAILY_TOKENS and FM_AI_MONTHLY_TOKENS for each user,
+// FM_AI_TOTAL_DAILY_TOKENS and FM_AI_TOTAL_MONTHLY_TOKENS for all of them.
+func loadAIUsage() error {
+	if v := os.Getenv("FM_AI_USAGE_FILE"); v != "" {
+		aiUsageFile = v
+	}
+	for env, limit := range map[string]*int{
+		"FM_AI_DAILY_TOKENS":         &aiQuotas.UserDaily,
+		"FM_AI_MONTHLY_TOKENS":       &aiQuotas.UserMonthly,
+		"FM_AI_TOTAL_DAILY_TOKENS":   &aiQuotas.TotalDaily,
+		"FM_AI_TOTAL_MONTHLY_TOKENS": &aiQuotas.TotalMonthly,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid %s %q", env, v)
+			}
+			*limit = n
+		}
+	}
+
+	data, err := os.ReadFile(aiUsageFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &aiUsageRecords); err != nil {
+		return fmt.Errorf("%s is damaged: %v", aiUsageFile, err)
+	}
+	return nil
+}
+
+// saveAIUsage rewrites the usage file; aiUsageMu must be held.
+func saveAIUsage() error {
+	data, err := json.MarshalIndent(aiUsageRecords, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(aiUsageFile), "."+filepath.Base(aiUsageFile)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), aiUsageFile)
+}
+
+// recordAIUsage counts a request to the model with the tokens the provider
+// reported for it. Servers that report none still have the request counted.
+func recordAIUsage(user, provider, model string, usage ai.Usage) {
+	day := time.Now().Format(aiUsageDayFormat)
+	oldest := time.Now().AddDate(0, 0, -aiUsageKeepDays).Format(aiUsageDayFormat)
+
+	aiUsageMu.Lock()
+	defer aiUsageMu.Unlock()
+
+	var record *AIUsageRecord
+	kept := aiUsageRecords[:0]
+	for _, rec := range aiUsageRecords {
+		if rec.Day < oldest {
+			continue
+		}
+		kept = append(kept, rec)
+		if rec.Day == day && rec.User == user && rec.Provider == provider && rec.Model == model {
+			record = rec
+		}
+	}
+	aiUsageRecords = kept
+	if record == nil {
+		record = &AIUsageRecord{Day: day, User: user, Provider: provider, Model: model}
+		aiUsageRecords = append(aiUsageRecords, record)
+	}
+	record.Requests++
+	record.PromptTokens += usage.PromptTokens
+	record.CompletionTokens += usage.CompletionTokens
+
+	if err := saveAIUsage(); err != nil {
+		log.Printf("Failed to save AI usage to %s: %v", aiUsageFile, err)
+	}
+}
+
+// recordUsage counts what answering turn took, tried and failed turns too
+// since the provider charges for them all the same.
+func (c *aiCall) recordUsage(r *http.Request, turn *aiTurn) {
+	if turn == nil {
+		return
+	}
+	model := turn.Model
+	if model == "" {
+		model = c.provider.Model()
+	}
+	recordAIUsage(auth.Username(r), c.provider.Name(), model, turn.Usage)
+}
+
+// AIUsageTotals adds up a set of records.
+type AIUsageTotals struct {
+	Requests         int `json:"requests"`
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+	Tokens           int `json:"tokens"`
+}
+
+func (t *AIUsageTotals) add(rec *AIUsageRecord) {
+	t.Requests += rec.Requests
+	t.PromptTokens += rec.PromptTokens
+	t.CompletionTokens += rec.CompletionTokens
+	t.Tokens += rec.PromptTokens + rec.CompletionTokens
+}
+
+// aiUsageSince adds up the records from day on, of user or of everybody
+// when user is empty.
+func aiUsageSince(day, user string) AIUsageTotals {
+	aiUsageMu.Lock()
+	defer aiUsageMu.Unlock()
+	return usageSince(day, user)
+}
+
+// usageSince is aiUsageSince for callers holding aiUsageMu.
+func usageSince(day, user string) AIUsageTotals {
+	var totals AIUsageTotals
+	for _, rec := range aiUsageRecords {
+		if rec.Day >= day && (user == "" || rec.User == user) {
+			totals.add(rec)
+		}
+	}
+	return totals
+}
+
+// aiQuotaError says which quota a request ran into and when it frees up.
+type aiQuotaError struct {
+	Period string `json:"period"`
+	Scope  string `json:"scope"`
+	Limit  int    `json:"limit"`
+	Used   int    `json:"used"`
+	// Running is held back for requests still being answered.
+	Running int       `json:"running,omitempty"`
+	Resets  time.Time `json:"resets"`
+}
+
+func (e *aiQuotaError) Error() string {
+	whose := "Your"
+	if e.Scope == "total" {
+		whose = "The shared"
+	}
+	if e.Running > 0 && e.Used < e.Limit {
+		return fmt.Sprintf("%s %s AI token quota is taken up by requests still running (%d of %d tokens used). Try again when they are done.",
+			whose, e.Period, e.Used, e.Limit)
+	}
+	return fmt.Sprintf("%s %s AI token quota is used up (%d of %d tokens). It resets %s.",
+		whose, e.Period, e.Used, e.Limit, e.Resets.Format("Jan 2 15:04 MST"))
+}
+
+// reserveAIQuota returns an *aiQuotaError when user, or everybody together,
+// has used up a quota, counting the requests still running at what they are
+// expected to use. Otherwise it holds back the user's average tokens per
+// request this month for the new request until release is called, once the
+// request has been recorded. Only what was spent or held back before counts,
+// so the request that crosses a limit is still answered.
+func reserveAIQuota(user string) (release func(), err error) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	periods := []struct {
+		name          string
+		start, resets time.Time
+		user, total   int
+	}{
+		{"daily", today, today.AddDate(0, 0, 1), aiQuotas.UserDaily, aiQuotas.TotalDaily},
+		{"monthly", month, month.AddDate(0, 1, 0), aiQuotas.UserMonthly, aiQuotas.TotalMonthly},
+	}
+
+	aiUsageMu.Lock()
+	defer aiUsageMu.Unlock()
+
+	pending := 0
+	for _, tokens := range aiUsagePending {
+		pending += tokens
+	}
+	for _, p := range periods {
+		from := p.start.Format(aiUsageDayFormat)
+		if p.user > 0 {
+			if used, running := usageSince(from, user).Tokens, aiUsagePending[user]; used+running >= p.user {
+				return nil, &aiQuotaError{p.name, "user", p.user, used, running, p.resets}
+			}
+		}
+		if p.total > 0 {
+			if used := usageSince(from, "").Tokens; used+pending >= p.total {
+				return nil, &aiQuotaError{p.name, "total", p.total, used, pending, p.resets}
+			}
+		}
+	}
+
+	estimate := aiReserveTokens
+	if spent := usageSince(month.Format(aiUsageDayFormat), user); spent.Requests > 0 {
+		estimate = spent.Tokens / spent.Requests
+	}
+	aiUsagePending[user] += estimate
+	return func() {
+		aiUsageMu.Lock()
+		defer aiUsageMu.Unlock()
+		if aiUsagePending[user] -= estimate; aiUsagePending[user] <= 0 {
+			delete(aiUsagePending, user)
+		}
+	}, nil
+}
+
+// aiQuotaReserve reserves a quota share for the caller's request with
+// reserveAIQuota. Over a quota it answers with 429 Too Many Requests and
+// reports false; otherwise the caller has to call release when done.
+func aiQuotaReserve(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	release, err := reserveAIQuota(auth.Username(r))
+	if err == nil {
+		return release, true
+	}
+	quota := err.(*aiQuotaError)
+	w.Header().Set("Content-Type", "application/json")
+	retry := int(time.Until(quota.Resets).Seconds()) + 1
+	if quota.Used < quota.Limit {
+		// Only running requests stand in the way
+		retry = aiRetryRunningSeconds
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "quota": quota})
+	return nil, false
+}
+
+// AIUsageDay is the usage of one day in the summary.
+type AIUsageDay struct {
+	Day string `json:"day"`
+	AIUsageTotals
+}
+
+// AIUsageShare is the usage of one user or model in the summary.
+type AIUsageShare struct {
+	Name string `json:"name"`
+	AIUsageTotals
+}
+
+func addShare(shares map[string]*AIUsageTotals, name string, rec *AIUsageRecord) {
+	if shares[name] == nil {
+		shares[name] = &AIUsageTotals{}
+	}
+	shares[name].add(rec)
+}
+
+func sortedShares(shares map[string]*AIUsageTotals) []AIUsageShare {
+	list := []AIUsageShare{}
+	for name, totals := range shares {
+		list = append(list, AIUsageShare{name, *totals})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Tokens != list[j].Tokens {
+			return list[i].Tokens > list[j].Tokens
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// handleAIUsage summarizes token usage over the last days (30 unless ?days=
+// says otherwise): each day, each user and each model, what the caller and
+// everybody have used today and this month, and the quotas.
+func handleAIUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	days := defaultAIUsageDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > aiUsageKeepDays {
+			writeFileError(w, fmt.Sprintf("days must be between 1 and %d", aiUsageKeepDays))
+			return
+		}
+		days = n
+	}
+
+	now := time.Now()
+	from := now.AddDate(0, 0, 1-days).Format(aiUsageDayFormat)
+	byDay := map[string]*AIUsageTotals{}
+	series := make([]AIUsageDay, 0, days)
+	for i := days - 1; i >= 0; i-- {
+		day := now.AddDate(0, 0, -i).Format(aiUsageDayFormat)
+		byDay[day] = &AIUsageTotals{}
+		series = append(series, AIUsageDay{Day: day})
+	}
+	byUser := map[string]*AIUsageTotals{}
+	byModel := map[string]*AIUsageTotals{}
+
+	aiUsageMu.Lock()
+	for _, rec := range aiUsageRecords {
+		if rec.Day < from || byDay[rec.Day] == nil {
+			continue
+		}
+		byDay[rec.Day].add(rec)
+		addShare(byUser, rec.User, rec)
+		addShare(byModel, rec.Provider+"/"+rec.Model, rec)
+	}
+	aiUsageMu.Unlock()
+	for i := range series {
+		series[i].AIUsageTotals = *byDay[series[i].Day]
+	}
+
+	user := auth.Username(r)
+	today := now.Format(aiUsageDayFormat)
+	month := now.Format("2006-01") + "-01"
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user":   user,
+		"quotas": aiQuotas,
+		"today":  map[string]AIUsageTotals{"user": aiUsageSince(today, user), "total": aiUsageSince(today, "")},
+		"month":  map[string]AIUsageTotals{"user": aiUsageSince(month, user), "total": aiUsageSince(month, "")},
+		"days":   series,
+		"users":  sortedShares(byUser),
+		"models": sortedShares(byModel),
+	})
+}
@@ -0,0 +1,979 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-manager/audit"
+	"cf-manager/auth"
+	"cf-manager/throttle"
+)
+
+const (
+	defaultMaxExtractMB = 4096
+	maxArchiveEntries   = 100000
+	maxSymlinkTarget    = 4096
+
+	archiveProgressInterval = 300 * time.Millisecond
+	finishedArchiveTTL      = 30 * time.Minute
+
+	ArchiveRunning   = "running"
+	ArchiveDone      = "done"
+	ArchiveFailed    = "failed"
+	ArchiveCancelled = "cancelled"
+)
+
+// maxExtractSize bounds how much one extraction may write, whatever the
+// archive claims, so a zip bomb fails instead of filling the disk.
+var maxExtractSize int64 = defaultMaxExtractMB << 20
+
+// loadArchiveLimits reads FM_MAX_EXTRACT_MB.
+func loadArchiveLimits() error {
+	if v := os.Getenv("FM_MAX_EXTRACT_MB"); v != "" {
+		mb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || mb <= 0 {
+			return fmt.Errorf("invalid FM_MAX_EXTRACT_MB %q", v)
+		}
+		maxExtractSize = mb << 20
+	}
+	return nil
+}
+
+// archiveFormat tells the format from the file name: "zip", "tar.gz", "tar",
+// or "" when it is not an archive we handle.
+func archiveFormat(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar"
+	}
+	return ""
+}
+
+// ArchiveTask is one create or extract running in the background. Progress is
+// counted in bytes: source bytes read when creating, archive bytes read when
+// extracting.
+type ArchiveTask struct {
+	ID        string
+	Owner     string
+	Kind      string
+	Target    string
+	StartedAt time.Time
+
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	state      string
+	bytesDone  int64
+	bytesTotal int64
+	files      int
+	current    string
+	result     string
+	err        string
+	finishedAt time.Time
+}
+
+type ArchiveStatus struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"`
+	Target     string    `json:"target"`
+	State      string    `json:"state"`
+	BytesDone  int64     `json:"bytesDone"`
+	BytesTotal int64     `json:"bytesTotal"`
+	Files      int       `json:"files"`
+	Current    string    `json:"current,omitempty"`
+	Result     string    `json:"result,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+}
+
+var (
+	archiveTasksMu sync.Mutex
+	archiveTasks   = make(map[string]*ArchiveTask)
+)
+
+func (t *ArchiveTask) Status() ArchiveStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return ArchiveStatus{
+		ID:         t.ID,
+		Kind:       t.Kind,
+		Target:     t.Target,
+		State:      t.state,
+		BytesDone:  min(t.bytesDone, t.bytesTotal),
+		BytesTotal: t.bytesTotal,
+		Files:      t.files,
+		Current:    t.current,
+		Result:     t.result,
+		Error:      t.err,
+		StartedAt:  t.StartedAt,
+	}
+}
+
+func (t *ArchiveTask) setTotal(n int64) {
+	t.mu.Lock()
+	t.bytesTotal = n
+	t.mu.Unlock()
+}
+
+func (t *ArchiveTask) addBytes(n int64) {
+	t.mu.Lock()
+	t.bytesDone += n
+	t.mu.Unlock()
+}
+
+func (t *ArchiveTask) startFile(name string) {
+	t.mu.Lock()
+	t.files++
+	t.current = name
+	t.mu.Unlock()
+}
+
+func (t *ArchiveTask) finish(result string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finishedAt = time.Now()
+	t.current = ""
+	switch {
+	case err == nil:
+		t.state = ArchiveDone
+		t.result = result
+		t.bytesDone = t.bytesTotal
+	case errors.Is(err, context.Canceled):
+		t.state = ArchiveCancelled
+		t.err = "cancelled"
+	default:
+		t.state = ArchiveFailed
+		t.err = err.Error()
+	}
+}
+
+// startArchiveTask runs fn in the background as a task of the requesting
+// user, and writes an audit entry when it ends.
+func startArchiveTask(r *http.Request, kind, target string, fn func(context.Context, *ArchiveTask) (string, error)) (*ArchiveTask, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	pruneArchiveTasks()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	task := &ArchiveTask{
+		ID:        id,
+		Owner:     auth.Username(r),
+		Kind:      kind,
+		Target:    target,
+		StartedAt: time.Now(),
+		cancel:    cancel,
+		state:     ArchiveRunning,
+	}
+
+	archiveTasksMu.Lock()
+	archiveTasks[id] = task
+	archiveTasksMu.Unlock()
+
+	// r is done with once the handler returns
+	actor, ip := auth.Actor(r), throttle.ClientIP(r)
+	go func() {
+		defer cancel()
+		result, err := fn(ctx, task)
+		task.finish(result, err)
+		audit.RecordFrom(actor, ip, "archive."+kind, target, "", result, err)
+		log.Printf("Archive %s of %s by %s: %s", kind, target, actor, task.Status().State)
+	}()
+	return task, nil
+}
+
+func getArchiveTask(id, owner string) (*ArchiveTask, bool) {
+	archiveTasksMu.Lock()
+	defer archiveTasksMu.Unlock()
+	task, ok := archiveTasks[id]
+	if !ok || task.Owner != owner {
+		return nil, false
+	}
+	return task, true
+}
+
+// pruneArchiveTasks forgets tasks that finished more than finishedArchiveTTL
+// ago.
+func pruneArchiveTasks() {
+	archiveTasksMu.Lock()
+	defer archiveTasksMu.Unlock()
+	for id, task := range archiveTasks {
+		task.mu.Lock()
+		expired := task.state != ArchiveRunning && time.Since(task.finishedAt) > finishedArchiveTTL
+		task.mu.Unlock()
+		if expired {
+			delete(archiveTasks, id)
+		}
+	}
+}
+
+// progressReader counts what passes through it towards the task's progress
+// and stops once the task is cancelled.
+type progressReader struct {
+	ctx  context.Context
+	r    io.Reader
+	task *ArchiveTask
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := p.r.Read(b)
+	p.task.addBytes(int64(n))
+	return n, err
+}
+
+type progressReaderAt struct {
+	ctx  context.Context
+	r    io.ReaderAt
+	task *ArchiveTask
+}
+
+func (p *progressReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := p.r.ReadAt(b, off)
+	p.task.addBytes(int64(n))
+	return n, err
+}
+
+type CreateArchiveRequest struct {
+	Paths     []string `json:"paths"`
+	Dest      string   `json:"dest"`
+	Overwrite bool     `json:"overwrite"`
+}
+
+// archiveEntry is one file, directory or symlink going into a new archive.
+type archiveEntry struct {
+	path string
+	name string
+	info fs.FileInfo
+	link string
+}
+
+// handleCreateArchive packs the selected files and directories into a new
+// .zip, .tar.gz or .tar, chosen by the extension of dest. Each selection is
+// stored under its own name at the top of the archive.
+func handleCreateArchive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CreateArchiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFileError(w, "Invalid request format: "+err.Error())
+		return
+	}
+	if len(req.Paths) == 0 {
+		writeFileError(w, "Select at least one file or directory")
+		return
+	}
+
+	dest, err := resolvePath(req.Dest)
+	if err != nil {
+		writeFileError(w, "Access denied: "+err.Error())
+		return
+	}
+	format := archiveFormat(dest)
+	if format == "" {
+		writeFileError(w, "Archive name must end in .zip, .tar.gz, .tgz or .tar")
+		return
+	}
+	if fi, err := os.Stat(dest); err == nil {
+		if fi.IsDir() || !req.Overwrite {
+			writeFileError(w, filepath.Base(dest)+" already exists")
+			return
+		}
+	}
+
+	var sources []string
+	names := make(map[string]bool)
+	for _, p := range req.Paths {
+		src, err := resolvePath(p)
+		if err != nil {
+			writeFileError(w, "Access denied: "+err.Error())
+			return
+		}
+		if _, err := os.Stat(src); err != nil {
+			writeFileError(w, "File not found or accessible: "+err.Error())
+			return
+		}
+		if names[filepath.Base(src)] {
+			writeFileError(w, "Two selected entries are both named "+filepath.Base(src))
+			return
+		}
+		names[filepath.Base(src)] = true
+		sources = append(sources, src)
+	}
+
+	task, err := startArchiveTask(r, "create", displayPath(dest), func(ctx context.Context, task *ArchiveTask) (string, error) {
+		return createArchive(ctx, task, sources, dest, format)
+	})
+	if err != nil {
+		writeFileError(w, "Failed to start: "+err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(task.Status())
+}
+
+func createArchive(ctx context.Context, task *ArchiveTask, sources []string, dest, format string) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".archive-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	entries, total, err := collectArchiveEntries(ctx, sources, map[string]bool{dest: true, tmp.Name(): true})
+	if err != nil {
+		tmp.Close()
+		return "", err
+	}
+	task.setTotal(total)
+
+	switch format {
+	case "zip":
+		err = writeZip(ctx, task, tmp, entries)
+	case "tar.gz":
+		gz := gzip.NewWriter(tmp)
+		err = writeTar(ctx, task, gz, entries)
+		if cerr := gz.Close(); err == nil {
+			err = cerr
+		}
+	default:
+		err = writeTar(ctx, task, tmp, entries)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d entries packed into %s", len(entries), displayPath(dest)), nil
+}
+
+// collectArchiveEntries lists everything below sources without following
+// symlinks, and the total size of the regular files. Paths in skip, the
+// archive being written, are left out.
+func collectArchiveEntries(ctx context.Context, sources []string, skip map[string]bool) ([]archiveEntry, int64, error) {
+	var (
+		entries []archiveEntry
+		total   int64
+	)
+	for _, src := range sources {
+		base := filepath.Dir(src)
+		err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if skip[p] {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(base, p)
+			if err != nil {
+				return err
+			}
+			entry := archiveEntry{path: p, name: filepath.ToSlash(rel), info: info}
+
+			switch {
+			case info.Mode().IsRegular():
+				total += info.Size()
+			case info.IsDir():
+				entry.name += "/"
+			case info.Mode()&fs.ModeSymlink != 0:
+				if entry.link, err = os.Readlink(p); err != nil {
+					return err
+				}
+			default:
+				// Devices, sockets and pipes have no place in an archive
+				return nil
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return entries, total, nil
+}
+
+func writeZip(ctx context.Context, task *ArchiveTask, out io.Writer, entries []archiveEntry) error {
+	zw := zip.NewWriter(out)
+	for _, e := range entries {
+		task.startFile(e.name)
+		hdr, err := zip.FileInfoHeader(e.info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = e.name
+		if e.info.Mode().IsRegular() {
+			hdr.Method = zip.Deflate
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case e.link != "":
+			_, err = io.WriteString(w, e.link)
+		case e.info.Mode().IsRegular():
+			err = copyIntoArchive(ctx, task, w, e.path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTar(ctx context.Context, task *ArchiveTask, out io.Writer, entries []archiveEntry) error {
+	tw := tar.NewWriter(out)
+	for _, e := range entries {
+		task.startFile(e.name)
+		hdr, err := tar.FileInfoHeader(e.info, e.link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = e.name
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if e.info.Mode().IsRegular() {
+			if err := copyIntoArchive(ctx, task, tw, e.path); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+func copyIntoArchive(ctx context.Context, task *ArchiveTask, w io.Writer, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, &progressReader{ctx: ctx, r: f, task: task})
+	return err
+}
+
+type ExtractArchiveRequest struct {
+	Archive   string `json:"archive"`
+	Dest      string `json:"dest"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+// handleExtractArchive unpacks an archive into dest, by default the directory
+// the archive is in. Everything is first unpacked into a hidden staging
+// directory inside dest and only moved into place once the whole archive has
+// been read, so a bad or hostile archive leaves nothing behind. Without
+// overwrite the extraction fails if any file already exists.
+func handleExtractArchive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ExtractArchiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFileError(w, "Invalid request format: "+err.Error())
+		return
+	}
+
+	archive, err := resolvePath(req.Archive)
+	if err != nil {
+		writeFileError(w, "Access denied: "+err.Error())
+		return
+	}
+	fi, err := os.Stat(archive)
+	if err != nil {
+		writeFileError(w, "File not found or accessible: "+err.Error())
+		return
+	}
+	format := archiveFormat(archive)
+	if !fi.Mode().IsRegular() || format == "" {
+		writeFileError(w, "Only .zip, .tar.gz, .tgz and .tar files can be extracted")
+		return
+	}
+
+	if req.Dest == "" {
+		req.Dest = filepath.Dir(archive)
+	}
+	dest, err := resolvePath(req.Dest)
+	if err != nil {
+		writeFileError(w, "Access denied: "+err.Error())
+		return
+	}
+	if fi, err := os.Stat(dest); err == nil && !fi.IsDir() {
+		writeFileError(w, displayPath(dest)+" is not a directory")
+		return
+	}
+
+	task, err := startArchiveTask(r, "extract", displayPath(archive), func(ctx context.Context, task *ArchiveTask) (string, error) {
+		return extractArchive(ctx, task, archive, format, dest, req.Overwrite)
+	})
+	if err != nil {
+		writeFileError(w, "Failed to start: "+err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(task.Status())
+}
+
+func extractArchive(ctx context.Context, task *ArchiveTask, archive, format, dest string, overwrite bool) (string, error) {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return "", err
+	}
+	staging, err := os.MkdirTemp(dest, ".extract-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	task.setTotal(fi.Size())
+
+	x := &extractor{ctx: ctx, task: task, root: staging}
+	if format == "zip" {
+		err = x.extractZip(f, fi.Size())
+	} else {
+		var r io.Reader = &progressReader{ctx: ctx, r: f, task: task}
+		if format == "tar.gz" {
+			gz, gerr := gzip.NewReader(r)
+			if gerr != nil {
+				return "", gerr
+			}
+			defer gz.Close()
+			r = gz
+		}
+		err = x.extractTar(r)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := mergeInto(staging, dest, overwrite); err != nil {
+		return "", err
+	}
+	result := fmt.Sprintf("%d entries extracted to %s", x.entries, displayPath(dest))
+	if x.skipped > 0 {
+		result += fmt.Sprintf(", %d special entries skipped", x.skipped)
+	}
+	return result, nil
+}
+
+// extractor writes archive entries below root and enforces the safety rules:
+// no entry may land outside root, directly or through a symlink, and the
+// archive may not expand beyond maxExtractSize or maxArchiveEntries.
+type extractor struct {
+	ctx  context.Context
+	task *ArchiveTask
+	root string
+
+	written int64
+	entries int
+	skipped int
+}
+
+// target returns where the archive entry name goes, or "" for the archive
+// root itself.
+func (x *extractor) target(name string) (string, error) {
+	x.entries++
+	if x.entries > maxArchiveEntries {
+		return "", fmt.Errorf("archive has more than %d entries", maxArchiveEntries)
+	}
+	if err := x.ctx.Err(); err != nil {
+		return "", err
+	}
+
+	name = strings.ReplaceAll(name, `\`, "/")
+	if strings.HasPrefix(name, "/") || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("unsafe absolute path %q in archive", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("unsafe path %q in archive", name)
+		}
+	}
+	rel := path.Clean(name)
+	if rel == "." {
+		return "", nil
+	}
+	target := filepath.Join(x.root, filepath.FromSlash(rel))
+	if !isWithin(x.root, target) {
+		return "", fmt.Errorf("unsafe path %q in archive", name)
+	}
+	x.task.startFile(rel)
+	return target, nil
+}
+
+// makeParent creates the directory target goes in and checks that no symlink
+// from the archive has redirected it outside root.
+func (x *extractor) makeParent(target string) error {
+	dir := filepath.Dir(target)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if !isWithin(x.root, resolved) {
+		return fmt.Errorf("archive entry %s escapes the target directory through a symlink", filepath.Base(target))
+	}
+	return nil
+}
+
+func (x *extractor) writeFile(target string, r io.Reader, mode fs.FileMode) error {
+	if err := x.makeParent(target); err != nil {
+		return err
+	}
+	// A later entry with the same name replaces the earlier one
+	if fi, err := os.Lstat(target); err == nil {
+		if fi.IsDir() {
+			return fmt.Errorf("archive has both a file and a directory named %s", filepath.Base(target))
+		}
+		os.Remove(target)
+	}
+
+	perm := mode.Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	remaining := maxExtractSize - x.written
+	n, err := io.Copy(f, io.LimitReader(r, remaining+1))
+	x.written += n
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n > remaining {
+		return x.tooBig()
+	}
+	return nil
+}
+
+func (x *extractor) tooBig() error {
+	return fmt.Errorf("archive expands to more than %d MB; refusing to extract it", maxExtractSize>>20)
+}
+
+// writeSymlink creates a symlink whose target stays inside root.
+func (x *extractor) writeSymlink(target, link string) error {
+	if filepath.IsAbs(link) {
+		return fmt.Errorf("symlink %s points to an absolute path", filepath.Base(target))
+	}
+	if !isWithin(x.root, filepath.Join(filepath.Dir(target), link)) {
+		return fmt.Errorf("symlink %s points outside the archive", filepath.Base(target))
+	}
+	if err := x.makeParent(target); err != nil {
+		return err
+	}
+	os.Remove(target)
+	return os.Symlink(link, target)
+}
+
+func (x *extractor) makeDir(target string) error {
+	if err := x.makeParent(target); err != nil {
+		return err
+	}
+	if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if fi, err := os.Lstat(target); err != nil || !fi.IsDir() {
+		return fmt.Errorf("archive has both a file and a directory named %s", filepath.Base(target))
+	}
+	return nil
+}
+
+func (x *extractor) extractZip(f *os.File, size int64) error {
+	zr, err := zip.NewReader(&progressReaderAt{ctx: x.ctx, r: f, task: x.task}, size)
+	if err != nil {
+		return err
+	}
+
+	// Refuse early when the archive admits to being too big; the byte count
+	// in writeFile catches archives that lie about it
+	var declared uint64
+	for _, zf := range zr.File {
+		declared += zf.UncompressedSize64
+	}
+	if declared > uint64(maxExtractSize) {
+		return x.tooBig()
+	}
+
+	for _, zf := range zr.File {
+		target, err := x.target(zf.Name)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			continue
+		}
+
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			err = x.makeDir(target)
+		case mode&fs.ModeSymlink != 0:
+			err = x.extractZipSymlink(zf, target)
+		case mode.IsRegular():
+			err = x.extractZipFile(zf, target, mode)
+		default:
+			x.skipped++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) extractZipFile(zf *zip.File, target string, mode fs.FileMode) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return x.writeFile(target, rc, mode)
+}
+
+func (x *extractor) extractZipSymlink(zf *zip.File, target string) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	link, err := io.ReadAll(io.LimitReader(rc, maxSymlinkTarget))
+	if err != nil {
+		return err
+	}
+	return x.writeSymlink(target, string(link))
+}
+
+func (x *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		target, err := x.target(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = x.makeDir(target)
+		case tar.TypeReg:
+			err = x.writeFile(target, tr, fs.FileMode(hdr.Mode))
+		case tar.TypeSymlink:
+			err = x.writeSymlink(target, hdr.Linkname)
+		default:
+			// Hard links, devices and pipes are not recreated
+			x.skipped++
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// mergeInto moves everything below staging into dest. Unless overwrite is set,
+// nothing is moved when any entry would replace an existing one.
+func mergeInto(staging, dest string, overwrite bool) error {
+	if !overwrite {
+		var conflicts []string
+		err := filepath.WalkDir(staging, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || p == staging {
+				return err
+			}
+			rel, _ := filepath.Rel(staging, p)
+			fi, err := os.Lstat(filepath.Join(dest, rel))
+			if err != nil {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() && fi.IsDir() {
+				return nil
+			}
+			conflicts = append(conflicts, filepath.ToSlash(rel))
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(conflicts) > 0 {
+			return fmt.Errorf("%d entries already exist, such as %s; extract with overwrite to replace them", len(conflicts), conflicts[0])
+		}
+	}
+	return moveTree(staging, dest)
+}
+
+func moveTree(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		s, d := filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())
+		if fi, err := os.Lstat(d); err == nil {
+			switch {
+			case e.IsDir() && fi.IsDir():
+				if err := moveTree(s, d); err != nil {
+					return err
+				}
+				continue
+			case fi.IsDir():
+				return fmt.Errorf("cannot replace the directory %s with a file", displayPath(d))
+			case e.IsDir():
+				if err := os.Remove(d); err != nil {
+					return err
+				}
+			}
+		}
+		if err := os.Rename(s, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleArchiveProgress streams a task's status as server-sent "progress"
+// events while it runs, ending with a "done" event.
+func handleArchiveProgress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	task, ok := getArchiveTask(r.URL.Query().Get("id"), auth.Username(r))
+	if !ok {
+		http.Error(w, "Archive task not found", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(archiveProgressInterval)
+	defer ticker.Stop()
+
+	var last ArchiveStatus
+	for {
+		status := task.Status()
+		data, _ := json.Marshal(status)
+		if status.State != ArchiveRunning {
+			fmt.Fprintf(w, "event: done\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		if status != last {
+			fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+			flusher.Flush()
+			last = status
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func handleCancelArchive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	task, ok := getArchiveTask(r.URL.Query().Get("id"), auth.Username(r))
+	if !ok {
+		writeFileError(w, "Archive task not found")
+		return
+	}
+	task.cancel()
+	json.NewEncoder(w).Encode(task.Status())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"cf-manager/access"
+	"cf-manager/auth"
+	"cf-manager/handlers"
+	"cf-manager/middleware"
+	"cf-manager/secrets"
+	"cf-manager/throttle"
+)
+
+// setupAuth loads the same password, Cloudflare Access and throttling settings
+// the cf-manager dashboard uses, so both UIs accept the same logins.
+func setupAuth() error {
+	auth.SetDevMode(os.Getenv("DEV_MODE") == "true")
+	auth.CookieName = "fm-session"
+
+	if err := secrets.Open(); err != nil {
+		return fmt.Errorf("failed to open secret store: %v", err)
+	}
+	if err := auth.LoadPassword(); err != nil {
+		return fmt.Errorf("failed to load admin password: %v", err)
+	}
+
+	accessConfig, err := access.ConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("invalid Cloudflare Access configuration: %v", err)
+	}
+	access.Configure(accessConfig)
+	throttle.Configure(throttle.ConfigFromEnv())
+	return nil
+}
+
+// handleLogin applies the per-IP login limit and then hands over to the
+// dashboard's login handler, which checks the account limit and sets the session.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if wait, ok := throttle.AllowIP(throttle.ClientIP(r)); !ok {
+		throttle.WriteTooManyRequests(w, wait)
+		return
+	}
+	handlers.LoginHandler(w, r)
+}
+
+// requireAuth only lets logged-in users through. Browsers get the login page,
+// API callers a JSON 401.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, ok := middleware.Authenticate(r)
+		if ok {
+			next(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+			return
+		}
+		if !access.PasswordAllowed() {
+			http.Error(w, "This file manager is only available through Cloudflare Access", http.StatusForbidden)
+			return
+		}
+		auth.RenderLogin(w, r.URL.RequestURI())
+	}
+}
+
+// requireCSRF rejects state-changing requests that do not echo the session's
+// CSRF token. It must run inside requireAuth.
+func requireCSRF(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" && !auth.ValidCSRF(r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid or missing CSRF token"})
+			return
+		}
+		next(w, r)
+	}
+}
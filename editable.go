@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultMaxEditKB = 2048
+
+	// How much of a file is read to decide whether it is text. The listing
+	// looks at less so that large directories stay quick to open.
+	editSniffSize    = 8192
+	listingSniffSize = 1024
+)
+
+var maxEditSize int64 = defaultMaxEditKB << 10
+
+// loadEditLimit reads FM_MAX_EDIT_KB, the largest file the editor opens or
+// saves.
+func loadEditLimit() error {
+	if v := os.Getenv("FM_MAX_EDIT_KB"); v != "" {
+		kb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || kb <= 0 {
+			return fmt.Errorf("invalid FM_MAX_EDIT_KB %q", v)
+		}
+		maxEditSize = kb << 10
+	}
+	return nil
+}
+
+// Language hints use highlight.js names.
+var languageByExtension = map[string]string{
+	".go": "go", ".sh": "bash", ".bash": "bash", ".zsh": "bash", ".env": "bash",
+	".js": "javascript", ".mjs": "javascript", ".cjs": "javascript", ".jsx": "javascript",
+	".ts": "typescript", ".tsx": "typescript",
+	".html": "xml", ".htm": "xml", ".xml": "xml", ".svg": "xml",
+	".css": "css", ".scss": "scss", ".less": "less",
+	".md": "markdown", ".markdown": "markdown", ".json": "json",
+	".yaml": "yaml", ".yml": "yaml",
+	".toml": "ini", ".ini": "ini", ".cfg": "ini", ".conf": "ini", ".config": "ini",
+	".service": "ini", ".socket": "ini", ".timer": "ini", ".mount": "ini", ".target": "ini", ".path": "ini",
+	".sql": "sql", ".py": "python", ".c": "c", ".h": "c",
+	".cpp": "cpp", ".cc": "cpp", ".cxx": "cpp", ".hpp": "cpp",
+	".java": "java", ".rb": "ruby", ".php": "php", ".pl": "perl", ".pm": "perl",
+	".rs": "rust", ".lua": "lua", ".diff": "diff", ".patch": "diff",
+	".dockerfile": "dockerfile", ".mk": "makefile",
+	".txt": "plaintext", ".log": "plaintext",
+}
+
+// languageByName covers files known by their whole name, matched in lower
+// case.
+var languageByName = map[string]string{
+	"dockerfile": "dockerfile", "containerfile": "dockerfile",
+	"makefile": "makefile", "gnumakefile": "makefile",
+	".bashrc": "bash", ".bash_profile": "bash", ".bash_aliases": "bash", ".bash_logout": "bash",
+	".profile": "bash", ".zshrc": "bash", ".zprofile": "bash", ".envrc": "bash",
+	".gitconfig": "ini", ".editorconfig": "ini", ".npmrc": "ini",
+	"gemfile": "ruby", "rakefile": "ruby", "vagrantfile": "ruby",
+	".gitignore": "plaintext", ".dockerignore": "plaintext",
+}
+
+// languageByInterpreter maps the program on a shebang line to a language.
+var languageByInterpreter = map[string]string{
+	"sh": "bash", "bash": "bash", "dash": "bash", "ash": "bash", "zsh": "bash", "ksh": "bash",
+	"python": "python", "python3": "python", "python2": "python",
+	"node": "javascript", "nodejs": "javascript", "deno": "typescript",
+	"perl": "perl", "ruby": "ruby", "php": "php", "lua": "lua",
+}
+
+// shebangInterpreter returns the program named on a "#!" first line, looking
+// through env, e.g. "python3" for "#!/usr/bin/env python3".
+func shebangInterpreter(head []byte) string {
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return ""
+	}
+	line := head[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return ""
+	}
+	prog := filepath.Base(fields[0])
+	if prog != "env" {
+		return prog
+	}
+	for _, f := range fields[1:] {
+		if !strings.HasPrefix(f, "-") && !strings.Contains(f, "=") {
+			return filepath.Base(f)
+		}
+	}
+	return ""
+}
+
+// detectLanguage guesses the language of a text file from its name, falling
+// back to its shebang line.
+func detectLanguage(name string, head []byte) string {
+	lower := strings.ToLower(name)
+	if lang, ok := languageByName[lower]; ok {
+		return lang
+	}
+	if strings.HasPrefix(lower, "dockerfile.") || strings.HasSuffix(lower, ".dockerfile") {
+		return "dockerfile"
+	}
+	if lang, ok := languageByExtension[filepath.Ext(lower)]; ok {
+		return lang
+	}
+	if lang, ok := languageByInterpreter[shebangInterpreter(head)]; ok {
+		return lang
+	}
+	return "plaintext"
+}
+
+// looksLikeText reports whether buf is UTF-8 without NUL bytes. When buf is
+// only the start of a file, a character cut off at the end is allowed.
+func looksLikeText(buf []byte, truncated bool) bool {
+	if bytes.IndexByte(buf, 0) >= 0 {
+		return false
+	}
+	if truncated {
+		i := len(buf) - 1
+		for i > 0 && len(buf)-i < utf8.UTFMax && !utf8.RuneStart(buf[i]) {
+			i--
+		}
+		if i >= 0 && !utf8.FullRune(buf[i:]) {
+			buf = buf[:i]
+		}
+	}
+	return utf8.Valid(buf)
+}
+
+// checkEditable reports whether the editor can open p: a regular file, after
+// following symlinks, no larger than maxEditSize whose first sniff bytes are
+// text. On success it returns the language hint.
+func checkEditable(p string, sniff int) (string, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", errors.New("Cannot edit a directory")
+	}
+	if !info.Mode().IsRegular() {
+		return "", errors.New("Cannot edit a device, pipe or socket")
+	}
+	if info.Size() > maxEditSize {
+		return "", fmt.Errorf("File is too large to edit (%d KB, the limit is %d KB)", info.Size()>>10, maxEditSize>>10)
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, sniff)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	head = head[:n]
+	if !looksLikeText(head, int64(n) < info.Size()) {
+		return "", errors.New("Cannot edit a binary file")
+	}
+	return detectLanguage(filepath.Base(p), head), nil
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"cf-manager/audit"
+)
+
+const (
+	defaultMaxUploadMB = 512
+	maxFormFieldSize   = 4096
+)
+
+var maxUploadSize int64 = defaultMaxUploadMB << 20
+
+// loadUploadLimit reads FM_MAX_UPLOAD_MB, the largest request /api/upload
+// accepts, all files included.
+func loadUploadLimit() error {
+	if v := os.Getenv("FM_MAX_UPLOAD_MB"); v != "" {
+		mb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || mb <= 0 {
+			return fmt.Errorf("invalid FM_MAX_UPLOAD_MB %q", v)
+		}
+		maxUploadSize = mb << 20
+	}
+	return nil
+}
+
+type FileInfo struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	DisplayPath string `json:"displayPath"`
+	Size        int64  `json:"size"`
+	IsDir       bool   `json:"isDir"`
+}
+
+func fileInfoFor(p string) FileInfo {
+	info := FileInfo{Name: filepath.Base(p), Path: p, DisplayPath: displayPath(p)}
+	if fi, err := os.Lstat(p); err == nil {
+		info.Size = fi.Size()
+		info.IsDir = fi.IsDir()
+	}
+	return info
+}
+
+func writeFileError(w http.ResponseWriter, message string) {
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// handleUpload streams multipart uploads straight to disk. The "path" field
+// names the target directory and must come before the "file" parts; an
+// "overwrite" field set to "true" allows replacing existing files. Each file
+// is written to a temporary name first, so a failed upload never leaves half a
+// file behind.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeFileError(w, "Expected a multipart upload: "+err.Error())
+		return
+	}
+
+	var (
+		dir       string
+		overwrite bool
+		saved     []FileInfo
+	)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeFileError(w, uploadError(err))
+			return
+		}
+
+		switch part.FormName() {
+		case "path":
+			value, _ := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			resolved, err := resolvePath(string(value))
+			if err != nil {
+				writeFileError(w, "Access denied: "+err.Error())
+				return
+			}
+			if fi, err := os.Stat(resolved); err != nil || !fi.IsDir() {
+				writeFileError(w, "Upload target is not a directory")
+				return
+			}
+			dir = resolved
+
+		case "overwrite":
+			value, _ := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			overwrite = string(value) == "true"
+
+		case "file":
+			if dir == "" {
+				writeFileError(w, "The path field must come before the files")
+				return
+			}
+			name := filepath.Base(filepath.Clean("/" + part.FileName()))
+			target, err := resolveEntryPath(filepath.Join(dir, name))
+			if err != nil {
+				writeFileError(w, "Invalid file name: "+err.Error())
+				return
+			}
+
+			err = saveUpload(target, part, overwrite)
+			audit.Record(r, "file.upload", displayPath(target), "", "", err)
+			if err != nil {
+				writeFileError(w, uploadError(err))
+				return
+			}
+			saved = append(saved, fileInfoFor(target))
+		}
+		part.Close()
+	}
+
+	if len(saved) == 0 {
+		writeFileError(w, "No files were uploaded")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"files":   saved,
+	})
+}
+
+func uploadError(err error) string {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return fmt.Sprintf("Upload is larger than the %d MB limit", maxUploadSize>>20)
+	}
+	return "Upload failed: " + err.Error()
+}
+
+func saveUpload(target string, src io.Reader, overwrite bool) error {
+	if fi, err := os.Lstat(target); err == nil {
+		if fi.IsDir() {
+			return fmt.Errorf("%s is a directory", filepath.Base(target))
+		}
+		if !overwrite {
+			return fmt.Errorf("%s already exists", filepath.Base(target))
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// handleDownload sends any file, text or binary, as an attachment. Range
+// requests are supported so large downloads can resume.
+func handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath, err := resolvePath(r.URL.Query().Get("path"))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		writeFileError(w, "Access denied: "+err.Error())
+		return
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		writeFileError(w, "File not found or accessible: "+err.Error())
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		w.Header().Set("Content-Type", "application/json")
+		writeFileError(w, "Only files can be downloaded")
+		return
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fi.Name()}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+type RenameRequest struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+// handleRename renames or moves a file or directory. Moving onto an existing
+// directory puts the entry inside it. Moves between filesystems, such as from
+// Termux's home to shared storage, fall back to copy and delete.
+func handleRename(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RenameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFileError(w, "Invalid request body: "+err.Error())
+		return
+	}
+
+	src, err := resolveEntryPath(req.From)
+	if err != nil {
+		writeFileError(w, "Access denied: "+err.Error())
+		return
+	}
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		writeFileError(w, "Source not found: "+err.Error())
+		return
+	}
+
+	dst, err := resolveEntryPath(req.To)
+	if err != nil {
+		writeFileError(w, "Access denied: "+err.Error())
+		return
+	}
+	if fi, err := os.Stat(dst); err == nil && fi.IsDir() && dst != src {
+		if dst, err = resolveEntryPath(filepath.Join(dst, filepath.Base(src))); err != nil {
+			writeFileError(w, "Access denied: "+err.Error())
+			return
+		}
+	}
+
+	if dst == src {
+		writeFileError(w, "Source and destination are the same")
+		return
+	}
+	if srcInfo.IsDir() && isWithin(src, dst) {
+		writeFileError(w, "Cannot move a directory into itself")
+		return
+	}
+	if fi, err := os.Lstat(dst); err == nil {
+		if !req.Overwrite || fi.IsDir() {
+			writeFileError(w, fmt.Sprintf("%s already exists", displayPath(dst)))
+			return
+		}
+	}
+
+	err = movePath(src, dst)
+	audit.Record(r, "file.rename", displayPath(src), displayPath(src), displayPath(dst), err)
+	if err != nil {
+		writeFileError(w, "Failed to move: "+err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"file":    fileInfoFor(dst),
+	})
+}
+
+// movePath renames src to dst, replacing a file there. Across filesystems it
+// copies src into a staging directory next to dst and renames the copy into
+// place only once it is complete, so a failed copy leaves dst as it was.
+func movePath(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	stage, err := os.MkdirTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".move-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stage)
+
+	staged := filepath.Join(stage, filepath.Base(dst))
+	if err := copyTree(src, staged); err != nil {
+		return err
+	}
+	if err := os.Rename(staged, dst); err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyTree copies files, directories and symlinks from src to dst, keeping
+// their permission bits.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.Mkdir(target, info.Mode().Perm())
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(p, target, info.Mode().Perm())
+		default:
+			return fmt.Errorf("cannot copy special file %s", displayPath(p))
+		}
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+type DeleteRequest struct {
+	Path      string `json:"path"`
+	Recursive bool   `json:"recursive"`
+}
+
+// handleDelete removes a file, a symlink (never its target) or an empty
+// directory. Directories with contents need "recursive": true.
+func handleDelete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req DeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFileError(w, "Invalid request body: "+err.Error())
+		return
+	}
+
+	target, err := resolveEntryPath(req.Path)
+	if err != nil {
+		writeFileError(w, "Access denied: "+err.Error())
+		return
+	}
+	fi, err := os.Lstat(target)
+	if err != nil {
+		writeFileError(w, "Not found: "+err.Error())
+		return
+	}
+
+	if fi.IsDir() && req.Recursive {
+		err = os.RemoveAll(target)
+	} else {
+		err = os.Remove(target)
+		if fi.IsDir() && errors.Is(err, syscall.ENOTEMPTY) {
+			writeFileError(w, "Directory is not empty; delete it recursively to remove its contents")
+			return
+		}
+	}
+	audit.Record(r, "file.delete", displayPath(target), describeEntry(fi), "", err)
+	if err != nil {
+		writeFileError(w, "Failed to delete: "+err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+func describeEntry(fi fs.FileInfo) string {
+	switch {
+	case fi.IsDir():
+		return "directory"
+	case fi.Mode()&fs.ModeSymlink != 0:
+		return "symlink"
+	}
+	return fmt.Sprintf("file, %d bytes", fi.Size())
+}
+
+type MkdirRequest struct {
+	Path    string `json:"path"`
+	Parents bool   `json:"parents"`
+}
+
+// handleMkdir creates a directory, and with "parents": true any missing
+// directories above it, like mkdir -p.
+func handleMkdir(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req MkdirRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFileError(w, "Invalid request body: "+err.Error())
+		return
+	}
+
+	var target string
+	var err error
+	if req.Parents {
+		target, err = resolvePath(req.Path)
+	} else {
+		target, err = resolveEntryPath(req.Path)
+	}
+	if err != nil {
+		writeFileError(w, "Access denied: "+err.Error())
+		return
+	}
+
+	if req.Parents {
+		err = os.MkdirAll(target, 0755)
+	} else {
+		err = os.Mkdir(target, 0755)
+	}
+	audit.Record(r, "file.mkdir", displayPath(target), "", "", err)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			writeFileError(w, fmt.Sprintf("%s already exists", displayPath(target)))
+			return
+		}
+		writeFileError(w, "Failed to create directory: "+strings.TrimPrefix(err.Error(), "mkdir "))
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"file":    fileInfoFor(target),
+	})
+}
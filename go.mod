@@ -1,5 +1,26 @@
 module fmanager
 
-go 1.22.9
+go 1.23.0
 
-require github.com/joho/godotenv v1.5.1
+require (
+	cf-manager v0.0.0
+	github.com/joho/godotenv v1.5.1
+	golang.org/x/sys v0.33.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/go-ole/go-ole v1.2.6 // indirect
+	github.com/gorilla/mux v1.8.0 // indirect
+	github.com/lufia/plan9stats v0.0.0-20211012122336-39d0f177ccd0 // indirect
+	github.com/power-devops/perfstat v0.0.0-20210106213030-5aafc221ea8c // indirect
+	github.com/shirou/gopsutil/v3 v3.23.12 // indirect
+	github.com/shoenig/go-m1cpu v0.1.6 // indirect
+	github.com/tklauser/go-sysconf v0.3.12 // indirect
+	github.com/tklauser/numcpus v0.6.1 // indirect
+	github.com/yusufpapurcu/wmi v1.2.3 // indirect
+	golang.org/x/crypto v0.39.0 // indirect
+	golang.org/x/time v0.12.0 // indirect
+)
+
+replace cf-manager => ./GUI
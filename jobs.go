@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cf-manager/auth"
+)
+
+const (
+	JobRunning   = "running"
+	JobExited    = "exited"
+	JobCancelled = "cancelled"
+	JobTimedOut  = "timeout"
+	JobFailed    = "failed"
+	JobLimited   = "output_limit"
+
+	maxJobLines       = 5000
+	maxLineLength     = 64 * 1024
+	maxFinishedJobs   = 50
+	finishedJobTTL    = 30 * time.Minute
+	jobKillGrace      = 5 * time.Second
+	sseKeepAlive      = 15 * time.Second
+	timeoutExitCode   = 124
+	cancelledExitCode = 130
+	defaultJobTTL     = 10 * time.Minute
+	defaultMaxJobTTL  = 2 * time.Hour
+)
+
+// JobLine is one line of output. Seq numbers are per job and never reused, so
+// a client can resume a stream with Last-Event-ID.
+type JobLine struct {
+	Seq    int    `json:"seq"`
+	Stream string `json:"stream"`
+	Text   string `json:"text"`
+}
+
+// JobStatus is the JSON view of a job.
+type JobStatus struct {
+	ID           string     `json:"id"`
+	Command      string     `json:"command"`
+	Dir          string     `json:"dir"`
+	State        string     `json:"state"`
+	ExitCode     int        `json:"exitCode"`
+	Error        string     `json:"error,omitempty"`
+	Timeout      string     `json:"timeout"`
+	StartedAt    time.Time  `json:"startedAt"`
+	FinishedAt   *time.Time `json:"finishedAt,omitempty"`
+	Lines        int        `json:"lines"`
+	DroppedLines int        `json:"droppedLines,omitempty"`
+	Rule         string     `json:"rule,omitempty"`
+	Limits       Limits     `json:"limits"`
+}
+
+// Job is a command running in the background. Its output is kept in memory,
+// up to maxJobLines, for anyone streaming it.
+type Job struct {
+	ID        string
+	Command   string
+	Dir       string
+	Owner     string
+	Timeout   time.Duration
+	StartedAt time.Time
+	Rule      string
+	Limits    Limits
+
+	mu          sync.Mutex
+	outputBytes int
+	limited     bool
+	lines       []JobLine
+	dropped     int
+	nextSeq     int
+	state       string
+	exitCode    int
+	err         string
+	finishedAt  time.Time
+	cancelled   bool
+	cancel      context.CancelFunc
+	changed     chan struct{}
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = make(map[string]*Job)
+
+	jobTimeout    = defaultJobTTL
+	maxJobTimeout = defaultMaxJobTTL
+)
+
+// loadJobLimits reads FM_COMMAND_TIMEOUT, the timeout used when a command does
+// not ask for one, and FM_COMMAND_MAX_TIMEOUT, the most a command may ask for.
+func loadJobLimits() error {
+	if v := os.Getenv("FM_COMMAND_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid FM_COMMAND_TIMEOUT %q", v)
+		}
+		jobTimeout = d
+	}
+	if v := os.Getenv("FM_COMMAND_MAX_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid FM_COMMAND_MAX_TIMEOUT %q", v)
+		}
+		maxJobTimeout = d
+	}
+	if jobTimeout > maxJobTimeout {
+		jobTimeout = maxJobTimeout
+	}
+	return nil
+}
+
+// parseJobTimeout accepts a Go duration ("90s", "15m") or a plain number of
+// seconds. Empty means the default; anything above the maximum is capped.
+func parseJobTimeout(v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+	if v == "" || v == "0" {
+		return jobTimeout, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, serr := strconv.Atoi(v)
+		if serr != nil {
+			return 0, fmt.Errorf("invalid timeout %q", v)
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q", v)
+	}
+	if d > maxJobTimeout {
+		d = maxJobTimeout
+	}
+	return d, nil
+}
+
+// startJob runs cmdStr in dir in the background, under the limits the command
+// policy set, and returns right away.
+func startJob(cmdStr, dir, owner string, timeout time.Duration, decision Decision) (*Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	cmd := buildCommand(ctx, cmdStr, dir)
+	if cmd == nil {
+		cancel()
+		return nil, errors.New("command is empty")
+	}
+	cmd = withLimits(ctx, cmd, decision.Limits)
+
+	job := &Job{
+		ID:        id,
+		Command:   cmdStr,
+		Dir:       dir,
+		Owner:     owner,
+		Timeout:   timeout,
+		StartedAt: time.Now(),
+		Rule:      decision.Rule,
+		Limits:    decision.Limits,
+		state:     JobRunning,
+		cancel:    cancel,
+		changed:   make(chan struct{}),
+	}
+
+	stdout := &lineWriter{job: job, stream: "stdout"}
+	stderr := &lineWriter{job: job, stream: "stderr"}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	// Run in its own process group so cancelling also stops anything the
+	// shell started, then give it a moment before the pipes are closed.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = jobKillGrace
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	pruneJobs()
+	jobsMu.Lock()
+	jobs[id] = job
+	jobsMu.Unlock()
+
+	go func() {
+		defer cancel()
+		err := cmd.Wait()
+		stdout.flush()
+		stderr.flush()
+		job.finish(ctx, err)
+		status := job.Status()
+		log.Printf("Job %s (%s) finished: %s, exit code %d", job.ID, job.Command, status.State, status.ExitCode)
+	}()
+
+	return job, nil
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// getJob returns the job with id if it belongs to owner.
+func getJob(id, owner string) (*Job, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	job, ok := jobs[id]
+	if !ok || job.Owner != owner {
+		return nil, false
+	}
+	return job, true
+}
+
+// pruneJobs forgets finished jobs after finishedJobTTL and keeps at most
+// maxFinishedJobs of them.
+func pruneJobs() {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	var finished []*Job
+	for id, job := range jobs {
+		job.mu.Lock()
+		done, at := job.state != JobRunning, job.finishedAt
+		job.mu.Unlock()
+		if !done {
+			continue
+		}
+		if time.Since(at) > finishedJobTTL {
+			delete(jobs, id)
+			continue
+		}
+		finished = append(finished, job)
+	}
+
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].StartedAt.Before(finished[j].StartedAt)
+	})
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(jobs, job.ID)
+	}
+}
+
+func (j *Job) appendLine(stream, text string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.limited {
+		return
+	}
+	j.outputBytes += len(text) + 1
+	if j.Limits.OutputKB > 0 && j.outputBytes > j.Limits.OutputKB*1024 {
+		j.limited = true
+		text = fmt.Sprintf("[output limit of %d KB reached, stopping the command]", j.Limits.OutputKB)
+		stream = "system"
+		j.cancel()
+	}
+
+	j.lines = append(j.lines, JobLine{Seq: j.nextSeq, Stream: stream, Text: text})
+	j.nextSeq++
+	// Trim in batches so a chatty command does not copy the buffer per line
+	if len(j.lines) > maxJobLines+maxJobLines/10 {
+		drop := len(j.lines) - maxJobLines
+		j.lines = append([]JobLine(nil), j.lines[drop:]...)
+		j.dropped += drop
+	}
+	j.notifyLocked()
+}
+
+func (j *Job) notifyLocked() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+func (j *Job) finish(ctx context.Context, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.finishedAt = time.Now()
+	j.state = JobExited
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			j.exitCode = exitErr.ExitCode()
+		} else {
+			j.exitCode = 1
+			j.state = JobFailed
+		}
+		j.err = err.Error()
+	}
+
+	switch {
+	case j.limited:
+		j.state = JobLimited
+		j.err = fmt.Sprintf("output limit of %d KB reached", j.Limits.OutputKB)
+		if j.exitCode < 0 {
+			j.exitCode = cancelledExitCode
+		}
+	case j.cancelled:
+		j.state = JobCancelled
+		if j.exitCode < 0 {
+			j.exitCode = cancelledExitCode
+		}
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		j.state = JobTimedOut
+		j.exitCode = timeoutExitCode
+		j.err = fmt.Sprintf("command timed out after %s", j.Timeout)
+	}
+	j.notifyLocked()
+}
+
+// Cancel stops a running job. It reports false when the job already ended.
+func (j *Job) Cancel() bool {
+	j.mu.Lock()
+	if j.state != JobRunning {
+		j.mu.Unlock()
+		return false
+	}
+	j.cancelled = true
+	j.mu.Unlock()
+
+	j.cancel()
+	return true
+}
+
+// Status returns a snapshot of the job without its output.
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	s := JobStatus{
+		ID:           j.ID,
+		Command:      j.Command,
+		Dir:          displayPath(j.Dir),
+		State:        j.state,
+		ExitCode:     j.exitCode,
+		Error:        j.err,
+		Timeout:      j.Timeout.String(),
+		StartedAt:    j.StartedAt,
+		Lines:        j.nextSeq,
+		DroppedLines: j.dropped,
+		Rule:         j.Rule,
+		Limits:       j.Limits,
+	}
+	if !j.finishedAt.IsZero() {
+		at := j.finishedAt
+		s.FinishedAt = &at
+	}
+	return s
+}
+
+// linesSince returns the buffered lines with Seq >= from, whether the job has
+// ended, and a channel that is closed when anything changes.
+func (j *Job) linesSince(from int) ([]JobLine, bool, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	start := from - j.dropped
+	if start < 0 {
+		start = 0
+	}
+	var lines []JobLine
+	if start < len(j.lines) {
+		lines = append(lines, j.lines[start:]...)
+	}
+	return lines, j.state != JobRunning, j.changed
+}
+
+// lineWriter splits a process's output into lines for its job. Very long lines
+// are cut into maxLineLength pieces so one never grows without bound.
+type lineWriter struct {
+	job    *Job
+	stream string
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.job.appendLine(w.stream, strings.TrimSuffix(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	for len(w.buf) >= maxLineLength {
+		w.job.appendLine(w.stream, string(w.buf[:maxLineLength]))
+		w.buf = w.buf[maxLineLength:]
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.job.appendLine(w.stream, string(w.buf))
+		w.buf = nil
+	}
+}
+
+type StartJobRequest struct {
+	Command   string `json:"command"`
+	Path      string `json:"path"`
+	Timeout   string `json:"timeout"`
+	Confirmed bool   `json:"confirmed"`
+}
+
+// handleStartJob starts a command from the API:
+// {"command": "go build ./...", "path": "/home/projects", "timeout": "15m"}.
+// When the command policy asks for confirmation the reply carries the
+// decision, and the request must be repeated with "confirmed": true.
+func handleStartJob(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req StartJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+
+	req.Command = strings.TrimSpace(req.Command)
+	if req.Command == "" {
+		json.NewEncoder(w).Encode(map[string]string{"error": "Command is required"})
+		return
+	}
+
+	dir := defaultRoot()
+	if req.Path != "" {
+		resolved, err := resolvePath(req.Path)
+		if err != nil {
+			json.NewEncoder(w).Encode(map[string]string{"error": "Access denied: " + err.Error()})
+			return
+		}
+		dir = resolved
+	}
+
+	timeout, err := parseJobTimeout(req.Timeout)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	decision := checkCommand(r, req.Command, dir, req.Confirmed)
+	if decision.Action == PolicyDeny || (decision.Action == PolicyConfirm && !req.Confirmed) {
+		message := "Command denied by " + describeRule(decision)
+		if decision.Action == PolicyConfirm {
+			message = "Command needs confirmation: " + describeRule(decision)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":    message,
+			"decision": decision,
+		})
+		return
+	}
+	if isInteractiveCommand(req.Command) {
+		json.NewEncoder(w).Encode(map[string]string{"error": "Interactive commands need the shell at /terminal: " + req.Command})
+		return
+	}
+
+	job, err := startJob(req.Command, dir, auth.Username(r), timeout, decision)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to start command: " + err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(job.Status())
+}
+
+// handleListJobs lists the caller's jobs, newest first.
+func handleListJobs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	owner := auth.Username(r)
+	jobsMu.Lock()
+	list := make([]JobStatus, 0, len(jobs))
+	for _, job := range jobs {
+		if job.Owner == owner {
+			list = append(list, job.Status())
+		}
+	}
+	jobsMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartedAt.After(list[j].StartedAt)
+	})
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleCancelJob stops the job named by ?id=.
+func handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, ok := getJob(r.URL.Query().Get("id"), auth.Username(r))
+	if !ok {
+		json.NewEncoder(w).Encode(map[string]string{"error": "Job not found"})
+		return
+	}
+	if !job.Cancel() {
+		json.NewEncoder(w).Encode(map[string]string{"error": "Job has already finished"})
+		return
+	}
+	log.Printf("Job %s (%s) cancelled by %s", job.ID, job.Command, auth.Actor(r))
+	json.NewEncoder(w).Encode(job.Status())
+}
+
+// handleJobStream sends a job's output as Server-Sent Events. Every line is a
+// "stdout", "stderr" or, for notes from the server itself, "system" event
+// whose id is its Seq, so a reconnecting EventSource picks up where it left
+// off. A final "exit" event carries the job's status, after which the stream
+// ends.
+func handleJobStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, ok := getJob(r.URL.Query().Get("id"), auth.Username(r))
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	next := 0
+	if last, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil {
+		next = last + 1
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		lines, done, changed := job.linesSince(next)
+		for _, line := range lines {
+			data, _ := json.Marshal(line)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", line.Seq, line.Stream, data)
+			next = line.Seq + 1
+		}
+		if done {
+			data, _ := json.Marshal(job.Status())
+			fmt.Fprintf(w, "event: exit\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
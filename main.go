@@ -1,49 +1,27 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"io"
 	"io/ioutil"
-	"mime"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
-	"syscall"
 	"time"
 
-	"github.com/joho/godotenv"
-)
+	"cf-manager/audit"
+	"cf-manager/auth"
+	"cf-manager/certs"
+	"cf-manager/handlers"
 
-const (
-	geminiAPIURLBase   = "https://generativelanguage.googleapis.com/v1beta/models"
-	geminiAPIGenerate  = ":generateContent"
-	ErrInvalidResponse = "geminiclient: invalid response format from Gemini API: no candidates or parts found"
-	ErrEmptyInput      = "geminiclient: input text and fileURL cannot both be empty"
-	ErrMissingAPIKey   = "geminiclient: API key is required"
-	ErrMissingPrompt   = "geminiclient: system prompt is required"
+	"github.com/joho/godotenv"
 )
 
-type AISettings struct {
-	Temperature float64
-	TopK        int
-	TopP        float64
-	MaxTokens   int
-}
-
-type GeminiRequest struct {
-	Contents []Content `json:"contents"`
-}
-
 type Content struct {
 	Role  string `json:"role,omitempty"`
 	Parts []Part `json:"parts"`
@@ -53,22 +31,22 @@ type Part struct {
 	Text string `json:"text"`
 }
 
-type GeminiResponse struct {
-	Candidates []Candidate `json:"candidates"`
-}
-
-type Candidate struct {
-	Content Content `json:"content"`
-}
-
 type TemplateData struct {
+	CSRFToken       string
 	CurrentPath     string
+	DisplayPath     string
+	Roots           []FileRoot
 	Command         string
 	CommandExecuted bool
 	CommandName     string
 	IsExecutable    bool
 	FileType        string
 	IsInteractive   bool
+	JobID           string
+	Timeout         string
+	PolicyRule      string
+	PolicyDenied    bool
+	NeedsConfirm    bool
 	Output          string
 	Error           string
 	ExitCode        int
@@ -84,19 +62,13 @@ type DirEntry struct {
 	FileType     string
 	FullPath     string
 	ParentPath   string
+	DisplayPath  string
 }
 
-var codeFileExtensions = map[string]bool{
-	".go": true, ".sh": true, ".bash": true, ".js": true, ".ts": true,
-	".html": true, ".htm": true, ".css": true, ".scss": true, ".less": true,
-	".txt": true, ".log": true, ".md": true, ".json": true, ".yaml": true, ".yml": true,
-	".xml": true, ".toml": true, ".env": true, ".sql": true, ".py": true,
-	".c": true, ".cpp": true, ".h": true, ".hpp": true, ".java": true, ".rb": true,
-	".php": true, ".pl": true, ".pm": true, ".config": true, ".conf": true,
-	".gitignore": true, ".editorconfig": true, ".prettierrc": true,
-}
-
-var tmpl *template.Template
+var (
+	tmpl         *template.Template
+	terminalTmpl *template.Template
+)
 
 func main() {
 	err := godotenv.Load()
@@ -105,25 +77,133 @@ func main() {
 	}
 
 	var errTemplate error
+	if err := setupAuth(); err != nil {
+		fmt.Println("Error setting up authentication:", err)
+		os.Exit(1)
+	}
+
+	if err := loadAllowedRoots(); err != nil {
+		fmt.Println("Error loading file manager roots:", err)
+		os.Exit(1)
+	}
+
+	if err := loadJobLimits(); err != nil {
+		fmt.Println("Error loading command limits:", err)
+		os.Exit(1)
+	}
+
+	if err := loadUploadLimit(); err != nil {
+		fmt.Println("Error loading upload limit:", err)
+		os.Exit(1)
+	}
+
+	if err := loadArchiveLimits(); err != nil {
+		fmt.Println("Error loading archive limits:", err)
+		os.Exit(1)
+	}
+
+	if err := loadEditLimit(); err != nil {
+		fmt.Println("Error loading editor limit:", err)
+		os.Exit(1)
+	}
+
+	if err := loadVersionSettings(); err != nil {
+		fmt.Println("Error loading version history settings:", err)
+		os.Exit(1)
+	}
+
+	if err := loadPolicy(); err != nil {
+		fmt.Println("Error loading command policy:", err)
+		os.Exit(1)
+	}
+
+	if err := loadTerminalLimits(); err != nil {
+		fmt.Println("Error loading terminal limits:", err)
+		os.Exit(1)
+	}
+
+	if err := loadAIConfig(); err != nil {
+		fmt.Println("Error loading AI provider settings:", err)
+		os.Exit(1)
+	}
+
 	tmpl, errTemplate = template.ParseFiles("templates/index.html.tmpl")
 	if errTemplate != nil {
 		fmt.Println("Error loading template:", errTemplate)
 		os.Exit(1)
 	}
 
-	http.HandleFunc("/", handleMain)
-
-	os.Setenv("GEMINI_API_KEY", "")
-	fmt.Println("GEMINI_API_KEY set to:", os.Getenv("GEMINI_API_KEY"))
+	terminalTmpl, errTemplate = template.ParseFiles("templates/terminal.html.tmpl")
+	if errTemplate != nil {
+		fmt.Println("Error loading template:", errTemplate)
+		os.Exit(1)
+	}
 
-	http.HandleFunc("/api/gemini", handleGeminiAPI)
-	http.HandleFunc("/api/get-file", handleGetFile)
-	http.HandleFunc("/api/save-file", handleSaveFile)
+	http.HandleFunc("/login", handleLogin)
+	http.HandleFunc("/logout", handlers.LogoutHandler)
+	http.HandleFunc("/", requireAuth(requireCSRF(handleMain)))
+
+	http.HandleFunc("/api/gemini", requireAuth(requireCSRF(handleGeminiAPI)))
+	http.HandleFunc("/api/ai/stream", requireAuth(requireCSRF(handleAIStream)))
+	http.HandleFunc("/api/ai/providers", requireAuth(handleAIProviders))
+	http.HandleFunc("/api/ai/diagnose", requireAuth(requireCSRF(handleDiagnoseTunnel)))
+	http.HandleFunc("/api/tunnels", requireAuth(handleListTunnels))
+	http.HandleFunc("/api/ai/usage", requireAuth(handleAIUsage))
+	http.HandleFunc("/api/ai/keys", requireAuth(handleListAIKeys))
+	http.HandleFunc("/api/ai/keys/set", requireAuth(requireCSRF(handleSetAIKey)))
+	http.HandleFunc("/api/ai/keys/test", requireAuth(requireCSRF(handleTestAIKey)))
+	http.HandleFunc("/api/ai/keys/delete", requireAuth(requireCSRF(handleDeleteAIKey)))
+	http.HandleFunc("/api/ai/actions/approve", requireAuth(requireCSRF(handleApproveAIAction)))
+	http.HandleFunc("/api/ai/actions/reject", requireAuth(requireCSRF(handleRejectAIAction)))
+	http.HandleFunc("/api/ai/conversations", requireAuth(handleListAIConversations))
+	http.HandleFunc("/api/ai/conversations/get", requireAuth(handleGetAIConversation))
+	http.HandleFunc("/api/ai/conversations/rename", requireAuth(requireCSRF(handleRenameAIConversation)))
+	http.HandleFunc("/api/ai/conversations/delete", requireAuth(requireCSRF(handleDeleteAIConversation)))
+	http.HandleFunc("/api/ai/conversations/export", requireAuth(handleExportAIConversation))
+	http.HandleFunc("/api/get-file", requireAuth(handleGetFile))
+	http.HandleFunc("/api/save-file", requireAuth(requireCSRF(handleSaveFile)))
+	http.HandleFunc("/api/file-versions", requireAuth(handleFileVersions))
+	http.HandleFunc("/api/file-diff", requireAuth(handleFileDiff))
+	http.HandleFunc("/api/restore-version", requireAuth(requireCSRF(handleRestoreVersion)))
+	http.HandleFunc("/api/search", requireAuth(handleSearch))
+	http.HandleFunc("/api/upload", requireAuth(requireCSRF(handleUpload)))
+	http.HandleFunc("/api/download", requireAuth(handleDownload))
+	http.HandleFunc("/api/rename", requireAuth(requireCSRF(handleRename)))
+	http.HandleFunc("/api/delete", requireAuth(requireCSRF(handleDelete)))
+	http.HandleFunc("/api/mkdir", requireAuth(requireCSRF(handleMkdir)))
+	http.HandleFunc("/api/archive/create", requireAuth(requireCSRF(handleCreateArchive)))
+	http.HandleFunc("/api/archive/extract", requireAuth(requireCSRF(handleExtractArchive)))
+	http.HandleFunc("/api/archive/progress", requireAuth(handleArchiveProgress))
+	http.HandleFunc("/api/archive/cancel", requireAuth(requireCSRF(handleCancelArchive)))
+	http.HandleFunc("/api/jobs", requireAuth(handleListJobs))
+	http.HandleFunc("/api/jobs/start", requireAuth(requireCSRF(handleStartJob)))
+	http.HandleFunc("/api/jobs/stream", requireAuth(handleJobStream))
+	http.HandleFunc("/api/jobs/cancel", requireAuth(requireCSRF(handleCancelJob)))
+	http.HandleFunc("/terminal", requireAuth(handleTerminalPage))
+	http.HandleFunc("/api/terminal/ws", requireAuth(handleTerminalSocket))
+	http.HandleFunc("/api/terminal/sessions", requireAuth(handleListTerminals))
+	http.HandleFunc("/api/terminal/close", requireAuth(requireCSRF(handleCloseTerminal)))
+
+	port := os.Getenv("FM_PORT")
+	if port == "" {
+		port = "7676"
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		fmt.Println("Error reading FM_PORT:", strconv.Quote(port), "is not a port number between 1 and 65535")
+		os.Exit(1)
+	}
+	tlsConfig := certs.ConfigFromEnv("8443")
 
-	url := "http://localhost:76076"
+	url := "http://localhost:" + port
+	if tlsConfig.Enabled {
+		url = "https://localhost:" + tlsConfig.Port
+	}
 	fmt.Printf("Click here to open in your browser: %s\n", url)
 
-	http.ListenAndServe(":76076", nil)
+	if err := certs.ListenAndServe(nil, "", port, tlsConfig); err != nil {
+		fmt.Println("Server error:", err)
+		os.Exit(1)
+	}
 }
 
 func isInteractiveCommand(cmdStr string) bool {
@@ -171,17 +251,18 @@ func getFileType(path string) string {
 
 	content := string(buffer[:n])
 
-	if strings.HasPrefix(content, "#!/bin/bash") || strings.HasPrefix(content, "#!/usr/bin/bash") {
+	switch interp := shebangInterpreter(buffer[:n]); interp {
+	case "":
+	case "bash":
 		return "bash"
-	}
-	if strings.HasPrefix(content, "#!/bin/sh") || strings.HasPrefix(content, "#!/usr/bin/sh") {
+	case "sh":
 		return "shell"
-	}
-	if strings.HasPrefix(content, "#!/usr/bin/python") || strings.HasPrefix(content, "#!/bin/python") {
+	case "python", "python3":
 		return "python"
-	}
-	if strings.HasPrefix(content, "#!/usr/bin/node") || strings.HasPrefix(content, "#!/bin/node") {
+	case "node":
 		return "node"
+	default:
+		return interp
 	}
 
 	if len(buffer) >= 4 && buffer[0] == 0x7f && buffer[1] == 'E' && buffer[2] == 'L' && buffer[3] == 'F' {
@@ -195,21 +276,15 @@ func getFileType(path string) string {
 	return "executable"
 }
 
-func executeCommand(cmdStr, workDir string) (string, error, int, bool) {
-	if isInteractiveCommand(cmdStr) {
-		return "Interactive command detected: " + cmdStr + "\n\nNote: Interactive commands like nano, vim, ssh, etc. are not supported in this web terminal.\nUse non-interactive alternatives when possible.", nil, 0, true
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
+// buildCommand prepares cmdStr to run in workDir. Executable scripts are started
+// with their interpreter; everything else goes through sh -c. It returns nil for
+// an empty command.
+func buildCommand(ctx context.Context, cmdStr, workDir string) *exec.Cmd {
 	var cmd *exec.Cmd
-	var output bytes.Buffer
-	var stderr bytes.Buffer
 
 	parts := strings.Fields(cmdStr)
 	if len(parts) == 0 {
-		return "", nil, 0, false
+		return nil
 	}
 
 	cmdName := parts[0]
@@ -256,225 +331,33 @@ func executeCommand(cmdStr, workDir string) (string, error, int, bool) {
 	}
 
 	cmd.Dir = workDir
-
-	stdoutPipe, err := cmd.StdoutPipe()
-	if err != nil {
-		return "", err, 1, false
-	}
-
-	stderrPipe, err := cmd.StderrPipe()
-	if err != nil {
-		return "", err, 1, false
-	}
-
-	if err := cmd.Start(); err != nil {
-		return "", err, 1, false
-	}
-
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		scanner := bufio.NewScanner(stdoutPipe)
-		for scanner.Scan() {
-			output.WriteString(scanner.Text() + "\n")
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		scanner := bufio.NewScanner(stderrPipe)
-		for scanner.Scan() {
-			stderr.WriteString(scanner.Text() + "\n")
-		}
-	}()
-
-	err = cmd.Wait()
-	wg.Wait()
-
-	combinedOutput := output.String()
-	if stderr.Len() > 0 {
-		if combinedOutput != "" {
-			combinedOutput += "\n"
-		}
-		combinedOutput += stderr.String()
-	}
-
-	exitCode := 0
-	if err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			if status, ok := exitError.Sys().(syscall.WaitStatus); ok {
-				exitCode = status.ExitStatus()
-			}
-		} else if ctx.Err() == context.DeadlineExceeded {
-			return combinedOutput + "\n[Command timed out after 30 seconds]", err, 124, false
-		}
-	}
-
-	return combinedOutput, err, exitCode, false
-}
-
-func constructAPIURL(model string) string {
-	return fmt.Sprintf("%s/%s%s", geminiAPIURLBase, model, geminiAPIGenerate)
-}
-
-func handleError(err error, message string) error {
-	if err != nil {
-		return fmt.Errorf("%s: %v", message, err)
-	}
-	return nil
-}
-
-func createTextPart(text string) map[string]interface{} {
-	return map[string]interface{}{
-		"text": text,
-	}
-}
-
-func createFileDataPart(fileURLStr string) (map[string]interface{}, error) {
-	_, err := url.ParseRequestURI(fileURLStr)
-	if err != nil {
-		return nil, fmt.Errorf("invalid file URL: %v", err)
-	}
-
-	resp, err := http.Get(fileURLStr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch file from URL %s: %v", fileURLStr, err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to fetch file: status code %d. Response: %s", resp.StatusCode, string(bodyBytes))
-	}
-
-	fileData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file data: %v", err)
-	}
-
-	var mimeType string
-	headerMime := resp.Header.Get("Content-Type")
-	if parsedMime, _, err := mime.ParseMediaType(headerMime); err == nil && parsedMime != "" {
-		mimeType = parsedMime
-	}
-
-	if mimeType == "" || mimeType == "application/octet-stream" {
-		detectedMime := http.DetectContentType(fileData)
-		if parsedMime, _, err := mime.ParseMediaType(detectedMime); err == nil && parsedMime != "" {
-			mimeType = parsedMime
-		} else if detectedMime != "" {
-			mimeType = detectedMime
-		}
-	}
-
-	if mimeType == "" || mimeType == "application/octet-stream" {
-		parsedURL, _ := url.Parse(fileURLStr)
-		ext := filepath.Ext(parsedURL.Path)
-		guessedMime := mime.TypeByExtension(ext)
-		if guessedMime != "" {
-			mimeType = guessedMime
-		}
-	}
-
-	if mimeType == "" || mimeType == "application/octet-stream" {
-		mimeType = "application/octet-stream"
-	}
-
-	encodedData := base64.StdEncoding.EncodeToString(fileData)
-
-	return map[string]interface{}{
-		"inline_data": map[string]interface{}{
-			"mime_type": mimeType,
-			"data":      encodedData,
-		},
-	}, nil
-}
-
-func sendToGeminiAPIInternal(apiKey, systemPrompt string, currentHistory []map[string]interface{}, settings AISettings) (string, error) {
-	if apiKey == "" {
-		return "", fmt.Errorf(ErrMissingAPIKey)
-	}
-	if systemPrompt == "" {
-		return "", fmt.Errorf(ErrMissingPrompt)
-	}
-	if len(currentHistory) == 0 {
-		return "", fmt.Errorf("geminiclient: cannot send empty history to Gemini API")
-	}
-
-	genConfig := map[string]interface{}{
-		"temperature":     settings.Temperature,
-		"maxOutputTokens": settings.MaxTokens,
-	}
-	if settings.TopK > 0 {
-		genConfig["topK"] = settings.TopK
-	}
-	if settings.TopP > 0.0 {
-		genConfig["topP"] = settings.TopP
-	}
-
-	payload := map[string]interface{}{
-		"contents":         currentHistory,
-		"generationConfig": genConfig,
-		"system_instruction": map[string]interface{}{
-			"parts": []map[string]interface{}{
-				{"text": systemPrompt},
-			},
-		},
-	}
-
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		return "", handleError(err, "geminiclient: failed to marshal payload")
-	}
-
-	requestURL := fmt.Sprintf("%s?key=%s", constructAPIURL("gemini-2.0-flash"), apiKey)
-
-	resp, err := http.Post(requestURL, "application/json", bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		return "", handleError(err, "geminiclient: failed to send request to Gemini API")
-	}
-	defer resp.Body.Close()
-
-	responseBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", handleError(err, "geminiclient: failed to read response body")
-	}
-
-	if resp.StatusCode >= 400 {
-		return "", fmt.Errorf("geminiclient: Gemini API request failed with status %d: %s", resp.StatusCode, string(responseBody))
-	}
-
-	var geminiResponse GeminiResponse
-	if err := json.Unmarshal(responseBody, &geminiResponse); err != nil {
-		return "", handleError(err, "geminiclient: failed to decode Gemini API response")
-	}
-
-	if len(geminiResponse.Candidates) > 0 &&
-		len(geminiResponse.Candidates[0].Content.Parts) > 0 &&
-		geminiResponse.Candidates[0].Content.Parts[0].Text != "" {
-		return geminiResponse.Candidates[0].Content.Parts[0].Text, nil
-	}
-
-	return "", fmt.Errorf(ErrInvalidResponse)
+	return cmd
 }
 
 func handleMain(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
 	data := TemplateData{
-		CurrentPath: "/data/data/com.termux/files/home",
+		CSRFToken:   auth.CSRFToken(r),
+		CurrentPath: defaultRoot(),
+		Roots:       allowedRoots,
 	}
 
-	queryPath := r.URL.Query().Get("path")
+	queryPath := r.FormValue("path")
 	if queryPath != "" {
-		data.CurrentPath = queryPath
+		resolved, err := resolvePath(queryPath)
+		if err != nil {
+			data.DirError = err.Error()
+		} else {
+			data.CurrentPath = resolved
+		}
 	}
 
-	data.CurrentPath = filepath.Clean(data.CurrentPath)
-
-	cmdStr := strings.TrimSpace(r.URL.Query().Get("cmd"))
+	// Commands only run from a POSTed form, which requireCSRF has already checked
+	cmdStr := ""
+	if r.Method == "POST" {
+		cmdStr = strings.TrimSpace(r.PostFormValue("cmd"))
+	}
 
 	if cmdStr != "" {
 		data.Command = cmdStr
@@ -487,12 +370,14 @@ func handleMain(w http.ResponseWriter, r *http.Request) {
 			}
 			target = filepath.Clean(target)
 
-			if fi, err := os.Stat(target); err == nil && fi.IsDir() {
-				// A simple check to prevent 'cd ../../..' out of the base,
-				// but this needs a defined base directory for robustness.
-				// For now, just setting the path.
-				data.CurrentPath = target // Update path if cd is successful
-				data.Output = "Changed directory to: " + data.CurrentPath
+			resolved, resolveErr := resolvePath(target)
+			if resolveErr == errOutsideRoots {
+				data.Output = "cd: permission denied: " + target + " is outside the allowed roots"
+				data.Error = data.Output
+				data.ExitCode = 1
+			} else if fi, err := os.Stat(resolved); resolveErr == nil && err == nil && fi.IsDir() {
+				data.CurrentPath = resolved // Update path if cd is successful
+				data.Output = "Changed directory to: " + displayPath(data.CurrentPath)
 				data.ExitCode = 0
 			} else {
 				data.Output = "cd: no such directory: " + target
@@ -502,15 +387,33 @@ func handleMain(w http.ResponseWriter, r *http.Request) {
 			data.IsInteractive = false
 
 		} else {
-			output, cmdErr, exitCode, isInteractive := executeCommand(cmdStr, data.CurrentPath)
+			data.Timeout = r.PostFormValue("timeout")
+			// The policy applies to interactive commands too, before the
+			// page offers to open them in the shell.
+			confirmed := r.PostFormValue("confirmed") == "yes"
+			decision := checkCommand(r, cmdStr, data.CurrentPath, confirmed)
+			if decision.Rule != "" || decision.Action != PolicyAllow {
+				data.PolicyRule = describeRule(decision)
+			}
 
-			data.Output = output
-			data.Error = ""
-			if cmdErr != nil {
-				data.Error = cmdErr.Error()
+			if decision.Action == PolicyDeny {
+				data.PolicyDenied = true
+				data.ExitCode = 126
+			} else if decision.Action == PolicyConfirm && !confirmed {
+				data.NeedsConfirm = true
+			} else if isInteractiveCommand(cmdStr) {
+				data.IsInteractive = true
+				data.Output = "Interactive command detected: " + cmdStr + "\n\nPrograms like nano, vim, htop and ssh need a real terminal. Open the interactive shell to run them."
+			} else if timeout, err := parseJobTimeout(data.Timeout); err != nil {
+				data.Error = err.Error()
+				data.ExitCode = 1
+			} else if job, err := startJob(cmdStr, data.CurrentPath, auth.Username(r), timeout, decision); err != nil {
+				data.Error = err.Error()
+				data.ExitCode = 1
+			} else {
+				// The page streams the output from /api/jobs/stream
+				data.JobID = job.ID
 			}
-			data.ExitCode = exitCode
-			data.IsInteractive = isInteractive
 
 			parts := strings.Fields(cmdStr)
 			if len(parts) > 0 {
@@ -532,10 +435,12 @@ func handleMain(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	data.DisplayPath = displayPath(data.CurrentPath)
+
 	entries, err := ioutil.ReadDir(data.CurrentPath)
 	if err != nil {
 		data.DirError = err.Error()
-	} else {
+	} else if data.DirError == "" {
 		data.Entries = make([]DirEntry, 0, len(entries))
 		for _, e := range entries {
 			name := e.Name()
@@ -543,10 +448,11 @@ func handleMain(w http.ResponseWriter, r *http.Request) {
 			fullPath = filepath.Clean(fullPath)
 
 			entryData := DirEntry{
-				Name:       name,
-				IsDir:      e.IsDir(),
-				FullPath:   fullPath,
-				ParentPath: data.CurrentPath,
+				Name:        name,
+				IsDir:       e.IsDir(),
+				FullPath:    fullPath,
+				ParentPath:  data.CurrentPath,
+				DisplayPath: displayPath(fullPath),
 			}
 
 			if !e.IsDir() {
@@ -554,8 +460,8 @@ func handleMain(w http.ResponseWriter, r *http.Request) {
 				if entryData.IsExecutable {
 					entryData.FileType = getFileType(fullPath)
 				} else {
-					ext := strings.ToLower(filepath.Ext(name))
-					entryData.IsEditable = codeFileExtensions[ext]
+					_, err := checkEditable(fullPath, listingSniffSize)
+					entryData.IsEditable = err == nil
 				}
 			}
 
@@ -585,27 +491,26 @@ func handleGetFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filePath = filepath.Clean(filePath)
-
-	info, err := os.Stat(filePath)
+	filePath, err := resolvePath(filePath)
 	if err != nil {
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "File not found or accessible: " + err.Error(),
+			"error": "Access denied: " + err.Error(),
 		})
 		return
 	}
 
-	if info.IsDir() {
+	info, err := os.Stat(filePath)
+	if err != nil {
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Cannot edit a directory",
+			"error": "File not found or accessible: " + err.Error(),
 		})
 		return
 	}
 
-	ext := strings.ToLower(filepath.Ext(filePath))
-	if !codeFileExtensions[ext] {
+	language, err := checkEditable(filePath, editSniffSize)
+	if err != nil {
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": fmt.Sprintf("Cannot edit binary or non-code file type: %s", ext),
+			"error": err.Error(),
 		})
 		return
 	}
@@ -618,14 +523,34 @@ func handleGetFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The sniff only saw the start; JSON would quietly replace invalid UTF-8
+	// further in, and saving would then corrupt the file
+	if !looksLikeText(content, false) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Cannot edit a binary file",
+		})
+		return
+	}
+
+	etag := fileETag(content)
+	w.Header().Set("ETag", etag)
 	json.NewEncoder(w).Encode(map[string]string{
-		"content": string(content),
+		"content":     string(content),
+		"path":        filePath,
+		"displayPath": displayPath(filePath),
+		"etag":        etag,
+		"modTime":     info.ModTime().UTC().Format(time.RFC3339Nano),
+		"language":    language,
 	})
 }
 
+// SaveFileRequest carries the ETag the editor loaded the file with; a save is
+// refused when the file has changed since. An empty ETag overwrites whatever
+// is on disk.
 type SaveFileRequest struct {
 	Path    string `json:"path"`
 	Content string `json:"content"`
+	ETag    string `json:"etag"`
 }
 
 func handleSaveFile(w http.ResponseWriter, r *http.Request) {
@@ -662,6 +587,14 @@ func handleSaveFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	filePath, err := resolvePath(filePath)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Access denied: " + err.Error(),
+		})
+		return
+	}
+
 	info, err := os.Stat(filePath)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -683,111 +616,29 @@ func handleSaveFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ext := strings.ToLower(filepath.Ext(filePath))
-	if !codeFileExtensions[ext] {
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": fmt.Sprintf("Cannot save binary or non-code file type: %s", ext),
-		})
-		return
-	}
-
-	err = ioutil.WriteFile(filePath, []byte(content), 0644)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to write file: " + err.Error(),
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]bool{
-		"success": true,
-	})
-}
-
-func handleGeminiAPI(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	apiKey := os.Getenv("GEMINI_API_KEY")
-	if apiKey == "" {
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "GEMINI_API_KEY environment variable not set. Please set it with your Google AI Studio API key.",
-		})
-		return
-	}
-
-	var req GeminiRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if _, err := checkEditable(filePath, editSniffSize); err != nil {
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Invalid request format: " + err.Error(),
+			"error": err.Error(),
 		})
 		return
 	}
 
-	if len(req.Contents) == 0 {
+	if int64(len(content)) > maxEditSize {
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Invalid request format: 'contents' array is empty",
+			"error": fmt.Sprintf("Content is too large to save (the limit is %d KB)", maxEditSize>>10),
 		})
 		return
 	}
 
-	geminiReq := req
-
-	reqBody, err := json.Marshal(geminiReq)
+	etag, err := replaceFile(filePath, req.ETag, []byte(content))
+	audit.Record(r, "file.save", displayPath(filePath), "", "", err)
 	if err != nil {
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to prepare request",
-		})
+		writeReplaceError(w, etag, err)
 		return
 	}
 
-	url := "https://generativelanguage.googleapis.com/v1beta/models/gemini-2.0-flash:generateContent?key=" + apiKey
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(reqBody))
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to connect to Gemini API: " + err.Error(),
-		})
-		return
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to read response",
-		})
-		return
-	}
-
-	if resp.StatusCode != 200 {
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Gemini API error: " + string(body),
-		})
-		return
-	}
-
-	var geminiResp GeminiResponse
-	if err := json.Unmarshal(body, &geminiResp); err != nil {
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to parse Gemini response",
-		})
-		return
-	}
-
-	if len(geminiResp.Candidates) == 0 ||
-		len(geminiResp.Candidates[0].Content.Parts) == 0 ||
-		geminiResp.Candidates[0].Content.Parts[0].Text == "" {
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": ErrInvalidResponse,
-		})
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]string{
-		"response": geminiResp.Candidates[0].Content.Parts[0].Text,
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"etag":    etag,
 	})
 }
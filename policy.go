@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-manager/audit"
+	"cf-manager/auth"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PolicyAllow   = "allow"
+	PolicyDeny    = "deny"
+	PolicyConfirm = "confirm"
+
+	defaultPolicyFile = "policy.yaml"
+)
+
+// defaultPolicyYAML is used when there is no policy file. Copy
+// policy.default.yaml to policy.yaml (or FM_POLICY_FILE) to change it.
+//
+//go:embed policy.default.yaml
+var defaultPolicyYAML []byte
+
+// Limits caps what a single process started by a command may use. Zero means
+// unlimited. CPU time and memory are applied with ulimit, so they hold for
+// every process the command starts; output counts stdout and stderr together.
+type Limits struct {
+	CPUSeconds int `yaml:"cpu_seconds" json:"cpuSeconds,omitempty"`
+	MemoryMB   int `yaml:"memory_mb" json:"memoryMB,omitempty"`
+	OutputKB   int `yaml:"output_kb" json:"outputKB,omitempty"`
+}
+
+// PolicyRule matches a simple command by executable name (shell globs on the
+// base name), by a regular expression over its arguments, and by working
+// directory (globs, or "/dir/**" for a whole tree). Empty fields match
+// anything.
+type PolicyRule struct {
+	Name       string     `yaml:"name"`
+	Action     string     `yaml:"action"`
+	Executable stringList `yaml:"executable"`
+	Args       string     `yaml:"args"`
+	Dir        stringList `yaml:"dir"`
+	Reason     string     `yaml:"reason"`
+	Limits     *Limits    `yaml:"limits"`
+
+	args *regexp.Regexp
+}
+
+// Policy is the parsed policy file. Rules are tried in order and the first one
+// that matches decides; commands no rule matches get Default. Shell controls
+// whether the interactive terminal, which no rule can inspect, is available.
+type Policy struct {
+	Default string       `yaml:"default"`
+	Shell   string       `yaml:"shell"`
+	Limits  Limits       `yaml:"limits"`
+	Rules   []PolicyRule `yaml:"rules"`
+}
+
+// Decision is the outcome of checking one command line.
+type Decision struct {
+	Action  string `json:"action"`
+	Rule    string `json:"rule,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Command string `json:"command,omitempty"`
+	Limits  Limits `json:"limits"`
+}
+
+// stringList accepts either a single YAML string or a list of them.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*l = stringList{node.Value}
+		return nil
+	}
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+var (
+	policyMu      sync.Mutex
+	policy        *Policy
+	policyPath    string
+	policyModTime time.Time
+)
+
+// loadPolicy reads FM_POLICY_FILE, or policy.yaml, falling back to the
+// built-in default policy when the file does not exist.
+func loadPolicy() error {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+
+	policyPath = os.Getenv("FM_POLICY_FILE")
+	if policyPath == "" {
+		policyPath = defaultPolicyFile
+	}
+	return reloadPolicyLocked()
+}
+
+func reloadPolicyLocked() error {
+	data, err := os.ReadFile(policyPath)
+	modTime := time.Time{}
+	source := policyPath
+	if os.IsNotExist(err) {
+		data = defaultPolicyYAML
+		source = "built-in default policy"
+	} else if err != nil {
+		return err
+	} else if fi, err := os.Stat(policyPath); err == nil {
+		modTime = fi.ModTime()
+	}
+
+	p, err := parsePolicy(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", source, err)
+	}
+	policy = p
+	policyModTime = modTime
+	log.Printf("Loaded command policy from %s: %d rules, default %s", source, len(p.Rules), p.Default)
+	return nil
+}
+
+// currentPolicy returns the policy, first reloading the file if it was edited.
+// A broken edit is logged and the previous policy stays in force.
+func currentPolicy() *Policy {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+
+	var modTime time.Time
+	if fi, err := os.Stat(policyPath); err == nil {
+		modTime = fi.ModTime()
+	}
+	if !modTime.Equal(policyModTime) {
+		if err := reloadPolicyLocked(); err != nil {
+			log.Printf("Keeping the previous command policy, failed to reload: %v", err)
+			policyModTime = modTime
+		}
+	}
+	return policy
+}
+
+func parsePolicy(data []byte) (*Policy, error) {
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+
+	if p.Default == "" {
+		p.Default = PolicyAllow
+	}
+	if !validAction(p.Default) {
+		return nil, fmt.Errorf("invalid default %q (want allow, deny or confirm)", p.Default)
+	}
+	if p.Shell == "" {
+		p.Shell = PolicyAllow
+	}
+	if p.Shell != PolicyAllow && p.Shell != PolicyDeny {
+		return nil, fmt.Errorf("invalid shell %q (want allow or deny)", p.Shell)
+	}
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if !validAction(rule.Action) {
+			return nil, fmt.Errorf("%s: invalid action %q (want allow, deny or confirm)", rule.Name, rule.Action)
+		}
+		for _, pattern := range append(append([]string{}, rule.Executable...), rule.Dir...) {
+			if _, err := filepath.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil {
+				return nil, fmt.Errorf("%s: bad pattern %q", rule.Name, pattern)
+			}
+		}
+		if rule.Args != "" {
+			re, err := regexp.Compile(rule.Args)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad args pattern: %v", rule.Name, err)
+			}
+			rule.args = re
+		}
+	}
+	return &p, nil
+}
+
+func validAction(a string) bool {
+	return a == PolicyAllow || a == PolicyDeny || a == PolicyConfirm
+}
+
+// Evaluate checks every simple command in cmdStr, including those in pipes,
+// lists and command substitutions, and returns the strictest outcome: deny
+// beats confirm beats allow. The command line gets the most generous limit
+// that any of its parts is allowed, since ulimit applies to all of them.
+//
+// This is a guard against mistakes, not a sandbox: a determined user can hide
+// a command from any parser that does not run the shell itself.
+func (p *Policy) Evaluate(cmdStr, dir string) Decision {
+	result := Decision{Action: PolicyAllow, Limits: p.Limits}
+	first := true
+
+	for _, words := range splitCommand(cmdStr) {
+		words = stripWrappers(words)
+		if len(words) == 0 {
+			continue
+		}
+
+		d := Decision{Action: p.Default, Command: strings.Join(words, " "), Limits: p.Limits}
+		if rule, ok := p.match(words, dir); ok {
+			d.Action = rule.Action
+			d.Rule = rule.Name
+			d.Reason = rule.Reason
+			if rule.Limits != nil {
+				d.Limits = mergeLimits(p.Limits, *rule.Limits)
+			}
+		}
+
+		if first {
+			result = d
+			first = false
+			continue
+		}
+		limits := looserLimits(result.Limits, d.Limits)
+		if severity(d.Action) > severity(result.Action) {
+			result = d
+		}
+		result.Limits = limits
+	}
+	return result
+}
+
+func (p *Policy) match(words []string, dir string) (*PolicyRule, bool) {
+	exe := filepath.Base(words[0])
+	args := strings.Join(words[1:], " ")
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if len(rule.Executable) > 0 && !matchAny(rule.Executable, exe, false) {
+			continue
+		}
+		if rule.args != nil && !rule.args.MatchString(args) {
+			continue
+		}
+		if len(rule.Dir) > 0 && !matchAny(rule.Dir, dir, true) {
+			continue
+		}
+		return rule, true
+	}
+	return nil, false
+}
+
+func matchAny(patterns []string, value string, isDir bool) bool {
+	for _, pattern := range patterns {
+		if isDir && strings.HasSuffix(pattern, "/**") {
+			if isWithin(strings.TrimSuffix(pattern, "/**"), value) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func severity(action string) int {
+	switch action {
+	case PolicyDeny:
+		return 2
+	case PolicyConfirm:
+		return 1
+	}
+	return 0
+}
+
+// mergeLimits overrides the defaults with whatever a rule sets.
+func mergeLimits(base, override Limits) Limits {
+	if override.CPUSeconds != 0 {
+		base.CPUSeconds = override.CPUSeconds
+	}
+	if override.MemoryMB != 0 {
+		base.MemoryMB = override.MemoryMB
+	}
+	if override.OutputKB != 0 {
+		base.OutputKB = override.OutputKB
+	}
+	return base
+}
+
+func looserLimits(a, b Limits) Limits {
+	looser := func(x, y int) int {
+		if x == 0 || y == 0 {
+			return 0
+		}
+		if x > y {
+			return x
+		}
+		return y
+	}
+	return Limits{
+		CPUSeconds: looser(a.CPUSeconds, b.CPUSeconds),
+		MemoryMB:   looser(a.MemoryMB, b.MemoryMB),
+		OutputKB:   looser(a.OutputKB, b.OutputKB),
+	}
+}
+
+// splitCommand breaks a shell command line into simple commands, each a list
+// of words with quotes removed. It splits on ; & | && || newlines and
+// parentheses, treats $(...) and `...` as commands of their own, and drops
+// redirections such as 2>&1 or >file.
+func splitCommand(s string) [][]string {
+	var (
+		segments   [][]string
+		words      []string
+		word       strings.Builder
+		inWord     bool
+		single     bool
+		double     bool
+		backtick   bool
+		skipTarget bool
+		subStack   []bool
+	)
+
+	endWord := func() {
+		if !inWord {
+			return
+		}
+		if skipTarget {
+			skipTarget = false
+		} else {
+			words = append(words, word.String())
+		}
+		word.Reset()
+		inWord = false
+	}
+	endSegment := func() {
+		endWord()
+		if len(words) > 0 {
+			segments = append(segments, words)
+			words = nil
+		}
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case single:
+			if c == '\'' {
+				single = false
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\\' && i+1 < len(s):
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		case c == '$' && i+1 < len(s) && s[i+1] == '(':
+			// $(( arithmetic )) is not a command, but splitting it is harmless
+			i++
+			endSegment()
+			subStack = append(subStack, double)
+			double = false
+		case c == ')' && len(subStack) > 0 && !double:
+			endSegment()
+			double = subStack[len(subStack)-1]
+			subStack = subStack[:len(subStack)-1]
+		case c == '`':
+			endSegment()
+			if backtick && len(subStack) > 0 {
+				double = subStack[len(subStack)-1]
+				subStack = subStack[:len(subStack)-1]
+			} else if !backtick {
+				subStack = append(subStack, double)
+				double = false
+			}
+			backtick = !backtick
+		case double:
+			if c == '"' {
+				double = false
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\'':
+			single = true
+			inWord = true
+		case c == '"':
+			double = true
+			inWord = true
+		case c == '>' || c == '<' || (c == '&' && i+1 < len(s) && s[i+1] == '>'):
+			// A file descriptor number right before the operator is not a word
+			if inWord && isDigits(word.String()) {
+				word.Reset()
+				inWord = false
+			}
+			endWord()
+			for i+1 < len(s) && strings.IndexByte("<>&|", s[i+1]) >= 0 {
+				i++
+			}
+			// The next word is the file or descriptor being redirected to
+			skipTarget = true
+		case c == ';' || c == '&' || c == '|' || c == '\n' || c == '(' || c == ')':
+			endSegment()
+		case c == ' ' || c == '\t':
+			endWord()
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	endSegment()
+	return segments
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+var commandWrappers = map[string]bool{
+	"sudo": true, "env": true, "nohup": true, "time": true, "nice": true,
+	"command": true, "builtin": true, "exec": true, "xargs": true, "timeout": true,
+	"!": true, "{": true, "}": true, "if": true, "then": true, "else": true,
+	"elif": true, "while": true, "until": true, "do": true,
+}
+
+// stripWrappers drops leading VAR=value assignments, shell keywords and
+// commands like sudo or nohup that only run the next word, along with their
+// options, so rules see the program that actually runs.
+func stripWrappers(words []string) []string {
+	for len(words) > 0 {
+		w := words[0]
+		switch {
+		case strings.Contains(w, "=") && !strings.HasPrefix(w, "=") && !strings.ContainsAny(strings.SplitN(w, "=", 2)[0], "/-."):
+			words = words[1:]
+		case commandWrappers[w]:
+			words = words[1:]
+			for len(words) > 0 && strings.HasPrefix(words[0], "-") {
+				words = words[1:]
+			}
+			// timeout takes a duration before the command
+			if w == "timeout" && len(words) > 0 {
+				words = words[1:]
+			}
+		default:
+			return words
+		}
+	}
+	return words
+}
+
+// checkCommand evaluates cmdStr and records the decision in the log and the
+// audit trail. Commands that need confirmation are only logged as such until
+// the user confirms.
+func checkCommand(r *http.Request, cmdStr, dir string, confirmed bool) Decision {
+	d := currentPolicy().Evaluate(cmdStr, dir)
+
+	outcome := d.Action
+	var err error
+	switch {
+	case d.Action == PolicyDeny:
+		err = fmt.Errorf("denied by %s", describeRule(d))
+	case d.Action == PolicyConfirm && !confirmed:
+		outcome = "confirm-required"
+		err = errors.New("waiting for confirmation")
+	case d.Action == PolicyConfirm:
+		outcome = "confirmed"
+	}
+
+	log.Printf("Command policy %s for %s in %s: %q (%s)", outcome, auth.Actor(r), displayPath(dir), cmdStr, describeRule(d))
+	audit.Record(r, "command."+outcome, cmdStr, displayPath(dir), describeRule(d), err)
+	return d
+}
+
+func describeRule(d Decision) string {
+	if d.Rule == "" {
+		return "default policy"
+	}
+	if d.Reason != "" {
+		return fmt.Sprintf("rule %q: %s", d.Rule, d.Reason)
+	}
+	return fmt.Sprintf("rule %q", d.Rule)
+}
+
+// withLimits re-runs cmd under sh with ulimit applied first. exec "$@" keeps
+// the original argument list intact, quoting and all.
+func withLimits(ctx context.Context, cmd *exec.Cmd, limits Limits) *exec.Cmd {
+	var script []string
+	if limits.CPUSeconds > 0 {
+		script = append(script, fmt.Sprintf("ulimit -t %d", limits.CPUSeconds))
+	}
+	if limits.MemoryMB > 0 {
+		script = append(script, fmt.Sprintf("ulimit -v %d", limits.MemoryMB*1024))
+	}
+	if len(script) == 0 {
+		return cmd
+	}
+
+	args := append([]string{"-c", strings.Join(script, " && ") + ` && exec "$@"`, "sh", cmd.Path}, cmd.Args[1:]...)
+	wrapped := exec.CommandContext(ctx, "sh", args...)
+	wrapped.Dir = cmd.Dir
+	return wrapped
+}
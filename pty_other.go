@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errPTYUnsupported = errors.New("interactive terminals are only supported on Linux and Android")
+
+func openPTY() (*os.File, *os.File, error) {
+	return nil, nil, errPTYUnsupported
+}
+
+func setPTYSize(master *os.File, cols, rows int) error {
+	return errPTYUnsupported
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const defaultHomePath = "/data/data/com.termux/files/home"
+
+// Dangling symlinks followed by resolvePath before it gives up, the limit
+// the kernel uses.
+const maxSymlinkHops = 40
+
+var (
+	errOutsideRoots = errors.New("path is outside the allowed roots")
+	errSymlinkLoop  = errors.New("too many levels of symbolic links")
+)
+
+// FileRoot is one directory tree the file manager may browse and edit.
+type FileRoot struct {
+	Name string
+	Path string
+}
+
+var allowedRoots []FileRoot
+
+// loadAllowedRoots reads FM_ROOTS, a list of directories separated by ':' like
+// PATH, and resolves each one. Without FM_ROOTS the home directory is the only
+// root.
+func loadAllowedRoots() error {
+	list := os.Getenv("FM_ROOTS")
+	if list == "" {
+		home, err := os.UserHomeDir()
+		if err != nil || home == "" {
+			home = defaultHomePath
+		}
+		list = home
+	}
+
+	allowedRoots = nil
+	seen := make(map[string]bool)
+	for _, p := range filepath.SplitList(list) {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(filepath.Clean(p))
+		if err != nil {
+			return fmt.Errorf("invalid root %s: %v", p, err)
+		}
+		resolved, err = filepath.Abs(resolved)
+		if err != nil {
+			return fmt.Errorf("invalid root %s: %v", p, err)
+		}
+		if fi, err := os.Stat(resolved); err != nil || !fi.IsDir() {
+			return fmt.Errorf("root %s is not a directory", p)
+		}
+		if seen[resolved] {
+			continue
+		}
+		seen[resolved] = true
+
+		name := filepath.Base(resolved)
+		if name == string(filepath.Separator) {
+			name = "root"
+		}
+		allowedRoots = append(allowedRoots, FileRoot{Name: name, Path: resolved})
+	}
+
+	if len(allowedRoots) == 0 {
+		return errors.New("FM_ROOTS does not contain any directory")
+	}
+	return nil
+}
+
+// defaultRoot is where the browser starts.
+func defaultRoot() string {
+	return allowedRoots[0].Path
+}
+
+// resolvePath turns a user supplied path into a clean absolute path with all
+// symlinks evaluated and checks that it lies inside an allowed root. Relative
+// paths are taken relative to the default root. When the path does not exist
+// yet, the nearest existing parent is resolved instead so new files can be
+// created, but never through a symlink, dangling ones included, that points
+// outside the roots.
+func resolvePath(p string) (string, error) {
+	return resolvePathHops(p, 0)
+}
+
+// resolvePathHops is resolvePath after following hops dangling symlinks.
+func resolvePathHops(p string, hops int) (string, error) {
+	if p == "" {
+		return "", errors.New("path is required")
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(defaultRoot(), p)
+	}
+	p = filepath.Clean(p)
+
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		// Resolve the deepest existing ancestor and re-append the rest
+		parent, rest := p, ""
+		for {
+			dir := filepath.Dir(parent)
+			rest = filepath.Join(filepath.Base(parent), rest)
+			parent = dir
+			if resolvedParent, perr := filepath.EvalSymlinks(parent); perr == nil {
+				// The first missing name can be a dangling symlink, and
+				// creating the file would follow it: resolve its target
+				first, after, _ := strings.Cut(rest, string(filepath.Separator))
+				link := filepath.Join(resolvedParent, first)
+				if fi, lerr := os.Lstat(link); lerr == nil && fi.Mode()&os.ModeSymlink != 0 {
+					if hops >= maxSymlinkHops {
+						return "", errSymlinkLoop
+					}
+					target, rerr := os.Readlink(link)
+					if rerr != nil {
+						return "", rerr
+					}
+					if !filepath.IsAbs(target) {
+						target = filepath.Join(resolvedParent, target)
+					}
+					return resolvePathHops(filepath.Join(target, after), hops+1)
+				}
+				resolved = filepath.Join(resolvedParent, rest)
+				break
+			}
+			if dir == filepath.Dir(dir) {
+				return "", err
+			}
+		}
+	}
+
+	if _, ok := rootFor(resolved); !ok {
+		return "", errOutsideRoots
+	}
+	return resolved, nil
+}
+
+// resolveEntryPath is resolvePath for operations on a directory entry itself,
+// such as delete or rename: the parent is resolved, but a final symlink is
+// not followed, so removing a link never removes what it points to. Roots
+// themselves are refused.
+func resolveEntryPath(p string) (string, error) {
+	if p == "" {
+		return "", errors.New("path is required")
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(defaultRoot(), p)
+	}
+	p = filepath.Clean(p)
+
+	name := filepath.Base(p)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+
+	parent, err := resolvePath(filepath.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	entry := filepath.Join(parent, name)
+	for _, root := range allowedRoots {
+		if entry == root.Path {
+			return "", errors.New("the root directory itself cannot be changed")
+		}
+	}
+	return entry, nil
+}
+
+// rootFor returns the allowed root containing p, preferring the deepest one
+// when roots are nested.
+func rootFor(p string) (FileRoot, bool) {
+	var best FileRoot
+	found := false
+	for _, root := range allowedRoots {
+		if isWithin(root.Path, p) && len(root.Path) >= len(best.Path) {
+			best = root
+			found = true
+		}
+	}
+	return best, found
+}
+
+// displayPath shows p relative to its root, e.g. "home:/projects/site".
+func displayPath(p string) string {
+	root, ok := rootFor(p)
+	if !ok {
+		return p
+	}
+	rel, err := filepath.Rel(root.Path, p)
+	if err != nil || rel == "." {
+		return root.Name + ":/"
+	}
+	return root.Name + ":/" + filepath.ToSlash(rel)
+}
+
+func isWithin(root, p string) bool {
+	if p == root {
+		return true
+	}
+	prefix := root
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	return strings.HasPrefix(p, prefix)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A dangling symlink that leads back to itself used to recurse until the
+// stack overflowed.
+func TestResolvePathSelfReferencingLink(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("FM_ROOTS", root)
+	if err := loadAllowedRoots(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("nonexist/../a", filepath.Join(root, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"a", "a/b"} {
+		if _, err := resolvePath(filepath.Join(root, p)); err != errSymlinkLoop {
+			t.Errorf("resolvePath(%s) = %v, want %v", p, err, errSymlinkLoop)
+		}
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchDepth = 20
+	maxSearchDepth     = 64
+	defaultSearchLimit = 500
+	maxSearchLimit     = 5000
+
+	// Content matching skips files larger than this, and reports at most
+	// maxMatchLines lines of each file, cut to maxMatchLineLength
+	maxSearchFileSize  = 32 << 20
+	maxMatchLines      = 5
+	maxMatchLineLength = 200
+
+	searchProgressInterval = 500 * time.Millisecond
+)
+
+var errSearchLimit = errors.New("search result limit reached")
+
+// searchQuery is the parsed form of a /api/search request. Every filter that
+// is set must match.
+type searchQuery struct {
+	root      string
+	name      string // glob on the base name
+	nameRE    *regexp.Regexp
+	contentRE *regexp.Regexp
+	fileType  string // "file", "dir" or "" for both
+	minSize   int64
+	maxSize   int64 // -1 for no limit
+	since     time.Time
+	depth     int
+	limit     int
+	gitignore bool
+	caseFold  bool
+}
+
+// parseSearchQuery reads the query parameters of /api/search:
+//
+//	path           where to start, defaults to the first root
+//	name           glob on the file name, e.g. "*.yml"
+//	regex          regular expression on the file name
+//	content        text the file must contain; a regular expression when
+//	               contentRegex=true
+//	type           "file" or "dir"
+//	minSize        smallest size, in bytes or with a K, M or G suffix
+//	maxSize        largest size
+//	since          modified within a duration such as "24h", or since a date
+//	depth          how many directory levels to descend, default 20
+//	limit          most results to return, default 500
+//	gitignore      "false" to also search files that .gitignore excludes
+//	case           "true" for case-sensitive name and content matching
+func parseSearchQuery(values map[string][]string) (*searchQuery, error) {
+	get := func(key string) string {
+		if v := values[key]; len(v) > 0 {
+			return strings.TrimSpace(v[0])
+		}
+		return ""
+	}
+
+	q := &searchQuery{
+		maxSize:   -1,
+		depth:     defaultSearchDepth,
+		limit:     defaultSearchLimit,
+		gitignore: get("gitignore") != "false",
+		caseFold:  get("case") != "true",
+	}
+
+	start := get("path")
+	if start == "" {
+		start = defaultRoot()
+	}
+	root, err := resolvePath(start)
+	if err != nil {
+		return nil, fmt.Errorf("Access denied: %v", err)
+	}
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		return nil, errors.New("Search path is not a directory")
+	}
+	q.root = root
+
+	flags := ""
+	if q.caseFold {
+		flags = "(?i)"
+	}
+
+	if q.name = get("name"); q.name != "" {
+		if q.caseFold {
+			q.name = strings.ToLower(q.name)
+		}
+		if _, err := filepath.Match(q.name, ""); err != nil {
+			return nil, fmt.Errorf("Invalid name pattern: %v", err)
+		}
+	}
+	if expr := get("regex"); expr != "" {
+		if q.nameRE, err = regexp.Compile(flags + expr); err != nil {
+			return nil, fmt.Errorf("Invalid name regex: %v", err)
+		}
+	}
+	if text := values["content"]; len(text) > 0 && text[0] != "" {
+		expr := regexp.QuoteMeta(text[0])
+		if get("contentRegex") == "true" {
+			expr = text[0]
+		}
+		if q.contentRE, err = regexp.Compile(flags + expr); err != nil {
+			return nil, fmt.Errorf("Invalid content regex: %v", err)
+		}
+	}
+
+	switch q.fileType = get("type"); q.fileType {
+	case "", "file", "dir":
+	default:
+		return nil, fmt.Errorf("Invalid type %q, expected file or dir", q.fileType)
+	}
+
+	if v := get("minSize"); v != "" {
+		if q.minSize, err = parseSize(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := get("maxSize"); v != "" {
+		if q.maxSize, err = parseSize(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := get("since"); v != "" {
+		if q.since, err = parseSince(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if v := get("depth"); v != "" {
+		if q.depth, err = strconv.Atoi(v); err != nil || q.depth < 1 {
+			return nil, fmt.Errorf("Invalid depth %q", v)
+		}
+		q.depth = min(q.depth, maxSearchDepth)
+	}
+	if v := get("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit < 1 {
+			return nil, fmt.Errorf("Invalid limit %q", v)
+		}
+		q.limit = min(q.limit, maxSearchLimit)
+	}
+	return q, nil
+}
+
+// parseSize accepts a byte count with an optional K, M or G suffix.
+func parseSize(v string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToUpper(v[len(v)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %q", v)
+	}
+	return n * multiplier, nil
+}
+
+// parseSince accepts a duration back from now, such as "24h", a date or an
+// RFC 3339 time.
+func parseSince(v string) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", v, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid since %q, expected a duration like 24h or a date like 2006-01-02", v)
+}
+
+type SearchMatch struct {
+	Path        string      `json:"path"`
+	DisplayPath string      `json:"displayPath"`
+	Name        string      `json:"name"`
+	IsDir       bool        `json:"isDir"`
+	Size        int64       `json:"size"`
+	ModTime     time.Time   `json:"modTime"`
+	Lines       []MatchLine `json:"lines,omitempty"`
+}
+
+type MatchLine struct {
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+type SearchSummary struct {
+	Matches   int    `json:"matches"`
+	Scanned   int    `json:"scanned"`
+	Skipped   int    `json:"skipped"`
+	Truncated bool   `json:"truncated"`
+	Error     string `json:"error,omitempty"`
+}
+
+type searcher struct {
+	ctx  context.Context
+	q    *searchQuery
+	emit func(event string, v interface{}) error
+
+	summary      SearchSummary
+	lastProgress time.Time
+}
+
+// walk searches dir, which is level levels below the start. Directories that
+// are symlinks are not followed, so the walk cannot loop or leave the roots.
+func (s *searcher) walk(dir string, level int, ignores []*ignoreList) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		s.summary.Skipped++
+		return nil
+	}
+	if s.q.gitignore {
+		if list := loadGitignore(dir); list != nil {
+			ignores = append(ignores[:len(ignores):len(ignores)], list)
+		}
+	}
+
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		if e.IsDir() && e.Name() == ".git" {
+			continue
+		}
+		if s.q.gitignore && isIgnored(ignores, p, e.IsDir()) {
+			continue
+		}
+		s.summary.Scanned++
+
+		if err := s.check(p, e); err != nil {
+			return err
+		}
+		if e.IsDir() && level < s.q.depth {
+			if err := s.walk(p, level+1, ignores); err != nil {
+				return err
+			}
+		}
+
+		if time.Since(s.lastProgress) >= searchProgressInterval {
+			s.lastProgress = time.Now()
+			err := s.emit("progress", map[string]interface{}{
+				"scanned": s.summary.Scanned,
+				"dir":     displayPath(dir),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// check applies the filters to one entry and emits it when it matches.
+func (s *searcher) check(p string, e os.DirEntry) error {
+	q := s.q
+	isDir := e.IsDir()
+	if (q.fileType == "file" && isDir) || (q.fileType == "dir" && !isDir) {
+		return nil
+	}
+	if isDir && (q.contentRE != nil || q.minSize > 0 || q.maxSize >= 0) {
+		return nil
+	}
+
+	name := e.Name()
+	if q.name != "" {
+		candidate := name
+		if q.caseFold {
+			candidate = strings.ToLower(name)
+		}
+		if ok, _ := filepath.Match(q.name, candidate); !ok {
+			return nil
+		}
+	}
+	if q.nameRE != nil && !q.nameRE.MatchString(name) {
+		return nil
+	}
+
+	info, err := e.Info()
+	if err != nil {
+		return nil
+	}
+	if !isDir && (info.Size() < q.minSize || (q.maxSize >= 0 && info.Size() > q.maxSize)) {
+		return nil
+	}
+	if !q.since.IsZero() && info.ModTime().Before(q.since) {
+		return nil
+	}
+
+	match := SearchMatch{
+		Path:        p,
+		DisplayPath: displayPath(p),
+		Name:        name,
+		IsDir:       isDir,
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+	}
+	if q.contentRE != nil {
+		// Symlinked files are not read, they may point outside the roots
+		if !info.Mode().IsRegular() || info.Size() > maxSearchFileSize {
+			return nil
+		}
+		lines, err := grepFile(s.ctx, p, q.contentRE)
+		if err != nil || len(lines) == 0 {
+			return err
+		}
+		match.Lines = lines
+	}
+
+	if err := s.emit("match", match); err != nil {
+		return err
+	}
+	s.summary.Matches++
+	if s.summary.Matches >= q.limit {
+		s.summary.Truncated = true
+		return errSearchLimit
+	}
+	return nil
+}
+
+// grepFile returns the first lines of a text file that match re. Binary files
+// and unreadable files count as not matching.
+func grepFile(ctx context.Context, p string, re *regexp.Regexp) ([]MatchLine, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+
+	br := bufio.NewReaderSize(f, editSniffSize)
+	head, _ := br.Peek(editSniffSize)
+	if !looksLikeText(head, len(head) == editSniffSize) {
+		return nil, nil
+	}
+
+	var lines []MatchLine
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		if n%1000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		line := scanner.Text()
+		if !re.MatchString(line) {
+			continue
+		}
+		if len(line) > maxMatchLineLength {
+			line = strings.ToValidUTF8(line[:maxMatchLineLength], "") + "…"
+		}
+		lines = append(lines, MatchLine{Line: n, Text: line})
+		if len(lines) == maxMatchLines {
+			break
+		}
+	}
+	return lines, nil
+}
+
+// parentIgnores loads the .gitignore files between the enclosing root and
+// dir, so searching a subdirectory of a repository still honours the rules
+// above it.
+func parentIgnores(dir string) []*ignoreList {
+	root, ok := rootFor(dir)
+	if !ok || root.Path == dir {
+		return nil
+	}
+	var dirs []string
+	for d := filepath.Dir(dir); isWithin(root.Path, d); d = filepath.Dir(d) {
+		dirs = append(dirs, d)
+		if d == root.Path {
+			break
+		}
+	}
+	var lists []*ignoreList
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if list := loadGitignore(dirs[i]); list != nil {
+			lists = append(lists, list)
+		}
+	}
+	return lists
+}
+
+// handleSearch walks the tree below a directory and streams each match as a
+// server-sent "match" event, with "progress" events while it works and a
+// final "done" event carrying a SearchSummary. Invalid queries also end in a
+// "done" event, with the error set. The walk stops as soon as the client goes
+// away.
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	emit := func(event string, v interface{}) error {
+		data, _ := json.Marshal(v)
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	q, err := parseSearchQuery(r.URL.Query())
+	if err != nil {
+		emit("done", SearchSummary{Error: err.Error()})
+		return
+	}
+
+	s := &searcher{ctx: r.Context(), q: q, emit: emit, lastProgress: time.Now()}
+	var ignores []*ignoreList
+	if q.gitignore {
+		ignores = parentIgnores(q.root)
+	}
+	err = s.walk(q.root, 1, ignores)
+	if err != nil && !errors.Is(err, errSearchLimit) {
+		if r.Context().Err() != nil {
+			return
+		}
+		s.summary.Error = err.Error()
+	}
+	emit("done", s.summary)
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+
+	"cf-manager/audit"
+	"cf-manager/auth"
+)
+
+const (
+	maxScrollback         = 256 * 1024
+	maxTerminalSessions   = 5
+	defaultTerminalCols   = 80
+	defaultTerminalRows   = 24
+	maxTerminalSize       = 1000
+	defaultTerminalIdle   = time.Hour
+	terminalReapInterval  = time.Minute
+	terminalReadChunkSize = 32 * 1024
+	terminalKillGrace     = 5 * time.Second
+)
+
+// TerminalSession is a login shell on a pseudo-terminal. It outlives the
+// WebSocket that started it, so a reloaded page can attach again and gets the
+// recent output replayed from the scrollback buffer.
+type TerminalSession struct {
+	ID        string
+	Owner     string
+	Dir       string
+	Shell     string
+	StartedAt time.Time
+
+	pty *os.File
+	cmd *exec.Cmd
+
+	mu         sync.Mutex
+	scrollback []byte
+	client     *wsConn
+	detachedAt time.Time
+	exited     bool
+	exitCode   int
+}
+
+// TerminalInfo is the JSON view of a session.
+type TerminalInfo struct {
+	ID        string    `json:"id"`
+	Dir       string    `json:"dir"`
+	Shell     string    `json:"shell"`
+	StartedAt time.Time `json:"startedAt"`
+	Attached  bool      `json:"attached"`
+}
+
+// terminalMessage is a control message. The browser sends "input" and
+// "resize"; the server sends "session", "exit", "detached" and "error".
+type terminalMessage struct {
+	Type    string `json:"type"`
+	Data    string `json:"data,omitempty"`
+	Cols    int    `json:"cols,omitempty"`
+	Rows    int    `json:"rows,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Dir     string `json:"dir,omitempty"`
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+var (
+	terminalsMu sync.Mutex
+	terminals   = make(map[string]*TerminalSession)
+	// terminalsStarting counts the shells of each user being started, which
+	// take up a slot before they are in terminals
+	terminalsStarting = make(map[string]int)
+
+	terminalIdle = defaultTerminalIdle
+	reaperOnce   sync.Once
+)
+
+// loadTerminalLimits reads FM_TERMINAL_IDLE_TIMEOUT, how long a shell with no
+// browser attached is kept alive.
+func loadTerminalLimits() error {
+	if v := os.Getenv("FM_TERMINAL_IDLE_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid FM_TERMINAL_IDLE_TIMEOUT %q", v)
+		}
+		terminalIdle = d
+	}
+	return nil
+}
+
+// releaseTerminalSlot gives up a slot taken by startTerminal. Callers hold
+// terminalsMu.
+func releaseTerminalSlot(owner string) {
+	if terminalsStarting[owner]--; terminalsStarting[owner] <= 0 {
+		delete(terminalsStarting, owner)
+	}
+}
+
+// loginShell picks $SHELL, then bash, then sh.
+func loginShell() string {
+	if shell := os.Getenv("SHELL"); shell != "" {
+		if _, err := os.Stat(shell); err == nil {
+			return shell
+		}
+	}
+	if path, err := exec.LookPath("bash"); err == nil {
+		return path
+	}
+	return "sh"
+}
+
+// startTerminal starts a login shell in dir on a new pseudo-terminal.
+func startTerminal(owner, dir string, cols, rows int) (*TerminalSession, error) {
+	terminalsMu.Lock()
+	count := terminalsStarting[owner]
+	for _, s := range terminals {
+		if s.Owner == owner {
+			count++
+		}
+	}
+	if count >= maxTerminalSessions {
+		terminalsMu.Unlock()
+		return nil, fmt.Errorf("too many open terminals (limit %d); close one first", maxTerminalSessions)
+	}
+	terminalsStarting[owner]++
+	terminalsMu.Unlock()
+	// The slot passes to the session once it is in terminals
+	started := false
+	defer func() {
+		if !started {
+			terminalsMu.Lock()
+			releaseTerminalSlot(owner)
+			terminalsMu.Unlock()
+		}
+	}()
+
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	master, slave, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+	defer slave.Close()
+
+	if err := setPTYSize(master, cols, rows); err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	shell := loginShell()
+	cmd := exec.Command(shell, "-l")
+	cmd.Dir = dir
+	cmd.Env = append(terminalEnv(), "PWD="+dir)
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+
+	if err := cmd.Start(); err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	s := &TerminalSession{
+		ID:         id,
+		Owner:      owner,
+		Dir:        dir,
+		Shell:      shell,
+		StartedAt:  time.Now(),
+		pty:        master,
+		cmd:        cmd,
+		detachedAt: time.Now(),
+	}
+
+	terminalsMu.Lock()
+	terminals[id] = s
+	releaseTerminalSlot(owner)
+	started = true
+	terminalsMu.Unlock()
+	reaperOnce.Do(func() { go reapTerminals() })
+
+	go s.pump()
+	log.Printf("Terminal %s started for %s: %s in %s", id, owner, shell, dir)
+	return s, nil
+}
+
+// terminalEnv is the server's environment with a terminal type browsers'
+// xterm.js understands.
+func terminalEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "TERM=") || strings.HasPrefix(kv, "COLORTERM=") || strings.HasPrefix(kv, "PWD=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return append(env, "TERM=xterm-256color", "COLORTERM=truecolor")
+}
+
+func getTerminal(id, owner string) (*TerminalSession, bool) {
+	terminalsMu.Lock()
+	defer terminalsMu.Unlock()
+	s, ok := terminals[id]
+	if !ok || s.Owner != owner {
+		return nil, false
+	}
+	return s, true
+}
+
+// pump copies the shell's output into the scrollback and to the attached
+// browser until the shell exits.
+func (s *TerminalSession) pump() {
+	buf := make([]byte, terminalReadChunkSize)
+	for {
+		n, err := s.pty.Read(buf)
+		if n > 0 {
+			s.mu.Lock()
+			s.scrollback = append(s.scrollback, buf[:n]...)
+			if len(s.scrollback) > maxScrollback {
+				s.scrollback = append([]byte(nil), s.scrollback[len(s.scrollback)-maxScrollback:]...)
+			}
+			if s.client != nil {
+				if werr := s.client.WriteMessage(wsOpBinary, buf[:n]); werr != nil {
+					s.client.CloseWith(wsCloseGoingAway, "write failed")
+					s.client = nil
+					s.detachedAt = time.Now()
+				}
+			}
+			s.mu.Unlock()
+		}
+		if err != nil {
+			// EIO once the shell and everything it started have exited
+			break
+		}
+	}
+
+	err := s.cmd.Wait()
+	s.pty.Close()
+
+	s.mu.Lock()
+	s.exited = true
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		s.exitCode = exitErr.ExitCode()
+	}
+	if s.client != nil {
+		s.sendLocked(terminalMessage{Type: "exit", Code: s.exitCode})
+		s.client.CloseWith(wsCloseNormal, "shell exited")
+		s.client = nil
+	}
+	s.mu.Unlock()
+
+	terminalsMu.Lock()
+	delete(terminals, s.ID)
+	terminalsMu.Unlock()
+	log.Printf("Terminal %s exited with code %d", s.ID, s.exitCode)
+}
+
+// attach makes c the session's browser, replacing any other tab, and replays
+// the scrollback so the screen comes back after a reload.
+func (s *TerminalSession) attach(c *wsConn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.exited {
+		return errors.New("terminal has exited")
+	}
+	if s.client != nil {
+		s.sendLocked(terminalMessage{Type: "detached", Message: "This terminal was opened in another window"})
+		s.client.CloseWith(wsCloseNormal, "attached elsewhere")
+	}
+	s.client = c
+
+	err := s.sendLocked(terminalMessage{Type: "session", ID: s.ID, Dir: displayPath(s.Dir)})
+	if err == nil && len(s.scrollback) > 0 {
+		err = c.WriteMessage(wsOpBinary, s.scrollback)
+	}
+	if err != nil {
+		s.client = nil
+		s.detachedAt = time.Now()
+	}
+	return err
+}
+
+func (s *TerminalSession) detach(c *wsConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == c {
+		s.client = nil
+		s.detachedAt = time.Now()
+	}
+}
+
+func (s *TerminalSession) sendLocked(msg terminalMessage) error {
+	data, _ := json.Marshal(msg)
+	return s.client.WriteMessage(wsOpText, data)
+}
+
+// Close hangs up the shell's whole session, and kills it if it is still
+// around a few seconds later.
+func (s *TerminalSession) Close() {
+	pid := s.cmd.Process.Pid
+	syscall.Kill(-pid, syscall.SIGHUP)
+	s.pty.Close()
+
+	time.AfterFunc(terminalKillGrace, func() {
+		s.mu.Lock()
+		exited := s.exited
+		s.mu.Unlock()
+		if !exited {
+			syscall.Kill(-pid, syscall.SIGKILL)
+		}
+	})
+}
+
+func (s *TerminalSession) Info() TerminalInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return TerminalInfo{
+		ID:        s.ID,
+		Dir:       displayPath(s.Dir),
+		Shell:     s.Shell,
+		StartedAt: s.StartedAt,
+		Attached:  s.client != nil,
+	}
+}
+
+// reapTerminals closes shells nobody has looked at for terminalIdle.
+func reapTerminals() {
+	for range time.Tick(terminalReapInterval) {
+		terminalsMu.Lock()
+		var idle []*TerminalSession
+		for _, s := range terminals {
+			s.mu.Lock()
+			if s.client == nil && time.Since(s.detachedAt) > terminalIdle {
+				idle = append(idle, s)
+			}
+			s.mu.Unlock()
+		}
+		terminalsMu.Unlock()
+
+		for _, s := range idle {
+			log.Printf("Closing terminal %s after %s without a browser attached", s.ID, terminalIdle)
+			s.Close()
+		}
+	}
+}
+
+// handleTerminalSocket upgrades to a WebSocket and attaches it to the session
+// named by ?session=, or starts a new shell in ?path= sized ?cols= by ?rows=.
+// After the upgrade, problems are reported as "error" messages because a
+// browser cannot read the body of a failed handshake.
+func handleTerminalSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.Printf("Terminal WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	fail := func(message string) {
+		data, _ := json.Marshal(terminalMessage{Type: "error", Message: message})
+		conn.WriteMessage(wsOpText, data)
+		conn.CloseWith(wsClosePolicy, "")
+	}
+
+	if currentPolicy().Shell == PolicyDeny {
+		log.Printf("Command policy denied the interactive shell to %s", auth.Actor(r))
+		audit.Record(r, "command.deny", "interactive shell", "", "policy shell: deny", errors.New("interactive shell is disabled"))
+		fail("The interactive shell is disabled by the command policy")
+		return
+	}
+
+	owner := auth.Username(r)
+	query := r.URL.Query()
+
+	var session *TerminalSession
+	if id := query.Get("session"); id != "" {
+		s, ok := getTerminal(id, owner)
+		if !ok {
+			fail("Terminal session not found; it may have exited")
+			return
+		}
+		session = s
+	} else {
+		dir := defaultRoot()
+		if p := query.Get("path"); p != "" {
+			resolved, err := resolvePath(p)
+			if err != nil {
+				fail("Access denied: " + err.Error())
+				return
+			}
+			if fi, err := os.Stat(resolved); err != nil || !fi.IsDir() {
+				fail("Not a directory: " + p)
+				return
+			}
+			dir = resolved
+		}
+
+		s, err := startTerminal(owner, dir, terminalSize(query.Get("cols"), defaultTerminalCols), terminalSize(query.Get("rows"), defaultTerminalRows))
+		if err != nil {
+			fail("Failed to start terminal: " + err.Error())
+			return
+		}
+		log.Printf("Terminal %s opened by %s", s.ID, auth.Actor(r))
+		session = s
+	}
+
+	if err := session.attach(conn); err != nil {
+		fail(err.Error())
+		return
+	}
+	defer session.detach(conn)
+
+	for {
+		opcode, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if opcode == wsOpBinary {
+			session.pty.Write(data)
+			continue
+		}
+
+		var msg terminalMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		switch msg.Type {
+		case "input":
+			session.pty.Write([]byte(msg.Data))
+		case "resize":
+			if msg.Cols > 0 && msg.Rows > 0 {
+				setPTYSize(session.pty, min(msg.Cols, maxTerminalSize), min(msg.Rows, maxTerminalSize))
+			}
+		}
+	}
+}
+
+func terminalSize(v string, fallback int) int {
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 || n > maxTerminalSize {
+		return fallback
+	}
+	return n
+}
+
+// handleListTerminals lists the caller's open shells, newest first.
+func handleListTerminals(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	owner := auth.Username(r)
+	terminalsMu.Lock()
+	list := make([]TerminalInfo, 0, len(terminals))
+	for _, s := range terminals {
+		if s.Owner == owner {
+			list = append(list, s.Info())
+		}
+	}
+	terminalsMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartedAt.After(list[j].StartedAt)
+	})
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleCloseTerminal hangs up the shell named by ?id=.
+func handleCloseTerminal(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s, ok := getTerminal(r.URL.Query().Get("id"), auth.Username(r))
+	if !ok {
+		json.NewEncoder(w).Encode(map[string]string{"error": "Terminal not found"})
+		return
+	}
+	s.Close()
+	log.Printf("Terminal %s closed by %s", s.ID, auth.Actor(r))
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+type TerminalPageData struct {
+	CSRFToken   string
+	Path        string
+	DisplayPath string
+	Command     string
+}
+
+// handleTerminalPage serves the xterm.js page. ?path= picks the directory for
+// a new shell and ?cmd= is typed into it once it starts, without being run:
+// the user has to press Enter. A cmd with control characters, which could
+// smuggle in a line break that runs it anyway, is left out, and so is one
+// the command policy denies.
+func handleTerminalPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	data := TerminalPageData{
+		CSRFToken: auth.CSRFToken(r),
+		Path:      defaultRoot(),
+		Command:   r.URL.Query().Get("cmd"),
+	}
+	if p := r.URL.Query().Get("path"); p != "" {
+		if resolved, err := resolvePath(p); err == nil {
+			data.Path = resolved
+		}
+	}
+	if strings.IndexFunc(data.Command, unicode.IsControl) >= 0 ||
+		currentPolicy().Evaluate(data.Command, data.Path).Action == PolicyDeny {
+		data.Command = ""
+	}
+	data.DisplayPath = displayPath(data.Path)
+
+	if err := terminalTmpl.Execute(w, data); err != nil {
+		http.Error(w, "Error rendering template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"cf-manager/audit"
+)
+
+const (
+	defaultVersionsDir  = "versions"
+	defaultVersionsKeep = 10
+)
+
+var (
+	versionsDir  = defaultVersionsDir
+	versionsKeep = defaultVersionsKeep
+
+	// saveMu makes the stale check and the write of an editor save one step,
+	// so two tabs saving together cannot both pass the check.
+	saveMu sync.Mutex
+
+	errFileChanged = errors.New("the file was changed on disk since it was opened")
+)
+
+// loadVersionSettings reads FM_VERSIONS_DIR, where earlier contents of saved
+// files are kept, and FM_VERSIONS_KEEP, how many are kept per file. Setting
+// FM_VERSIONS_KEEP to 0 turns the history off.
+func loadVersionSettings() error {
+	if v := os.Getenv("FM_VERSIONS_DIR"); v != "" {
+		versionsDir = v
+	}
+	if v := os.Getenv("FM_VERSIONS_KEEP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid FM_VERSIONS_KEEP %q", v)
+		}
+		versionsKeep = n
+	}
+	if versionsKeep == 0 {
+		return nil
+	}
+	return os.MkdirAll(versionsDir, 0700)
+}
+
+type FileVersion struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+// fileETag identifies one exact content of a file. It is a content hash rather
+// than the mtime so that edits made within the same second are still noticed.
+func fileETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// versionDirFor returns the history directory of p, named after a hash of the
+// path. A "path" file inside records which file it belongs to.
+func versionDirFor(p string) string {
+	sum := sha256.Sum256([]byte(p))
+	return filepath.Join(versionsDir, hex.EncodeToString(sum[:12]))
+}
+
+// listVersions returns the kept versions of p, newest first.
+func listVersions(p string) ([]FileVersion, error) {
+	versions := []FileVersion{}
+	entries, err := os.ReadDir(versionDirFor(p))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return versions, nil
+		}
+		return nil, err
+	}
+	for _, e := range entries {
+		nanos, err := strconv.ParseInt(e.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, FileVersion{
+			ID:   e.Name(),
+			Time: time.Unix(0, nanos),
+			Size: info.Size(),
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Time.After(versions[j].Time)
+	})
+	return versions, nil
+}
+
+func readVersion(p, id string) ([]byte, error) {
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid version %q", id)
+	}
+	content, err := os.ReadFile(filepath.Join(versionDirFor(p), id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("version %s not found", id)
+	}
+	return content, err
+}
+
+// recordVersion keeps content as the newest version of p, unless it already
+// is, and drops the oldest ones beyond versionsKeep.
+func recordVersion(p string, content []byte) error {
+	if versionsKeep == 0 {
+		return nil
+	}
+	versions, err := listVersions(p)
+	if err != nil {
+		return err
+	}
+	if len(versions) > 0 {
+		if latest, err := readVersion(p, versions[0].ID); err == nil && bytes.Equal(latest, content) {
+			return nil
+		}
+	}
+
+	dir := versionDirFor(p)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "path"), []byte(p+"\n"), 0600); err != nil {
+		return err
+	}
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := os.WriteFile(filepath.Join(dir, id), content, 0600); err != nil {
+		return err
+	}
+
+	versions = append([]FileVersion{{ID: id}}, versions...)
+	for _, v := range versions[min(len(versions), versionsKeep):] {
+		os.Remove(filepath.Join(dir, v.ID))
+	}
+	return nil
+}
+
+// writeFileAtomic replaces p through a temporary file in the same directory,
+// so nobody ever reads a half written file, and keeps the mode and, where
+// permitted, the owner of the original.
+func writeFileAtomic(p string, content []byte) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".save-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	mode := fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		os.Chown(tmp.Name(), int(st.Uid), int(st.Gid))
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// replaceFile writes content to p, keeping what it replaces as a version. When
+// etag is set and p no longer matches it, nothing is written and
+// errFileChanged is returned. The ETag of the file afterwards is returned
+// either way.
+func replaceFile(p, etag string, content []byte) (string, error) {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	current, err := os.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	currentETag := fileETag(current)
+	if etag != "" && etag != currentETag {
+		return currentETag, errFileChanged
+	}
+	if bytes.Equal(current, content) {
+		return currentETag, nil
+	}
+
+	if err := recordVersion(p, current); err != nil {
+		log.Printf("Warning: could not keep the previous version of %s: %v", p, err)
+	}
+	if err := writeFileAtomic(p, content); err != nil {
+		return currentETag, err
+	}
+	return fileETag(content), nil
+}
+
+// writeReplaceError reports a failed replaceFile. A conflict carries the
+// current ETag so the client can choose to overwrite anyway.
+func writeReplaceError(w http.ResponseWriter, etag string, err error) {
+	if errors.Is(err, errFileChanged) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":    "The file was changed on disk since you opened it",
+			"conflict": true,
+			"etag":     etag,
+		})
+		return
+	}
+	writeFileError(w, "Failed to write file: "+err.Error())
+}
+
+// resolveVersionedFile resolves the path parameter of the history endpoints
+// to an existing regular file.
+func resolveVersionedFile(p string) (string, error) {
+	resolved, err := resolvePath(p)
+	if err != nil {
+		return "", fmt.Errorf("Access denied: %v", err)
+	}
+	fi, err := os.Stat(resolved)
+	if err != nil {
+		return "", fmt.Errorf("File not found or accessible: %v", err)
+	}
+	if fi.IsDir() {
+		return "", errors.New("Directories have no version history")
+	}
+	return resolved, nil
+}
+
+func handleFileVersions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath, err := resolveVersionedFile(r.URL.Query().Get("path"))
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+
+	versions, err := listVersions(filePath)
+	if err != nil {
+		writeFileError(w, "Failed to list versions: "+err.Error())
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":        filePath,
+		"displayPath": displayPath(filePath),
+		"versions":    versions,
+	})
+}
+
+// handleFileDiff shows what changed between a kept version and the current
+// file, or another version when "against" is given.
+func handleFileDiff(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filePath, err := resolveVersionedFile(query.Get("path"))
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+
+	id := query.Get("version")
+	from, err := readVersion(filePath, id)
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+
+	against := query.Get("against")
+	var to []byte
+	toName := displayPath(filePath) + " (current)"
+	if against == "" {
+		to, err = os.ReadFile(filePath)
+	} else {
+		to, err = readVersion(filePath, against)
+		toName = versionName(filePath, against)
+	}
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"diff": unifiedDiff(versionName(filePath, id), toName, from, to),
+	})
+}
+
+func versionName(p, id string) string {
+	nanos, _ := strconv.ParseInt(id, 10, 64)
+	return fmt.Sprintf("%s (%s)", displayPath(p), time.Unix(0, nanos).Format("2006-01-02 15:04:05"))
+}
+
+type RestoreVersionRequest struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	ETag    string `json:"etag"`
+}
+
+// handleRestoreVersion puts a kept version back. The content it replaces
+// becomes a version itself, so a restore can be undone.
+func handleRestoreVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RestoreVersionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFileError(w, "Invalid request format: "+err.Error())
+		return
+	}
+
+	filePath, err := resolveVersionedFile(req.Path)
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+	content, err := readVersion(filePath, req.Version)
+	if err != nil {
+		writeFileError(w, err.Error())
+		return
+	}
+
+	etag, err := replaceFile(filePath, req.ETag, content)
+	audit.Record(r, "file.restore", displayPath(filePath), "", versionName(filePath, req.Version), err)
+	if err != nil {
+		writeReplaceError(w, etag, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"etag":    etag,
+	})
+}